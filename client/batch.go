@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"sync"
+)
+
+// CallRequest is one call of CallAll.
+type CallRequest struct {
+	Addr models.Addr
+	Path string
+	Req  []byte
+}
+
+// CallResult is the outcome of the CallRequest at the same index.
+type CallResult struct {
+	Rsp []byte
+	Err error
+}
+
+// CallAll issues reqs concurrently, at most PoolMaxCapacity at a time so the
+// conns they use can all go back to the pool. Every request gets a result.
+//
+// With failFast the first failure cancels the calls still running or waiting
+// and is returned, otherwise all calls run and the failures are returned as
+// errors.Errors. The returned error is nil only if every call succeeded.
+func (cli *Client) CallAll(ctx context.Context, reqs []*CallRequest, failFast bool) ([]*CallResult, error) {
+	results := make([]*CallResult, len(reqs))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	slots := make(chan struct{}, cli.concurrency(len(reqs)))
+
+	for i, req := range reqs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = &CallResult{Err: ctx.Err()}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, req *CallRequest) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			rsp, err := cli.Call(ctx, req.Addr, req.Path, req.Req)
+			results[i] = &CallResult{Rsp: rsp, Err: err}
+			if err != nil && failFast {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i, req)
+	}
+	wg.Wait()
+
+	if failFast {
+		if firstErr == nil && ctx.Err() != nil {
+			// 外部ctx结束, 部分请求没有发出
+			for _, result := range results {
+				if result.Err != nil {
+					return results, result.Err
+				}
+			}
+		}
+		return results, firstErr
+	}
+
+	var errs errors.Errors
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+func (cli *Client) concurrency(count int) int {
+	limit := cli.transport.connPool.maxCapacityPerKey
+	if limit <= 0 || limit > count {
+		limit = count
+	}
+	if limit <= 0 {
+		limit = 1
+	}
+	return limit
+}
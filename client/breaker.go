@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+)
+
+// BreakerState is the state of the circuit breaker of one address.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls go through
+	BreakerOpen                         // calls fail with errors.StatusCircuitOpen until Cooldown elapsed
+	BreakerHalfOpen                     // one probe call goes through, its result closes or reopens
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerConfig trips a per address (CID:port) breaker. A call fails when it
+// gets no answer (conn errors, timeouts) or a server status >= 500 like busy;
+// an errors.AppError or the caller cancelling is not a failure of the server.
+type BreakerConfig struct {
+	// Failures consecutive failures trip the breaker, 0 disables the count.
+	Failures int
+
+	// FailureRate of the calls within Window trips the breaker once at least
+	// MinRequests were made within it, 0 disables the rate.
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration // constant.BreakerWindow if 0
+
+	// Cooldown an open breaker waits before letting a probe through, constant.BreakerCooldown if 0.
+	Cooldown time.Duration
+
+	// OnStateChange is called on every transition, addr is "uri:port".
+	OnStateChange func(addr string, from, to BreakerState)
+}
+
+func (cfg *BreakerConfig) window() time.Duration {
+	if cfg.Window > 0 {
+		return cfg.Window
+	}
+	return constant.BreakerWindow
+}
+
+func (cfg *BreakerConfig) cooldown() time.Duration {
+	if cfg.Cooldown > 0 {
+		return cfg.Cooldown
+	}
+	return constant.BreakerCooldown
+}
+
+type breaker struct {
+	state    BreakerState
+	openedAt time.Time
+	probing  bool // half open, the probe call is in flight
+
+	consecutive int
+	windowAt    time.Time
+	calls       int
+	failures    int
+}
+
+// breakers holds the breakers of a Transport, nil config disables them.
+type breakers struct {
+	config *BreakerConfig
+	mutex  sync.Mutex
+	hosts  map[connectKey]*breaker
+}
+
+// allow reports if a call to key may go out, a half open breaker lets one probe through.
+func (bs *breakers) allow(key connectKey) error {
+	if bs.config == nil {
+		return nil
+	}
+	notify := func() {}
+	defer func() { notify() }() // 解锁之后再回调
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	b := bs.hostLocked(key)
+	switch b.state {
+	case BreakerOpen:
+		wait := bs.config.cooldown() - time.Since(b.openedAt)
+		if wait > 0 {
+			return errors.StatusCircuitOpen.WithRetryAfter(wait)
+		}
+		notify = bs.setLocked(key, b, BreakerHalfOpen)
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return errors.StatusCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record counts the result of a call allowed by allow.
+func (bs *breakers) record(key connectKey, failed bool) {
+	if bs.config == nil {
+		return
+	}
+	notify := func() {}
+	defer func() { notify() }()
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	b := bs.hostLocked(key)
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.openedAt = time.Now()
+			notify = bs.setLocked(key, b, BreakerOpen)
+		} else {
+			b.reset()
+			notify = bs.setLocked(key, b, BreakerClosed)
+		}
+		return
+	case BreakerOpen:
+		return // 打开前已发出的请求
+	}
+
+	now := time.Now()
+	if now.Sub(b.windowAt) > bs.config.window() {
+		b.windowAt, b.calls, b.failures = now, 0, 0
+	}
+	b.calls++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+	b.failures++
+
+	cfg := bs.config
+	if (cfg.Failures > 0 && b.consecutive >= cfg.Failures) ||
+		(cfg.FailureRate > 0 && b.calls >= cfg.MinRequests && float64(b.failures) >= cfg.FailureRate*float64(b.calls)) {
+		b.reset()
+		b.openedAt = now
+		notify = bs.setLocked(key, b, BreakerOpen)
+	}
+}
+
+// state of the breaker to addr, BreakerClosed if breakers are disabled.
+func (bs *breakers) state(addr models.Addr) BreakerState {
+	if bs.config == nil {
+		return BreakerClosed
+	}
+	var key connectKey
+	key.From(addr)
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	return bs.hostLocked(key).state
+}
+
+func (bs *breakers) hostLocked(key connectKey) *breaker {
+	if bs.hosts == nil {
+		bs.hosts = make(map[connectKey]*breaker)
+	}
+	b, ok := bs.hosts[key]
+	if !ok {
+		b = &breaker{windowAt: time.Now()}
+		bs.hosts[key] = b
+	}
+	return b
+}
+
+// setLocked moves b to state, the returned func calls OnStateChange and
+// must run once bs.mutex is released.
+func (bs *breakers) setLocked(key connectKey, b *breaker, state BreakerState) func() {
+	from := b.state
+	b.state = state
+	fn := bs.config.OnStateChange
+	if fn == nil || from == state {
+		return func() {}
+	}
+	return func() { fn(key.String(), from, state) }
+}
+
+func (b *breaker) reset() {
+	b.consecutive, b.calls, b.failures = 0, 0, 0
+	b.windowAt = time.Now()
+}
+
+// breakerFailure reports if a round trip result counts against the server.
+func breakerFailure(ctx context.Context, rsp *models.Response, err error) bool {
+	if err == nil {
+		err = rsp.Err
+	} else if ctx.Err() == context.Canceled {
+		return false
+	}
+	status, ok := err.(*errors.Status)
+	if !ok {
+		return err != nil && !errors.As(err, new(*errors.AppError))
+	}
+	// 1xxx是客户端自己产生的, 不是服务端的问题
+	return status.Code() >= 500 && status.Code() < 1000
+}
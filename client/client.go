@@ -2,6 +2,9 @@ package client
 
 import (
 	"context"
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/metadata"
 	"github.com/brodyxchen/vsock-sdk/models"
 	"github.com/brodyxchen/vsock-sdk/protocols"
 	"github.com/brodyxchen/vsock-sdk/statistics"
@@ -9,6 +12,7 @@ import (
 	"google.golang.org/protobuf/proto"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,11 +29,22 @@ func (cli *Client) Init(cfg *Config) {
 				pool:              make(map[connectKey][]*PersistConn, 0),
 				mutex:             sync.RWMutex{},
 				idleTimeout:       cfg.GetPoolIdleTimeout(),
-				maxCapacityPerKey: cfg.GetPoolMaxCapacity(),
+				maxCapacityPerKey: cfg.GetMaxIdleConnsPerHost(),
+				maxIdle:           cfg.MaxIdleConns,
 			},
-			WriteBufferSize: cfg.GetWriteBufferSize(),
-			ReadBufferSize:  cfg.GetReadBufferSize(),
-			connIndex:       0,
+			WriteBufferSize:   cfg.GetWriteBufferSize(),
+			ReadBufferSize:    cfg.GetReadBufferSize(),
+			PoolValidateAfter: cfg.GetPoolValidateAfter(),
+			MaxConnsPerHost:   cfg.MaxConnsPerHost,
+			Version:           cfg.GetVersion(),
+			breakers:          breakers{config: cfg.Breaker},
+			retryBudget:       retryBudget{config: cfg.RetryBudget},
+			Dialer:            cfg.Dialer,
+			Signer:            cfg.Signer,
+			MaxFrameSize:      cfg.MaxFrameSize,
+			StreamWindow:      cfg.StreamWindow,
+			FirstByteTimeout:  cfg.FirstByteTimeout,
+			connIndex:         0,
 		}
 	}
 
@@ -59,42 +74,117 @@ func (cli *Client) Init(cfg *Config) {
 }
 
 func (cli *Client) Do(addr models.Addr, path string, req []byte) ([]byte, error) {
-	return cli.send(addr, path, req, cli.deadline())
+	return cli.send(context.Background(), addr, path, req, cli.deadline())
 }
 
-func (cli *Client) send(addr models.Addr, path string, body []byte, deadline time.Time) ([]byte, error) {
-	ctx := context.Background()
+// Call sends req to path like Do, but takes a context: its deadline bounds the call
+// (cli.Timeout applies when ctx has none) and its outgoing metadata is sent along.
+// A stream response failing after part of it was written returns that part
+// along with an error matching errors.ErrStreamAborted.
+func (cli *Client) Call(ctx context.Context, addr models.Addr, path string, req []byte) ([]byte, error) {
+	deadline := time.Time{}
+	if _, ok := ctx.Deadline(); !ok {
+		deadline = cli.deadline()
+	}
+	return cli.send(ctx, addr, path, req, deadline)
+}
+
+func (cli *Client) send(ctx context.Context, addr models.Addr, path string, body []byte, deadline time.Time) ([]byte, error) {
+	rsp, err := cli.call(ctx, addr, path, body, deadline)
+
+	// 系统错误
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unexpectedCode(ctx, rsp.Err); err != nil {
+		return nil, err
+	}
+
+	// 业务错误, 中途失败的流式响应带着已收到的部分
+	if rsp.Err != nil {
+		return rsp.Body, rsp.Err
+	}
+
+	return rsp.Body, nil
+}
+
+// call does one round trip, the handler outcome is left in the models.Response.
+func (cli *Client) call(ctx context.Context, addr models.Addr, path string, body []byte, deadline time.Time) (*models.Response, error) {
 	if !deadline.IsZero() {
 		ctxDeadline, cancel := context.WithDeadline(ctx, deadline)
 		defer cancel()
 		ctx = ctxDeadline
 	}
 
-	pbReq := &protocols.Request{
-		Path: path,
-		Req:  body,
+	bodyBytes, err := marshalRequest(ctx, path, body)
+	if err != nil {
+		return nil, err
 	}
-	bodyBytes, _ := proto.Marshal(pbReq)
 
 	req := &models.Request{
-		Ctx:  ctx,
-		Addr: addr,
-		Body: bodyBytes,
+		Ctx:        ctx,
+		Addr:       addr,
+		Body:       bodyBytes,
+		Idempotent: isIdempotent(ctx),
 	}
 
 	rsp, err := cli.transport.roundTrip(req)
-
-	// 系统错误
 	if err != nil {
 		return nil, err
 	}
 
-	// 业务错误
-	if rsp.Err != nil {
-		return nil, rsp.Err
+	if trailer, ok := ctx.Value(trailerKey{}).(*metadata.MD); ok {
+		*trailer = rsp.Trailer
 	}
+	return rsp, nil
+}
 
-	return rsp.Body, nil
+// marshalRequest builds the protocols.Request for path, carrying the outgoing metadata of ctx.
+func marshalRequest(ctx context.Context, path string, body []byte) ([]byte, error) {
+	pbReq := &protocols.Request{
+		Path: path,
+		Req:  body,
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md) > 0 {
+		if md.Size() > constant.MaxMetadataSize {
+			return nil, errors.ErrExceedMetadata
+		}
+		pbReq.Meta = md
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// 传剩余时长而不是绝对时间, 避免两端时钟不一致
+		timeout := time.Until(deadline).Milliseconds()
+		if timeout <= 0 {
+			timeout = 1
+		}
+		pbReq.Timeout = timeout
+	}
+	return proto.Marshal(pbReq)
+}
+
+// PoolStats counts the conns of a client, Active are the ones in use.
+type PoolStats struct {
+	Idle   int
+	Active int
+}
+
+// BreakerState returns the state of the breaker to addr, BreakerClosed without Config.Breaker.
+func (cli *Client) BreakerState(addr models.Addr) BreakerState {
+	return cli.transport.breakers.state(addr)
+}
+
+// RetryBudgetStats returns the state of the retry budget, zero without Config.RetryBudget.
+func (cli *Client) RetryBudgetStats() RetryBudgetStats {
+	return cli.transport.retryBudget.stats()
+}
+
+func (cli *Client) PoolStats() PoolStats {
+	idle := cli.transport.connPool.IdleCount()
+	return PoolStats{
+		Idle:   idle,
+		Active: int(atomic.LoadInt64(&cli.transport.openConns)) - idle,
+	}
 }
 
 func (cli *Client) DialTest(addr models.Addr) (*PersistConn, error) {
@@ -110,11 +200,10 @@ func (cli *Client) SendTest(addr models.Addr, path string, body []byte, deadline
 		ctx = ctxDeadline
 	}
 
-	pbReq := &protocols.Request{
-		Path: path,
-		Req:  body,
+	bodyBytes, err := marshalRequest(ctx, path, body)
+	if err != nil {
+		return -1, nil, err
 	}
-	bodyBytes, _ := proto.Marshal(pbReq)
 
 	req := &models.Request{
 		Ctx:  ctx,
@@ -0,0 +1,647 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/socket"
+	"github.com/brodyxchen/vsock-sdk/statistics"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestClient(cfg *Config) *Client {
+	statistics.InitClient()
+
+	cli := &Client{
+		Timeout: cfg.GetTimeout(),
+	}
+	cli.Init(cfg)
+	return cli
+}
+
+// startRawServer answers every request frame of every accepted conn with reply.
+func startRawServer(t *testing.T, reply func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte)) models.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		var index int64
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveRaw(conn, &index, reply)
+		}
+	}()
+
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	return &models.HttpAddr{IP: tcpAddr.IP.String(), Port: uint32(tcpAddr.Port)}
+}
+
+// serveRaw answers the request frames of conn with reply until it closes,
+// index counts the requests over all conns.
+func serveRaw(conn net.Conn, index *int64, reply func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte)) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		_, body, _, err := socket.ReadSocket(context.Background(), reader)
+		if err != nil {
+			return
+		}
+		var req protocols.Request
+		if err := proto.Unmarshal(body, &req); err != nil {
+			return
+		}
+		header, rsp := reply(conn, int(atomic.AddInt64(index, 1)-1), &req)
+		if header == nil {
+			continue
+		}
+		if _, err := socket.WriteSocket(context.Background(), writer, header, rsp); err != nil {
+			return
+		}
+	}
+}
+
+func statusFrame(status *errors.Status) (*models.Header, []byte) {
+	return &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    status.Code(),
+	}, status.Encode()
+}
+
+func successFrame(rsp []byte) (*models.Header, []byte) {
+	body, _ := proto.Marshal(&protocols.Response{Code: protocols.StatusOK, Rsp: rsp})
+	return &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+	}, body
+}
+
+func TestRetryAfterHonored(t *testing.T) {
+	retryAfter := time.Millisecond * 100
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		if index == 0 {
+			return statusFrame(errors.StatusServerBusy.WithRetryAfter(retryAfter))
+		}
+		return successFrame([]byte("ok"))
+	})
+
+	cli := newTestClient(&Config{Timeout: time.Second})
+	now := time.Now()
+	rsp, err := cli.Call(context.Background(), addr, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "ok" {
+		t.Fatalf("unexpected rsp %q", rsp)
+	}
+	if elapsed := time.Since(now); elapsed < retryAfter {
+		t.Fatalf("retried after %v, expect at least %v", elapsed, retryAfter)
+	}
+}
+
+func TestRetryAfterBeyondDeadline(t *testing.T) {
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		return statusFrame(errors.StatusRateLimited.WithRetryAfter(time.Second * 5))
+	})
+
+	cli := newTestClient(&Config{Timeout: time.Millisecond * 200})
+	_, err := cli.Call(context.Background(), addr, "test", nil)
+	status, ok := err.(*errors.Status)
+	if !ok {
+		t.Fatalf("expect *errors.Status, got %v", err)
+	}
+	if status.Code() != errors.StatusRateLimited.Code() || status.RetryAfter() != time.Second*5 {
+		t.Fatalf("unexpected status %v %v %v", status.Code(), status.Error(), status.RetryAfter())
+	}
+	if status.Error() != errors.StatusRateLimited.Error() {
+		t.Fatalf("retry hint should be stripped from the message, got %q", status.Error())
+	}
+}
+
+func TestWriteDeadlineSlowReader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	// 只读一点就停下, 请求写不完
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Read(make([]byte, 1024))
+		time.Sleep(time.Second * 2)
+	}()
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	addr := &models.HttpAddr{IP: tcpAddr.IP.String(), Port: uint32(tcpAddr.Port)}
+
+	cli := newTestClient(&Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	now := time.Now()
+	_, err = cli.Call(ctx, addr, "upload", make([]byte, 32<<20))
+	if !errors.Is(err, errors.ErrWriteTimeout) {
+		t.Fatalf("unexpected err %v", err)
+	}
+	if elapsed := time.Since(now); elapsed > time.Second {
+		t.Fatalf("write aborted after %v", elapsed)
+	}
+
+	// 半发的连接不能回到连接池
+	time.Sleep(time.Millisecond * 50)
+	if stats := cli.PoolStats(); stats.Idle != 0 || stats.Active != 0 {
+		t.Fatalf("conn kept after write timeout: %+v", stats)
+	}
+}
+
+func TestVSockDialError(t *testing.T) {
+	addr := &models.VSockAddr{ContextId: 3, Port: 1024}
+	for errno := range vsockDialHints {
+		// vsock.Dial的错误形式: *net.OpError{Err: *os.SyscallError{Err: errno}}
+		raw := &net.OpError{Op: "dial", Net: "vsock", Err: os.NewSyscallError("connect", errno)}
+		err := vsockDialError(addr, raw)
+		if !errors.Is(err, errno) {
+			t.Fatalf("%v: errno lost in %v", errno, err)
+		}
+		if !strings.Contains(err.Error(), vsockDialHints[errno]) {
+			t.Fatalf("%v: no hint in %v", errno, err)
+		}
+	}
+	err := vsockDialError(addr, errors.New("other"))
+	if err.Error() != "vsock dial cid 3 port 1024: other" {
+		t.Fatalf("unexpected err %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		failing  int32 = 1
+		received int32
+	)
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		atomic.AddInt32(&received, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return statusFrame(errors.StatusServerBusy)
+		}
+		return successFrame([]byte("ok"))
+	})
+
+	var (
+		mutex       sync.Mutex
+		transitions []string
+	)
+	cooldown := time.Millisecond * 100
+	cli := newTestClient(&Config{
+		Timeout: time.Second,
+		Breaker: &BreakerConfig{
+			Failures: 3,
+			Cooldown: cooldown,
+			OnStateChange: func(addr string, from, to BreakerState) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				transitions = append(transitions, from.String()+">"+to.String())
+			},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := cli.Call(context.Background(), addr, "test", nil); err == nil {
+			t.Fatal("expect busy")
+		}
+	}
+	if state := cli.BreakerState(addr); state != BreakerOpen {
+		t.Fatalf("breaker should be open, got %v", state)
+	}
+	_, err := cli.Call(context.Background(), addr, "test", nil)
+	status, ok := err.(*errors.Status)
+	if !ok || status.Code() != errors.StatusCircuitOpen.Code() || status.RetryAfter() <= 0 {
+		t.Fatalf("expect StatusCircuitOpen, got %v", err)
+	}
+	if n := atomic.LoadInt32(&received); n != 3 {
+		t.Fatalf("open breaker should not send, server got %v requests", n)
+	}
+
+	// 冷却后放行一次探测, 成功则关闭
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(cooldown)
+	if rsp, err := cli.Call(context.Background(), addr, "test", nil); err != nil || string(rsp) != "ok" {
+		t.Fatalf("probe should go through, got %q, %v", rsp, err)
+	}
+	if state := cli.BreakerState(addr); state != BreakerClosed {
+		t.Fatalf("breaker should be closed, got %v", state)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if got := strings.Join(transitions, ","); got != "closed>open,open>half-open,half-open>closed" {
+		t.Fatalf("unexpected transitions %v", got)
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	var received int32
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		// 每个请求的第一次都在读到之后断开连接
+		if atomic.AddInt32(&received, 1)%2 == 1 {
+			_ = conn.Close()
+			return nil, nil
+		}
+		return successFrame(req.Req)
+	})
+	cli := newTestClient(&Config{Timeout: time.Second})
+
+	rsp, err := cli.Call(WithIdempotent(context.Background()), addr, "test", []byte("replayed"))
+	if err != nil || string(rsp) != "replayed" {
+		t.Fatalf("idempotent call should be replayed, got %q, %v", rsp, err)
+	}
+	if n := atomic.LoadInt32(&received); n != 2 {
+		t.Fatalf("server got %v requests, want 2", n)
+	}
+
+	atomic.StoreInt32(&received, 0)
+	if _, err := cli.Call(context.Background(), addr, "test", []byte("once")); err == nil {
+		t.Fatal("non idempotent call must fail instead of being replayed")
+	}
+	if n := atomic.LoadInt32(&received); n != 1 {
+		t.Fatalf("non idempotent call sent %v times", n)
+	}
+}
+
+// TestReplayOnlyBrokenConns counts the attempts of idempotent calls: a conn
+// breaking is replayed once, a server answer or a timeout is not.
+func TestReplayOnlyBrokenConns(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := map[string]int{}
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		mutex.Lock()
+		attempts[req.Path]++
+		mutex.Unlock()
+		switch req.Path {
+		case "broken":
+			_ = conn.Close()
+			return nil, nil
+		case "stall":
+			time.Sleep(time.Millisecond * 200)
+		case "busy":
+			return statusFrame(errors.StatusServerBusy)
+		}
+		return successFrame(req.Req)
+	})
+	cli := newTestClient(&Config{Timeout: time.Second * 2, FirstByteTimeout: time.Millisecond * 50})
+
+	for path, want := range map[string]int{"broken": 2, "stall": 1, "busy": 1} {
+		if _, err := cli.Call(WithIdempotent(context.Background()), addr, path, nil); err == nil {
+			t.Fatalf("%v: expect the call to fail", path)
+		}
+		mutex.Lock()
+		got := attempts[path]
+		mutex.Unlock()
+		if got != want {
+			t.Fatalf("%v: server got %v attempts, want %v", path, got, want)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var received int32
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		atomic.AddInt32(&received, 1)
+		_ = conn.Close()
+		return nil, nil
+	})
+	cli := newTestClient(&Config{Timeout: time.Second, RetryBudget: &RetryBudgetConfig{Retries: 2, Window: time.Hour}})
+
+	// 预算用完后幂等请求也不再重放
+	for i := 0; i < 4; i++ {
+		if _, err := cli.Call(WithIdempotent(context.Background()), addr, "test", nil); err == nil {
+			t.Fatal("expect the call to fail")
+		}
+	}
+	if n := atomic.LoadInt32(&received); n != 6 {
+		t.Fatalf("server got %v requests, want 2 replayed calls then 2 sent once", n)
+	}
+	if stats := cli.RetryBudgetStats(); stats != (RetryBudgetStats{Capacity: 2, Retried: 2, Exhausted: 2}) {
+		t.Fatalf("unexpected budget %+v", stats)
+	}
+
+	// 熔断拦下的重试把token还回去
+	cli = newTestClient(&Config{
+		Timeout:     time.Second,
+		RetryBudget: &RetryBudgetConfig{Retries: 1, Window: time.Hour},
+		Breaker:     &BreakerConfig{Failures: 1, Cooldown: time.Hour},
+	})
+	_, err := cli.Call(WithIdempotent(context.Background()), addr, "test", nil)
+	if status, ok := err.(*errors.Status); !ok || status.Code() != errors.StatusCircuitOpen.Code() {
+		t.Fatalf("expect the replay refused by the breaker, got %v", err)
+	}
+	if stats := cli.RetryBudgetStats(); stats != (RetryBudgetStats{Available: 1, Capacity: 1}) {
+		t.Fatalf("expect the token refunded, got %+v", stats)
+	}
+}
+
+func TestExpectedCodes(t *testing.T) {
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		switch req.Path {
+		case "missing":
+			body, _ := proto.Marshal(&protocols.Response{Code: 404, Err: "not found"})
+			header, _ := successFrame(nil)
+			return header, body
+		case "busy":
+			return statusFrame(errors.StatusServerBusy)
+		}
+		return successFrame([]byte("ok"))
+	})
+	cli := newTestClient(&Config{Timeout: time.Second})
+	ctx := WithExpectedCodes(context.Background(), protocols.StatusOK, 404)
+
+	var appErr *errors.AppError
+	if _, err := cli.Call(ctx, addr, "missing", nil); !errors.As(err, &appErr) || appErr.Code != 404 {
+		t.Fatalf("expected code should be returned as usual, got %v", err)
+	}
+	_, err := cli.Call(ctx, addr, "busy", nil)
+	var (
+		unexpected *errors.UnexpectedCodeError
+		status     *errors.Status
+	)
+	if !errors.Is(err, errors.StatusUnexpectedCode) || !errors.As(err, &unexpected) ||
+		unexpected.Code != int32(errors.StatusServerBusy.Code()) || !errors.As(err, &status) {
+		t.Fatalf("expect StatusUnexpectedCode with the busy status, got %v", err)
+	}
+	rsp, err := cli.Call(WithExpectedCodes(context.Background(), 404), addr, "ok", nil)
+	if !errors.As(err, &unexpected) || unexpected.Code != protocols.StatusOK || unexpected.Err != nil || rsp != nil {
+		t.Fatalf("expect StatusUnexpectedCode for a success, got %q, %v", rsp, err)
+	}
+
+	// 默认接受任何code
+	_, err = cli.Call(context.Background(), addr, "busy", nil)
+	if status, ok := err.(*errors.Status); !ok || status.Code() != errors.StatusServerBusy.Code() {
+		t.Fatalf("expect the busy status, got %v", err)
+	}
+}
+
+func TestCallAll(t *testing.T) {
+	var (
+		mutex         sync.Mutex
+		running, peak int
+		echoed        int32
+	)
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		if req.Path == "fail" {
+			body, _ := proto.Marshal(&protocols.Response{Code: 42, Err: "failed"})
+			header, _ := successFrame(nil)
+			return header, body
+		}
+		mutex.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mutex.Unlock()
+		atomic.AddInt32(&echoed, 1)
+		time.Sleep(time.Millisecond * 10)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return successFrame(req.Req)
+	})
+
+	// 全部执行, 结果与请求一一对应, 并发不超过PoolMaxCapacity
+	cli := newTestClient(&Config{Timeout: time.Second, PoolMaxCapacity: 2})
+	var reqs []*CallRequest
+	for i := 0; i < 6; i++ {
+		path := "echo"
+		if i == 2 {
+			path = "fail"
+		}
+		reqs = append(reqs, &CallRequest{Addr: addr, Path: path, Req: []byte{byte('a' + i)}})
+	}
+	results, err := cli.CallAll(context.Background(), reqs, false)
+	if errs, ok := err.(errors.Errors); !ok || len(errs) != 1 {
+		t.Fatalf("expect the one failure as errors.Errors, got %v", err)
+	}
+	for i, result := range results {
+		if i == 2 {
+			var appErr *errors.AppError
+			if !errors.As(result.Err, &appErr) || appErr.Code != 42 {
+				t.Fatalf("expect the app error at index 2, got %v", result.Err)
+			}
+			continue
+		}
+		if result.Err != nil || string(result.Rsp) != string(reqs[i].Req) {
+			t.Fatalf("result %v: got %q, %v", i, result.Rsp, result.Err)
+		}
+	}
+	mutex.Lock()
+	if peak > 2 {
+		t.Fatalf("expect at most 2 calls at once, got %v", peak)
+	}
+	mutex.Unlock()
+
+	// failFast: 第一个失败返回, 还没发出的不再发
+	atomic.StoreInt32(&echoed, 0)
+	cli = newTestClient(&Config{Timeout: time.Second, PoolMaxCapacity: 1})
+	reqs[0], reqs[2] = reqs[2], reqs[0]
+	results, err = cli.CallAll(context.Background(), reqs, true)
+	var appErr *errors.AppError
+	if !errors.As(err, &appErr) || appErr.Code != 42 {
+		t.Fatalf("expect the first failure, got %v", err)
+	}
+	for i, result := range results[1:] {
+		if result.Err == nil {
+			t.Fatalf("result %v should be canceled", i+1)
+		}
+	}
+	if n := atomic.LoadInt32(&echoed); n != 0 {
+		t.Fatalf("expect no call after the failure, %v ran", n)
+	}
+}
+
+func TestSession(t *testing.T) {
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		return successFrame([]byte(conn.RemoteAddr().String()))
+	})
+	cli := newTestClient(&Config{Timeout: time.Second})
+
+	first, err := cli.Session(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cli.Session(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[*Session]string)
+	for i := 0; i < 3; i++ {
+		for _, s := range []*Session{first, second} {
+			rsp, err := s.Call(context.Background(), "conn", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn, ok := seen[s]; ok && conn != string(rsp) {
+				t.Fatalf("session moved from conn %v to %s", conn, rsp)
+			}
+			seen[s] = string(rsp)
+		}
+	}
+	if seen[first] == seen[second] {
+		t.Fatal("expect the sessions on different conns")
+	}
+
+	first.Close()
+	second.Close()
+	first.Close()
+	if stats := cli.PoolStats(); stats.Idle != 2 || stats.Active != 0 {
+		t.Fatalf("expect both conns back in the pool, got %+v", stats)
+	}
+	if _, err := first.Call(context.Background(), "conn", nil); err != errors.ErrSessionClosed {
+		t.Fatalf("expect ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		if req.Path == "hang" {
+			return nil, nil // 不回复, 调用一直进行中
+		}
+		return successFrame(nil)
+	})
+	cli := newTestClient(&Config{Timeout: 5 * time.Second})
+
+	hung := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), addr, "hang", nil)
+		hung <- err
+	}()
+	for cli.PoolStats().Active != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := cli.Call(context.Background(), addr, "echo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cli.PoolStats(); stats.Idle != 1 || stats.Active != 1 {
+		t.Fatalf("expect one idle and one active conn, got %+v", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	forced, err := cli.Close(ctx)
+	if err != context.DeadlineExceeded || forced != 1 {
+		t.Fatalf("expect 1 conn forcibly closed on the deadline, got %v, %v", forced, err)
+	}
+	select {
+	case err := <-hung:
+		if !errors.Is(err, errors.ErrClientClosed) {
+			t.Fatalf("expect the active call to fail with ErrClientClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("active call still running after Close")
+	}
+	if stats := cli.PoolStats(); stats.Idle != 0 || stats.Active != 0 {
+		t.Fatalf("expect every conn closed, got %+v", stats)
+	}
+	if _, err := cli.Call(context.Background(), addr, "echo", nil); !errors.Is(err, errors.ErrClientClosed) {
+		t.Fatalf("expect ErrClientClosed after Close, got %v", err)
+	}
+	if forced, err := cli.Close(context.Background()); forced != 0 || err != nil {
+		t.Fatalf("expect closing again to return at once, got %v, %v", forced, err)
+	}
+}
+
+// TestMaxFrameSizeOldServer talks to a server not knowing ActionSettings: it
+// answers the settings frame like a request, the conn keeps the default size.
+func TestMaxFrameSizeOldServer(t *testing.T) {
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		if req.Path == "" {
+			return statusFrame(errors.StatusInvalidPath)
+		}
+		return successFrame([]byte("ok"))
+	})
+
+	cli := newTestClient(&Config{Timeout: time.Second, MaxFrameSize: 1000})
+	rsp, err := cli.Call(context.Background(), addr, "test", nil)
+	if err != nil || string(rsp) != "ok" {
+		t.Fatalf("expect the call to succeed, got %q %v", rsp, err)
+	}
+	pc, err := cli.transport.getConn(context.Background(), addr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.transport.putConn(pc)
+	if size := pc.MaxFrameSize(); size != constant.MaxFrameBodySize {
+		t.Fatalf("expect the default max frame size, got %v", size)
+	}
+}
+
+// TestFirstByteTimeout tells a server slow to start answering, failed by the
+// first byte timeout, from a response stalling midway, bounded by the call
+// deadline only.
+func TestFirstByteTimeout(t *testing.T) {
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		header, body := successFrame(bytes.Repeat([]byte("x"), 1000))
+		header.Length = uint16(len(body))
+		frame := make([]byte, models.HeaderSize+len(body))
+		socket.PutHeader(frame, header)
+		copy(frame[models.HeaderSize:], body)
+
+		switch req.Path {
+		case "late": // 迟迟不开始
+			time.Sleep(time.Millisecond * 300)
+			_, _ = conn.Write(frame)
+		case "stall": // 开始后中途停顿
+			_, _ = conn.Write(frame[:100])
+			time.Sleep(time.Millisecond * 300)
+			_, _ = conn.Write(frame[100:])
+		}
+		return nil, nil
+	})
+	cli := newTestClient(&Config{Timeout: time.Second * 2, FirstByteTimeout: time.Millisecond * 100})
+
+	now := time.Now()
+	_, err := cli.Call(context.Background(), addr, "late", nil)
+	if !errors.Is(err, errors.ErrTTFBTimeout) {
+		t.Fatalf("expect ErrTTFBTimeout, got %v", err)
+	}
+	if elapsed := time.Since(now); elapsed > time.Millisecond*250 {
+		t.Fatalf("first byte timeout took %v", elapsed)
+	}
+
+	// 首字节按时到达, 慢但在进行的传输只受整体超时约束
+	rsp, err := cli.Call(context.Background(), addr, "stall", nil)
+	if err != nil || len(rsp) != 1000 {
+		t.Fatalf("expect the stalled response within the call timeout, got %v bytes, %v", len(rsp), err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*150)
+	defer cancel()
+	now = time.Now()
+	_, err = cli.Call(WithFirstByteTimeout(ctx, 0), addr, "stall", nil)
+	if err == nil || errors.Is(err, errors.ErrTTFBTimeout) {
+		t.Fatalf("expect the call deadline to fail the stalled response, got %v", err)
+	}
+	if elapsed := time.Since(now); elapsed > time.Millisecond*280 {
+		t.Fatalf("call deadline took %v", elapsed)
+	}
+}
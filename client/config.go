@@ -2,6 +2,7 @@ package client
 
 import (
 	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/protocols"
 	"time"
 )
 
@@ -9,8 +10,69 @@ type Config struct {
 	Timeout         time.Duration
 	PoolIdleTimeout time.Duration
 	PoolMaxCapacity int
-	WriteBufferSize int
-	ReadBufferSize  int
+
+	// MaxIdleConns caps the idle conns of the whole pool, the ones idle the
+	// longest are closed first, 0 means no limit. MaxIdleConnsPerHost caps
+	// them per address and defaults to PoolMaxCapacity.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost caps the conns to one address, busy and idle, see Transport.MaxConnsPerHost.
+	MaxConnsPerHost int
+
+	// PoolValidateAfter: a pooled conn idle longer than this is pinged before
+	// reuse and redialed if dead, keep it below the server IdleTimeout.
+	// constant.ConnPoolValidateAfter if 0, negative disables validation.
+	PoolValidateAfter time.Duration
+	WriteBufferSize   int
+	ReadBufferSize    int
+
+	// Version of the request frames, constant.DefaultVersion if 0. With
+	// constant.SentinelVersion every frame ends with a sentinel both sides
+	// check, catching framing bugs of other implementations early; the
+	// server answers in the version of the request.
+	Version uint16
+
+	// Breaker enables a circuit breaker per address, nil disables it. An open
+	// breaker fails calls with errors.StatusCircuitOpen and stops retries.
+	Breaker *BreakerConfig
+
+	// RetryBudget caps the retries of the whole client, on top of the per
+	// call policy, so a server incident isn't amplified by every call
+	// retrying; nil leaves retries unbounded.
+	RetryBudget *RetryBudgetConfig
+
+	// Dialer opens the conns, DefaultDialer if nil. Tests inject an in
+	// memory one to drive retries, pooling and the breaker over fake conns.
+	Dialer Dialer
+
+	// Signer signs the requests and checks the signature of the responses,
+	// see server.Server.Signer. A response failing the check is returned as
+	// errors.StatusSignatureInvalid.
+	Signer *protocols.Signer
+
+	// MaxFrameSize makes each new conn exchange an ActionSettings frame with
+	// the server before its first request: requests are then split into
+	// frames within the smaller of both sides, see server.Server.MaxFrameSize.
+	// A server that doesn't know it answers with a status, the conn then
+	// keeps constant.MaxFrameBodySize. 0 skips the exchange unless
+	// StreamWindow is set.
+	MaxFrameSize int
+
+	// StreamWindow turns on flow control of stream responses: the server
+	// sends at most this many bytes of a response frame ahead of what the
+	// client has read, and blocks its producer until the client grants more
+	// with ActionWindowUpdate frames. It is exchanged in the ActionSettings
+	// frame like MaxFrameSize, raised to constant.MinStreamWindow, and only
+	// applies when the server echoes it. 0 disables flow control.
+	StreamWindow int
+
+	// FirstByteTimeout bounds the wait for the first byte of a response once
+	// the request is written, to fail fast on a dead server, while Timeout
+	// keeps bounding the whole call, e.g. a large stream still arriving.
+	// WithFirstByteTimeout sets it per call. 0 leaves the call under its
+	// deadline only.
+	FirstByteTimeout time.Duration
 }
 
 func (cfg *Config) GetTimeout() time.Duration {
@@ -31,6 +93,27 @@ func (cfg *Config) GetPoolMaxCapacity() int {
 	}
 	return constant.MaxConnPoolCapacity
 }
+func (cfg *Config) GetMaxIdleConnsPerHost() int {
+	if cfg.MaxIdleConnsPerHost > 0 {
+		return cfg.MaxIdleConnsPerHost
+	}
+	return cfg.GetPoolMaxCapacity()
+}
+func (cfg *Config) GetPoolValidateAfter() time.Duration {
+	if cfg.PoolValidateAfter > 0 {
+		return cfg.PoolValidateAfter
+	}
+	if cfg.PoolValidateAfter < 0 {
+		return 0
+	}
+	return constant.ConnPoolValidateAfter
+}
+func (cfg *Config) GetVersion() uint16 {
+	if cfg.Version > 0 {
+		return cfg.Version
+	}
+	return constant.DefaultVersion
+}
 func (cfg *Config) GetWriteBufferSize() int {
 	if cfg.WriteBufferSize > 0 {
 		return cfg.WriteBufferSize
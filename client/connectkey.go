@@ -18,9 +18,15 @@ func (ck *connectKey) From(addr models.Addr) {
 	case *models.HttpAddr:
 		ck.Uri = ad.IP
 		ck.Port = ad.Port
+	case *models.UnixAddr:
+		ck.Uri = "unix:" + ad.Path
 	}
 }
 
+func (ck connectKey) String() string {
+	return ck.Uri + ":" + strconv.FormatUint(uint64(ck.Port), 10)
+}
+
 func (ck *connectKey) Equal(target *connectKey) bool {
 	return ck.Uri == target.Uri && ck.Port == target.Port
 }
@@ -12,7 +12,9 @@ type ConnPool struct {
 
 	idleTimeout time.Duration
 
-	maxCapacityPerKey int
+	maxCapacityPerKey int // MaxIdleConnsPerHost
+	maxIdle           int // MaxIdleConns, 0 means unlimited
+	idleCount         int // conns in pool
 }
 
 func (cp *ConnPool) Get(key connectKey) *PersistConn {
@@ -28,36 +30,40 @@ func (cp *ConnPool) Get(key connectKey) *PersistConn {
 	if !ok {
 		return nil
 	}
+	defer func() {
+		if len(list) > 0 {
+			cp.pool[key] = list
+		} else {
+			delete(cp.pool, key)
+		}
+	}()
 
 	// 倒序查找
 	for len(list) > 0 {
 		pConn := list[len(list)-1]
+		list = list[:len(list)-1] // 从缓存删除
+		cp.idleCount--
 
 		if pConn.isClosed() {
-			list = list[:len(list)-1]
 			continue
 		}
 
 		tooOld := !idleBegin.IsZero() && pConn.idleAt.Round(0).Before(idleBegin)
 		if tooOld {
-			list = list[:len(list)-1]
 			pConn.close(errors.ErrConnIdleTimeout)
 			continue
 		}
 
 		// 取出
-		list = list[:len(list)-1] // 从缓存删除
-		if len(list) > 0 {
-			cp.pool[key] = list
-		} else {
-			delete(cp.pool, key)
-		}
 
-		// 清理数据
+		// 清理数据, idleTimer与closeLocked共用closedMutex
+		pConn.closedMutex.Lock()
 		if pConn.idleTimer != nil {
 			pConn.idleTimer.Stop()
 			pConn.idleTimer = nil
 		}
+		pConn.closedMutex.Unlock()
+		pConn.idleFor = time.Since(pConn.idleAt)
 		pConn.idleAt = time.Time{}
 		return pConn
 	}
@@ -73,11 +79,13 @@ func (cp *ConnPool) Put(conn *PersistConn) {
 
 	conn.reused = true
 	conn.idleAt = time.Now()
+	conn.closedMutex.Lock()
 	if conn.idleTimer != nil {
 		conn.idleTimer.Reset(idleTimeout)
 	} else {
 		conn.idleTimer = time.AfterFunc(idleTimeout, conn.closeWhenIdleTimeout) // 空闲状态才关闭
 	}
+	conn.closedMutex.Unlock()
 
 	key := conn.key
 	list, ok := cp.pool[key]
@@ -92,10 +100,64 @@ func (cp *ConnPool) Put(conn *PersistConn) {
 			v.close(errors.ErrOutOfConnectionPool)
 		}
 		list = list[cutPoint:]
+		cp.idleCount -= len(removed)
 	}
 
 	list = append(list, conn)
 	cp.pool[key] = list
+	cp.idleCount++
+
+	// 超过池子总上限, 关闭空闲最久的
+	for cp.maxIdle > 0 && cp.idleCount > cp.maxIdle {
+		cp.removeOldestLocked()
+	}
+}
+
+// removeOldestLocked closes the conn idle the longest, each list is ordered oldest first.
+func (cp *ConnPool) removeOldestLocked() {
+	var (
+		oldestKey connectKey
+		oldest    *PersistConn
+	)
+	for key, list := range cp.pool {
+		if len(list) > 0 && (oldest == nil || list[0].idleAt.Before(oldest.idleAt)) {
+			oldestKey, oldest = key, list[0]
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	list := cp.pool[oldestKey][1:]
+	if len(list) > 0 {
+		cp.pool[oldestKey] = list
+	} else {
+		delete(cp.pool, oldestKey)
+	}
+	cp.idleCount--
+	oldest.close(errors.ErrOutOfConnectionPool)
+}
+
+// CloseIdle closes every conn waiting in the pool.
+func (cp *ConnPool) CloseIdle() {
+	cp.mutex.Lock()
+	pool := cp.pool
+	cp.pool = make(map[connectKey][]*PersistConn)
+	cp.idleCount = 0
+	cp.mutex.Unlock()
+
+	for _, list := range pool {
+		for _, pConn := range list {
+			pConn.close(errors.ErrClientClosed)
+		}
+	}
+}
+
+// IdleCount returns the number of conns waiting in the pool.
+func (cp *ConnPool) IdleCount() int {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
+	return cp.idleCount
 }
 
 func (cp *ConnPool) Remove(pConn *PersistConn) bool {
@@ -117,7 +179,12 @@ func (cp *ConnPool) Remove(pConn *PersistConn) bool {
 		}
 
 		copy(list[k:], list[k+1:])
-		cp.pool[conn.key] = list[:len(list)-1]
+		if len(list) > 1 {
+			cp.pool[conn.key] = list[:len(list)-1]
+		} else {
+			delete(cp.pool, conn.key)
+		}
+		cp.idleCount--
 		return true
 	}
 	return false
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+)
+
+func TestMaxIdleConns(t *testing.T) {
+	reply := func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		return successFrame(req.Req)
+	}
+	addrA := startRawServer(t, reply)
+	addrB := startRawServer(t, reply)
+
+	cli := newTestClient(&Config{MaxIdleConns: 3, MaxIdleConnsPerHost: 2})
+	tp := cli.transport
+
+	// retryCount>0 跳过连接池, 每次都新建
+	dial := func(addr models.Addr, n int) []*PersistConn {
+		conns := make([]*PersistConn, 0, n)
+		for i := 0; i < n; i++ {
+			conn, err := tp.getConn(context.Background(), addr, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+		return conns
+	}
+	connsA := dial(addrA, 3)
+	connsB := dial(addrB, 2)
+	if stats := cli.PoolStats(); stats.Idle != 0 || stats.Active != 5 {
+		t.Fatalf("before put: %+v", stats)
+	}
+
+	for _, conn := range connsA {
+		tp.putConn(conn)
+		time.Sleep(time.Millisecond)
+	}
+	// 每个地址最多2个, 最早放回的被关闭
+	if !connsA[0].isClosed() || connsA[1].isClosed() || connsA[2].isClosed() {
+		t.Fatal("the oldest conn of addrA should be closed by MaxIdleConnsPerHost")
+	}
+
+	for _, conn := range connsB {
+		tp.putConn(conn)
+		time.Sleep(time.Millisecond)
+	}
+	// 全局最多3个, 关闭空闲最久的
+	if !connsA[1].isClosed() || connsA[2].isClosed() || connsB[0].isClosed() || connsB[1].isClosed() {
+		t.Fatal("the oldest idle conn of the pool should be closed by MaxIdleConns")
+	}
+	if stats := cli.PoolStats(); stats.Idle != 3 || stats.Active != 0 {
+		t.Fatalf("after put: %+v", stats)
+	}
+}
+
+func TestMaxConnsPerHostCheckout(t *testing.T) {
+	release := make(chan struct{})
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		if string(req.Req) == "hold" {
+			<-release
+		}
+		return successFrame(req.Req)
+	})
+	cli := newTestClient(&Config{MaxConnsPerHost: 1})
+
+	held := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), addr, "any", []byte("hold"))
+		held <- err
+	}()
+	time.Sleep(time.Millisecond * 50) // 唯一的连接被占用
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	now := time.Now()
+	_, err := cli.Call(ctx, addr, "any", []byte("next"))
+	if err != errors.StatusPoolExhausted {
+		t.Fatalf("expect StatusPoolExhausted, got %v", err)
+	}
+	if elapsed := time.Since(now); elapsed > time.Millisecond*500 {
+		t.Fatalf("checkout should end with the deadline, took %v", elapsed)
+	}
+
+	// 连接放回后, 等待中的调用拿到它
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), addr, "any", []byte("next"))
+		waiting <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	close(release)
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	if stats := cli.PoolStats(); stats.Idle+stats.Active != 1 {
+		t.Fatalf("MaxConnsPerHost exceeded: %+v", stats)
+	}
+}
+
+// validatingServer answers pings with pongs and echoes requests, counting the
+// pings and the conns. A conn it marks dead after its first request gets no
+// answer anymore, or is closed.
+type validatingServer struct {
+	mutex sync.Mutex
+	conns map[net.Conn]bool // conn -> dead
+	pings int
+	close bool // close dead conns instead of going silent
+}
+
+func (vs *validatingServer) reply(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if vs.conns[conn] {
+		return nil, nil
+	}
+	if req.Path == "" {
+		vs.pings++
+		return &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion, Code: constant.ActionPong}, nil
+	}
+	return successFrame(req.Req)
+}
+
+// kill marks every conn seen so far dead.
+func (vs *validatingServer) kill() {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	for conn := range vs.conns {
+		vs.conns[conn] = true
+		if vs.close {
+			_ = conn.Close()
+		}
+	}
+}
+
+func (vs *validatingServer) track(conn net.Conn) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if _, ok := vs.conns[conn]; !ok {
+		vs.conns[conn] = false
+	}
+}
+
+func (vs *validatingServer) stats() (conns, pings int) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	return len(vs.conns), vs.pings
+}
+
+func startValidatingServer(t *testing.T, close bool) (*validatingServer, models.Addr) {
+	vs := &validatingServer{conns: make(map[net.Conn]bool), close: close}
+	addr := startRawServer(t, func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		vs.track(conn)
+		return vs.reply(conn, index, req)
+	})
+	return vs, addr
+}
+
+// TestPoolValidateStaleConn reuses a pooled conn the server dropped while it
+// was idle: the call goes out on a redialed conn and succeeds.
+func TestPoolValidateStaleConn(t *testing.T) {
+	for _, close := range []bool{false, true} {
+		vs, addr := startValidatingServer(t, close)
+		cli := newTestClient(&Config{Timeout: time.Second, PoolValidateAfter: time.Millisecond * 20})
+		if _, err := cli.Call(context.Background(), addr, "echo", []byte("first")); err != nil {
+			t.Fatal(err)
+		}
+		vs.kill()
+		time.Sleep(time.Millisecond * 40)
+
+		rsp, err := cli.Call(context.Background(), addr, "echo", []byte("second"))
+		if err != nil || string(rsp) != "second" {
+			t.Fatalf("close %v: expect the call on a redialed conn, got %q, %v", close, rsp, err)
+		}
+		if conns, _ := vs.stats(); conns != 2 {
+			t.Fatalf("close %v: expect a second conn, got %v", close, conns)
+		}
+	}
+}
+
+// TestPoolValidateFreshConn reuses conns idle shorter than PoolValidateAfter,
+// or with validation disabled, without pinging them.
+func TestPoolValidateFreshConn(t *testing.T) {
+	for _, validateAfter := range []time.Duration{time.Hour, -1} {
+		vs, addr := startValidatingServer(t, false)
+		cli := newTestClient(&Config{Timeout: time.Second, PoolValidateAfter: validateAfter})
+		for i := 0; i < 3; i++ {
+			if _, err := cli.Call(context.Background(), addr, "echo", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if conns, pings := vs.stats(); conns != 1 || pings != 0 {
+			t.Fatalf("validate after %v: expect 1 conn and no ping, got %v conns %v pings", validateAfter, conns, pings)
+		}
+	}
+	if after := (&Config{PoolValidateAfter: -1}).GetPoolValidateAfter(); after != 0 {
+		t.Fatalf("negative PoolValidateAfter should disable validation, got %v", after)
+	}
+}
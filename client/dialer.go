@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/mdlayher/vsock"
+)
+
+// Dialer opens the conns of a client, see Config.Dialer. Like the
+// net.Listener given to server.Serve it lets tests run the client over fake
+// conns, e.g. one end of a net.Pipe.
+type Dialer interface {
+	DialContext(ctx context.Context, addr models.Addr) (net.Conn, error)
+}
+
+// DialerFunc adapts a func to a Dialer.
+type DialerFunc func(ctx context.Context, addr models.Addr) (net.Conn, error)
+
+func (fn DialerFunc) DialContext(ctx context.Context, addr models.Addr) (net.Conn, error) {
+	return fn(ctx, addr)
+}
+
+// DefaultDialer dials vsock, tcp and unix addrs, a vsock dial failure is a *DialError.
+var DefaultDialer Dialer = DialerFunc(dialContext)
+
+func dialContext(ctx context.Context, addr models.Addr) (net.Conn, error) {
+	var dialer net.Dialer
+	switch ad := addr.(type) {
+	case *models.VSockAddr:
+		// vsock.Dial不支持ctx, 本机连接很快返回
+		conn, err := vsock.Dial(ad.ContextId, ad.Port, nil)
+		if err != nil {
+			return nil, vsockDialError(ad, err)
+		}
+		return conn, nil
+	case *models.HttpAddr:
+		return dialer.DialContext(ctx, "tcp", ad.GetAddr())
+	case *models.UnixAddr:
+		return dialer.DialContext(ctx, "unix", ad.Path)
+	default:
+		panic("invalid models addr")
+	}
+}
+
+func (tp *Transport) dial(ctx context.Context, addr models.Addr) (net.Conn, error) {
+	if tp.Dialer != nil {
+		return tp.Dialer.DialContext(ctx, addr)
+	}
+	return DefaultDialer.DialContext(ctx, addr)
+}
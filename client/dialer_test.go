@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/statistics"
+)
+
+// pipeDialer connects every dial to reply over a net.Pipe, without a listener.
+func pipeDialer(reply func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte)) DialerFunc {
+	var index int64
+	return func(ctx context.Context, addr models.Addr) (net.Conn, error) {
+		server, conn := net.Pipe()
+		go serveRaw(server, &index, reply)
+		return conn, nil
+	}
+}
+
+func ExampleDialerFunc() {
+	statistics.InitClient()
+	echo := pipeDialer(func(conn net.Conn, index int, req *protocols.Request) (*models.Header, []byte) {
+		return successFrame(req.Req)
+	})
+
+	cli := &Client{Timeout: time.Second}
+	cli.Init(&Config{Dialer: echo})
+	rsp, err := cli.Call(context.Background(), &models.VSockAddr{ContextId: 3, Port: 5000}, "echo", []byte("hello"))
+	fmt.Println(string(rsp), err)
+	// Output: hello <nil>
+}
+
+func TestDialerBreaker(t *testing.T) {
+	var dials int64
+	refused := errors.New("connection refused")
+	cli := newTestClient(&Config{
+		Timeout: time.Second,
+		Breaker: &BreakerConfig{Failures: 2, Cooldown: time.Hour},
+		Dialer: DialerFunc(func(ctx context.Context, addr models.Addr) (net.Conn, error) {
+			atomic.AddInt64(&dials, 1)
+			return nil, refused
+		}),
+	})
+	addr := &models.VSockAddr{ContextId: 3, Port: 5000}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cli.Call(context.Background(), addr, "echo", nil); !errors.Is(err, refused) {
+			t.Fatalf("expect the dial error, got %v", err)
+		}
+	}
+	if state := cli.BreakerState(addr); state != BreakerOpen {
+		t.Fatalf("expect the breaker open after the failed dials, got %v", state)
+	}
+	before := atomic.LoadInt64(&dials)
+	_, err := cli.Call(context.Background(), addr, "echo", nil)
+	if status, ok := err.(*errors.Status); !ok || status.Code() != errors.StatusCircuitOpen.Code() {
+		t.Fatalf("expect StatusCircuitOpen, got %v", err)
+	}
+	if atomic.LoadInt64(&dials) != before {
+		t.Fatal("an open breaker should not dial")
+	}
+}
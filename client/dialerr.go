@@ -0,0 +1,50 @@
+package client
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+)
+
+// DialError is a failed vsock dial with a hint on the usual cause of its
+// errno. Err is kept as is, errors.Is(err, syscall.ECONNREFUSED) still works.
+type DialError struct {
+	Addr *models.VSockAddr
+	Hint string
+	Err  error
+}
+
+func (de *DialError) Error() string {
+	if de.Hint == "" {
+		return fmt.Sprintf("vsock dial cid %v port %v: %v", de.Addr.ContextId, de.Addr.Port, de.Err)
+	}
+	return fmt.Sprintf("vsock dial cid %v port %v: %v: %v", de.Addr.ContextId, de.Addr.Port, de.Hint, de.Err)
+}
+
+func (de *DialError) Unwrap() error {
+	return de.Err
+}
+
+var vsockDialHints = map[syscall.Errno]string{
+	syscall.ENODEV:        "vsock device not available: is the vsock kernel module loaded / is this running in a VM?",
+	syscall.EAFNOSUPPORT:  "vsock address family not supported: is the vsock kernel module loaded?",
+	syscall.EACCES:        "permission denied: the process may lack access to the vsock device (container, seccomp or SELinux policy)",
+	syscall.EPERM:         "operation not permitted: the process may lack access to the vsock device (container, seccomp or SELinux policy)",
+	syscall.ECONNREFUSED:  "connection refused: is the server listening on this port of the cid?",
+	syscall.ECONNRESET:    "connection reset: the cid exists but nothing accepted on this port, or the peer dropped the conn",
+	syscall.ETIMEDOUT:     "connection timed out: is the cid running and reachable from this VM?",
+	syscall.EHOSTUNREACH:  "host unreachable: no VM with this cid, check the cid of the enclave/guest",
+	syscall.ENETUNREACH:   "network unreachable: no VM with this cid, check the cid of the enclave/guest",
+	syscall.EADDRNOTAVAIL: "address not available: the cid is invalid in this VM",
+}
+
+// vsockDialError wraps err of dialing addr with a hint, err is returned as is without errno.
+func vsockDialError(addr *models.VSockAddr, err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return &DialError{Addr: addr, Err: err}
+	}
+	return &DialError{Addr: addr, Hint: vsockDialHints[errno], Err: err}
+}
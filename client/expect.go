@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+)
+
+type expectedCodesKey struct{}
+
+// WithExpectedCodes makes Call accept only the response codes given: the
+// protocols.StatusOK of a success, the code of an errors.AppError or of a
+// server errors.Status. Any other code fails the call with an
+// *errors.UnexpectedCodeError, matching errors.StatusUnexpectedCode. Errors
+// carrying no code, e.g. a broken conn, are returned as they are.
+func WithExpectedCodes(ctx context.Context, codes ...int32) context.Context {
+	return context.WithValue(ctx, expectedCodesKey{}, codes)
+}
+
+// unexpectedCode returns the StatusUnexpectedCode of the call outcome err if
+// ctx expects other codes, nil if it is accepted.
+func unexpectedCode(ctx context.Context, err error) error {
+	codes, ok := ctx.Value(expectedCodesKey{}).([]int32)
+	if !ok {
+		return nil
+	}
+	code := protocols.StatusOK
+	var (
+		status *errors.Status
+		appErr *errors.AppError
+	)
+	switch {
+	case err == nil:
+	case errors.As(err, &status):
+		code = int32(status.Code())
+	case errors.As(err, &appErr):
+		code = appErr.Code
+	default:
+		return nil
+	}
+	for _, expected := range codes {
+		if code == expected {
+			return nil
+		}
+	}
+	return &errors.UnexpectedCodeError{Code: code, Err: err}
+}
@@ -0,0 +1,23 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+type firstByteKey struct{}
+
+// WithFirstByteTimeout bounds the wait for the first byte of the response to
+// the call of ctx, overriding Config.FirstByteTimeout; the ctx deadline keeps
+// bounding the whole call. The call fails with errors.ErrTTFBTimeout
+// and the conn is closed when nothing arrived in time.
+func WithFirstByteTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, firstByteKey{}, timeout)
+}
+
+func firstByteTimeout(ctx context.Context, fallback time.Duration) time.Duration {
+	if timeout, ok := ctx.Value(firstByteKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return fallback
+}
@@ -0,0 +1,77 @@
+package client
+
+// hostConns counts the conns of one address against MaxConnsPerHost.
+type hostConns struct {
+	count int
+	ready chan struct{} // closed and replaced once a conn is put back or closed
+}
+
+// hostReady returns the channel signaling the next conn of key becoming
+// available, taken before looking into the pool so no signal is missed.
+func (tp *Transport) hostReady(key connectKey) <-chan struct{} {
+	if tp.MaxConnsPerHost <= 0 {
+		return nil
+	}
+	tp.hostMutex.Lock()
+	defer tp.hostMutex.Unlock()
+	return tp.hostLocked(key).ready
+}
+
+// reserveHost takes a slot for a new conn to key, false if MaxConnsPerHost are open.
+func (tp *Transport) reserveHost(key connectKey) bool {
+	if tp.MaxConnsPerHost <= 0 {
+		return true
+	}
+	tp.hostMutex.Lock()
+	defer tp.hostMutex.Unlock()
+
+	host := tp.hostLocked(key)
+	if host.count < tp.MaxConnsPerHost {
+		host.count++
+		return true
+	}
+	return false
+}
+
+func (tp *Transport) hostLocked(key connectKey) *hostConns {
+	if tp.hosts == nil {
+		tp.hosts = make(map[connectKey]*hostConns)
+	}
+	host, ok := tp.hosts[key]
+	if !ok {
+		host = &hostConns{ready: make(chan struct{})}
+		tp.hosts[key] = host
+	}
+	return host
+}
+
+// releaseHost frees the slot of a closed conn.
+func (tp *Transport) releaseHost(key connectKey) {
+	tp.hostMutex.Lock()
+	defer tp.hostMutex.Unlock()
+
+	host, ok := tp.hosts[key]
+	if !ok {
+		return
+	}
+	host.count--
+	tp.signalHostLocked(host)
+	if host.count <= 0 {
+		delete(tp.hosts, key)
+	}
+}
+
+// signalHost wakes the callers waiting for a conn to key, after one was put back.
+func (tp *Transport) signalHost(key connectKey) {
+	tp.hostMutex.Lock()
+	defer tp.hostMutex.Unlock()
+
+	if host, ok := tp.hosts[key]; ok {
+		tp.signalHostLocked(host)
+	}
+}
+
+func (tp *Transport) signalHostLocked(host *hostConns) {
+	close(host.ready)
+	host.ready = make(chan struct{})
+}
@@ -0,0 +1,27 @@
+package client
+
+import (
+	"context"
+
+	"github.com/brodyxchen/vsock-sdk/metadata"
+)
+
+type idempotentKey struct{}
+
+// WithIdempotent marks the calls made with the returned ctx as safe to run
+// twice: when the conn breaks after the request was sent, it is replayed
+// once on a new conn within the ctx deadline. Calls carrying a
+// metadata.IdempotencyKey are replayed as well, the server drops the
+// duplicate on paths with a dedup cache. Other calls are only retried when
+// they are known not to have reached the server.
+func WithIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+func isIdempotent(ctx context.Context) bool {
+	if ok, _ := ctx.Value(idempotentKey{}).(bool); ok {
+		return true
+	}
+	md, ok := metadata.FromOutgoingContext(ctx)
+	return ok && md[metadata.IdempotencyKey] != ""
+}
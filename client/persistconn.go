@@ -2,8 +2,12 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/brodyxchen/vsock-sdk/constant"
 	"github.com/brodyxchen/vsock-sdk/errors"
 	"github.com/brodyxchen/vsock-sdk/log"
+	"github.com/brodyxchen/vsock-sdk/metadata"
 	"github.com/brodyxchen/vsock-sdk/models"
 	"github.com/brodyxchen/vsock-sdk/protocols"
 	"github.com/brodyxchen/vsock-sdk/socket"
@@ -11,6 +15,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,14 +32,23 @@ type PersistConn struct {
 	receiveCh chan *models.NotifyReceive
 	sendCh    chan *models.SendRequest
 
-	// 以下三个变量被connPool.mutex守护
-	idleAt    time.Time   // time it last become idle
-	idleTimer *time.Timer // holding an AfterFunc to close it
+	// 以下四个变量被connPool.mutex守护
+	idleAt    time.Time     // time it last become idle
+	idleFor   time.Duration // how long it was idle before the last Get
+	idleTimer *time.Timer   // holding an AfterFunc to close it, guarded by closedMutex
 	reused    bool
 
-	closedMutex sync.RWMutex // 守护以下2个变量
+	hostSlot bool // counted in transport MaxConnsPerHost
+
+	goAway int32 // atomic visit, the server sent a goaway, not reused
+
+	maxFrame     int // agreed by negotiate before the loops start, 0 if none
+	streamWindow int // echoed by the server in negotiate, 0 without flow control, see Config.StreamWindow
+
+	closedMutex sync.RWMutex // 守护以下3个变量
 	closed      error
 	closedCh    chan struct{}
+	sub         *Subscription // set before the subscribe request is sent, the conn is dedicated to it
 }
 
 // roundTrip 一次往返，不处理关闭和链接池， 由上层transport处理
@@ -50,19 +64,41 @@ func (pc *PersistConn) roundTrip(req *models.Request) (*models.Response, error)
 
 	// 通知接收
 	receiveReply := make(chan *models.ReceiveResponse, 1)
-	pc.receiveCh <- &models.NotifyReceive{
+	notify := &models.NotifyReceive{
 		Req:        req,
 		Reply:      receiveReply,
 		CallerGone: gone,
 	}
+	ttfb := firstByteTimeout(req.Ctx, pc.transport.FirstByteTimeout)
+	if ttfb > 0 {
+		notify.FirstByte = make(chan struct{})
+	}
+	pc.receiveCh <- notify
 
+	var (
+		firstByte <-chan struct{}
+		ttfbTimer <-chan time.Time
+	)
+	sent := false
 	for {
 		select {
 		case err := <-sendReply:
+			sent = true
 			pc.transport.sendDoneHist.Update(time.Since(sendNow).Milliseconds())
 			if err != nil {
 				return nil, errors.Wrap(errors.ErrSendErr, err)
 			}
+			// 请求写完才开始计算首字节超时
+			if ttfb > 0 {
+				timer := time.NewTimer(ttfb)
+				defer timer.Stop()
+				firstByte, ttfbTimer = notify.FirstByte, timer.C
+			}
+		case <-firstByte:
+			firstByte, ttfbTimer = nil, nil
+		case <-ttfbTimer:
+			pc.transport.receiveTimeoutHist.Update(time.Since(sendNow).Milliseconds())
+			return nil, errors.Wrap(errors.ErrReceiveErr, errors.ErrTTFBTimeout)
 		case rpy := <-receiveReply:
 			pc.transport.receiveHist.Update(time.Since(sendNow).Milliseconds())
 			if rpy.Err != nil {
@@ -74,16 +110,67 @@ func (pc *PersistConn) roundTrip(req *models.Request) (*models.Response, error)
 		case <-pc.closedCh: // 外部关闭
 			pc.transport.receiveTimeoutHist.Update(time.Since(sendNow).Milliseconds())
 			if pc.closed != nil {
-				return nil, pc.closed
+				return nil, errors.Wrap(errors.ErrClosed, pc.closed)
 			}
 			return nil, errors.ErrClosed
 		case <-req.Ctx.Done(): // ctx结束
 			pc.transport.receiveTimeoutHist.Update(time.Since(sendNow).Milliseconds())
+			if !sent && req.Ctx.Err() == context.DeadlineExceeded {
+				// 请求还没写完, 连接上可能留下半帧, 由上层关闭
+				return nil, errors.Wrap(errors.ErrSendErr, errors.ErrWriteTimeout)
+			}
 			return nil, errors.ErrCtxDone
 		}
 	}
 }
 
+// validate pings the server, false if the conn is dead and should be discarded.
+func (pc *PersistConn) validate(ctx context.Context, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req := &models.Request{
+		Ctx: ctx,
+		Header: models.Header{
+			Magic:   constant.DefaultMagic,
+			Version: constant.DefaultVersion,
+			Code:    constant.ActionPing,
+		},
+	}
+	// 任何完整的响应都说明连接是活的
+	_, err := pc.roundTrip(req)
+	return err == nil
+}
+
+// pong answers a server ping through the writeLoop.
+func (pc *PersistConn) pong() {
+	req := &models.Request{
+		Ctx: context.Background(),
+		Header: models.Header{
+			Magic:   constant.DefaultMagic,
+			Version: constant.DefaultVersion,
+			Code:    constant.ActionPong,
+		},
+	}
+	select {
+	case pc.sendCh <- &models.SendRequest{Req: req, Reply: make(chan error, 1)}:
+	case <-pc.closedCh:
+	}
+}
+
+// onGoAway closes the conn if it is idle in the pool, a busy one is closed
+// instead of put back once its call is done.
+func (pc *PersistConn) onGoAway() {
+	atomic.StoreInt32(&pc.goAway, 1)
+	if pc.transport.removeConn(pc) {
+		pc.close(errors.ErrServerGoAway)
+	}
+}
+
+func (pc *PersistConn) goingAway() bool {
+	return atomic.LoadInt32(&pc.goAway) != 0
+}
+
 func (pc *PersistConn) Read(p []byte) (n int, err error) {
 	n, err = pc.conn.Read(p)
 	return
@@ -107,8 +194,7 @@ func (pc *PersistConn) writeLoop() {
 		case <-pc.closedCh:
 			return
 		case writeReq := <-pc.sendCh:
-			req := writeReq.Req
-			broken, err := socket.WriteSocket(req.Ctx, pc.bufWriter, &req.Header, req.Body)
+			broken, err := pc.writeRequest(writeReq.Req)
 			if err != nil {
 				writeReq.Reply <- err
 
@@ -123,24 +209,69 @@ func (pc *PersistConn) writeLoop() {
 	}
 }
 
+// writeRequest writes req with the ctx deadline as write deadline, applied to
+// every chunk. A stalled peer makes it fail with ErrWriteTimeout and broken:
+// part of the frame may already be on the wire, the conn can't be reused.
+func (pc *PersistConn) writeRequest(req *models.Request) (bool, error) {
+	deadline, _ := req.Ctx.Deadline()
+	_ = pc.conn.SetWriteDeadline(deadline) // 没有deadline时清除上一次的
+
+	body := req.Body
+	if signer := pc.transport.Signer; signer != nil && req.Header.Code != constant.ActionPing && req.Header.Code != constant.ActionWindowUpdate {
+		body = signer.Sign(body) // 重试时req.Body还会再用
+	}
+	broken, err := socket.WriteChunkedSize(req.Ctx, pc.bufWriter, &req.Header, body, pc.maxFrame)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true, errors.Wrap(errors.ErrWriteTimeout, err)
+	}
+	return broken, err
+}
+
 func (pc *PersistConn) readLoop() {
 	closeErr := errors.ErrClosed
 
 	defer func() {
 		pc.close(closeErr)
+		if sub := pc.subscription(); sub != nil {
+			sub.end(pc.closeErr())
+		}
 	}()
 
 	var err error
 
 	wrap := func(header *models.Header, body []byte) (*models.Response, error) {
+		if header.Code == constant.ActionPong {
+			return &models.Response{
+				Header:   *header,
+				Code:     header.Code,
+				ConnName: pc.Name,
+			}, nil
+		}
+
 		if header.Length == 0 || len(body) <= 0 {
 			return nil, errors.ErrUnknownServerErr
 		}
 
-		// 服务器 错误
+		// 服务器 错误, 连接本身是好的
 		if header.Code != 0 {
-			errMsg := string(body)
-			return nil, errors.New(errMsg)
+			return &models.Response{
+				Header:   *header,
+				Code:     header.Code,
+				Err:      errors.DecodeStatus(header.Code, body),
+				ConnName: pc.Name,
+			}, nil
+		}
+
+		if signer := pc.transport.Signer; signer != nil {
+			var ok bool
+			if body, ok = signer.Open(body); !ok {
+				return &models.Response{
+					Header:   *header,
+					Code:     errors.StatusSignatureInvalid.Code(),
+					Err:      errors.StatusSignatureInvalid,
+					ConnName: pc.Name,
+				}, nil
+			}
 		}
 
 		var pbBody protocols.Response
@@ -159,7 +290,7 @@ func (pc *PersistConn) readLoop() {
 		if pbBody.Code != protocols.StatusOK {
 			rsp.Code = uint16(pbBody.Code)
 			rsp.Body = nil
-			rsp.Err = errors.New(pbBody.Err)
+			rsp.Err = errors.NewAppError(pbBody.Code, pbBody.Err, pbBody.Rsp)
 		} else {
 			rsp.Code = 0
 			rsp.Body = pbBody.Rsp
@@ -174,7 +305,7 @@ func (pc *PersistConn) readLoop() {
 		rsp       *models.Response
 	)
 	for !pc.isClosed() {
-		_, err = pc.bufReader.Peek(2) // 阻塞
+		headerBuf, err := pc.bufReader.Peek(models.HeaderSize) // 阻塞
 		if err != nil {
 			//if err == io.EOF {
 			//	continue
@@ -183,17 +314,74 @@ func (pc *PersistConn) readLoop() {
 			return
 		}
 
+		// 服务器探测, 不对应任何请求
+		if binary.BigEndian.Uint16(headerBuf[4:]) == constant.ActionPing {
+			if _, _, broken, err := socket.ReadSocket(context.Background(), pc.bufReader); err != nil && broken {
+				closeErr = errors.Wrap(errors.ErrReadSocketErr, err)
+				return
+			}
+			pc.pong()
+			continue
+		}
+		// 服务器要求迁走, 已发出的请求照常读完
+		if binary.BigEndian.Uint16(headerBuf[4:]) == constant.ActionGoAway {
+			if _, _, broken, err := socket.ReadSocket(context.Background(), pc.bufReader); err != nil && broken {
+				closeErr = errors.Wrap(errors.ErrReadSocketErr, err)
+				return
+			}
+			pc.onGoAway()
+			continue
+		}
+		// 订阅推送, 不对应任何请求
+		if code := binary.BigEndian.Uint16(headerBuf[4:]); code == constant.ActionPush || code == constant.ActionPushEnd {
+			sub := pc.subscription()
+			if sub == nil {
+				closeErr = errors.ErrInvalidPush
+				return
+			}
+			ended, err := pc.readPush(sub, code)
+			if err != nil {
+				closeErr = err
+				return
+			}
+			if ended {
+				closeErr = errors.ErrSubscriptionClosed
+				return
+			}
+			continue
+		}
+
 		notifyReq = <-pc.receiveCh
+		if notifyReq.FirstByte != nil {
+			close(notifyReq.FirstByte)
+		}
 
-		header, body, broken, err := socket.ReadSocket(notifyReq.Req.Ctx, pc.bufReader)
+		// 响应已经开始到达, 剩下的部分受调用的deadline约束
+		deadline, _ := notifyReq.Req.Ctx.Deadline()
+		_ = pc.conn.SetReadDeadline(deadline)
+		header, body, broken, err := socket.ReadSocketProgress(notifyReq.Req.Ctx, pc.bufReader, pc.streamGrant())
+		if err == nil {
+			header.Code &^= constant.FlagStreamWindow
+		}
+		var trailer metadata.MD
+		if err == nil && header.Code&constant.FlagTrailer != 0 {
+			header.Code &^= constant.FlagTrailer
+			trailer, broken, err = pc.readTrailer(notifyReq.Req.Ctx)
+		}
+		_ = pc.conn.SetReadDeadline(time.Time{})
 		if err == nil {
 			rsp, err = wrap(header, body)
 			if rsp != nil {
 				rsp.Req = notifyReq.Req
+				rsp.Trailer = trailer
+				streamFailure(rsp)
 			}
 		} else {
 			rsp = nil
 		}
+		if err != nil && broken {
+			err = errors.Wrap(errors.ErrReadSocketErr, err) // 调用方据此判断连接已断
+		}
 
 		select {
 		case notifyReq.Reply <- &models.ReceiveResponse{Rsp: rsp, Err: err}:
@@ -201,7 +389,7 @@ func (pc *PersistConn) readLoop() {
 		}
 
 		if err != nil && broken {
-			closeErr = errors.Wrap(errors.ErrReadSocketErr, err)
+			closeErr = err
 			return
 		}
 	}
@@ -209,6 +397,71 @@ func (pc *PersistConn) readLoop() {
 	closeErr = errors.ErrClosed
 }
 
+// readTrailer reads the trailer frame announced by FlagTrailer on the response just read.
+func (pc *PersistConn) readTrailer(ctx context.Context) (metadata.MD, bool, error) {
+	header, body, broken, err := socket.ReadSocket(ctx, pc.bufReader)
+	if err != nil {
+		return nil, true, err
+	}
+	if header.Code != constant.ActionTrailer {
+		return nil, true, errors.ErrInvalidTrailer
+	}
+	md, err := metadata.Decode(body)
+	if err != nil {
+		return nil, broken, errors.Wrap(errors.ErrInvalidTrailer, err)
+	}
+	return md, false, nil
+}
+
+// readPush hands a push frame to the subscription, true once it ended.
+func (pc *PersistConn) readPush(sub *Subscription, code uint16) (bool, error) {
+	_, body, _, err := socket.ReadSocket(context.Background(), pc.bufReader)
+	if err != nil {
+		return false, errors.Wrap(errors.ErrReadSocketErr, err)
+	}
+	push, err := protocols.UnmarshalPush(body)
+	if err != nil {
+		return false, errors.Wrap(errors.ErrInvalidPush, err)
+	}
+	if code == constant.ActionPushEnd {
+		var endErr error
+		if push.Err != "" {
+			endErr = errors.NewAppError(protocols.StatusErr, push.Err, nil)
+		}
+		sub.end(endErr)
+		return true, nil
+	}
+	// 消费慢时阻塞在这里, 服务端的发送缓冲随之填满
+	select {
+	case sub.ch <- push.Msg:
+	case <-pc.closedCh:
+	}
+	return false, nil
+}
+
+func (pc *PersistConn) subscription() *Subscription {
+	pc.closedMutex.RLock()
+	defer pc.closedMutex.RUnlock()
+	return pc.sub
+}
+
+// setSubscription dedicates the conn to sub, the closed error if it is already closed.
+func (pc *PersistConn) setSubscription(sub *Subscription) error {
+	pc.closedMutex.Lock()
+	defer pc.closedMutex.Unlock()
+	if pc.closed != nil {
+		return pc.closed
+	}
+	pc.sub = sub
+	return nil
+}
+
+func (pc *PersistConn) closeErr() error {
+	pc.closedMutex.RLock()
+	defer pc.closedMutex.RUnlock()
+	return pc.closed
+}
+
 func (pc *PersistConn) isClosed() bool {
 	pc.closedMutex.RLock()
 	defer pc.closedMutex.RUnlock()
@@ -231,6 +484,11 @@ func (pc *PersistConn) closeLocked(err error) {
 
 	pc.closed = err
 	close(pc.closedCh)
+	atomic.AddInt64(&pc.transport.openConns, -1)
+	pc.transport.untrackConn(pc)
+	if pc.hostSlot {
+		pc.transport.releaseHost(pc.key)
+	}
 
 	if pc.idleTimer != nil {
 		pc.idleTimer.Stop()
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"google.golang.org/protobuf/proto"
+)
+
+// Response is the handler outcome of a call. Code is 0 when the handler
+// succeeded and Body holds its response, otherwise Code and Err are the
+// ones of the errors.AppError it returned and Detail its body.
+type Response struct {
+	Code   uint16
+	Err    string
+	Body   []byte
+	Detail []byte
+}
+
+// OK reports if the handler succeeded.
+func (r *Response) OK() bool {
+	return r.Code == 0
+}
+
+// UnmarshalDetail decodes the detail body of a failed call into m.
+func (r *Response) UnmarshalDetail(m proto.Message) error {
+	if len(r.Detail) == 0 {
+		return errors.ErrNoDetail
+	}
+	return proto.Unmarshal(r.Detail, m)
+}
+
+// CallResponse sends req to path like Call, but a handler error is returned
+// as a Response with its code and detail instead of an error. The error is
+// only set when the call did not reach the handler or got no answer from it
+// (conn errors, timeouts, server statuses like busy), see errors.AppError.
+func (cli *Client) CallResponse(ctx context.Context, addr models.Addr, path string, req []byte) (*Response, error) {
+	deadline := time.Time{}
+	if _, ok := ctx.Deadline(); !ok {
+		deadline = cli.deadline()
+	}
+	rsp, err := cli.call(ctx, addr, path, req, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Err == nil {
+		return &Response{Body: rsp.Body}, nil
+	}
+
+	appErr, ok := rsp.Err.(*errors.AppError)
+	if !ok {
+		return nil, rsp.Err
+	}
+	return &Response{
+		Code:   uint16(appErr.Code),
+		Err:    appErr.Message,
+		Detail: appErr.Body,
+	}, nil
+}
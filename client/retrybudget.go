@@ -0,0 +1,109 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+)
+
+// RetryBudgetConfig is a token bucket of retries shared by all calls of a
+// Client. Every retry, a replay or a wait on a busy server's retry-after,
+// takes a token; once they are gone calls fail with their error right away
+// instead of retrying, whatever the per call policy. An open breaker
+// refusing a retry gives its token back.
+type RetryBudgetConfig struct {
+	// Retries is how many retries Window allows, refilled evenly across it.
+	// Unused tokens add up to Retries at most, 0 allows no retry.
+	Retries int
+	Window  time.Duration // constant.RetryBudgetWindow if 0
+}
+
+func (cfg *RetryBudgetConfig) window() time.Duration {
+	if cfg.Window > 0 {
+		return cfg.Window
+	}
+	return constant.RetryBudgetWindow
+}
+
+// RetryBudgetStats is the state of the retry budget of a Client.
+type RetryBudgetStats struct {
+	Available int   // tokens left now
+	Capacity  int   // RetryBudgetConfig.Retries
+	Retried   int64 // retries let through
+	Exhausted int64 // retries refused for lack of tokens
+}
+
+// retryBudget holds the budget of a Transport, nil config disables it.
+type retryBudget struct {
+	config *RetryBudgetConfig
+
+	mutex     sync.Mutex // 守护以下4个变量
+	tokens    float64
+	refillAt  time.Time // zero before the first take, the bucket starts full
+	retried   int64
+	exhausted int64
+}
+
+// take reports if a retry may go out and consumes its token.
+func (rb *retryBudget) take() bool {
+	if rb.config == nil {
+		return true
+	}
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	rb.refillLocked(time.Now())
+	if rb.tokens < 1 {
+		rb.exhausted++
+		return false
+	}
+	rb.tokens--
+	rb.retried++
+	return true
+}
+
+// refund gives back the token of a retry that didn't go out after all.
+func (rb *retryBudget) refund() {
+	if rb.config == nil {
+		return
+	}
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	rb.retried--
+	if capacity := float64(rb.config.Retries); rb.tokens+1 < capacity {
+		rb.tokens++
+	} else {
+		rb.tokens = capacity
+	}
+}
+
+func (rb *retryBudget) refillLocked(now time.Time) {
+	capacity := float64(rb.config.Retries)
+	if rb.refillAt.IsZero() {
+		rb.tokens, rb.refillAt = capacity, now
+		return
+	}
+	rb.tokens += capacity * float64(now.Sub(rb.refillAt)) / float64(rb.config.window())
+	if rb.tokens > capacity {
+		rb.tokens = capacity
+	}
+	rb.refillAt = now
+}
+
+func (rb *retryBudget) stats() RetryBudgetStats {
+	if rb.config == nil {
+		return RetryBudgetStats{}
+	}
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	rb.refillLocked(time.Now())
+	return RetryBudgetStats{
+		Available: int(rb.tokens),
+		Capacity:  rb.config.Retries,
+		Retried:   rb.retried,
+		Exhausted: rb.exhausted,
+	}
+}
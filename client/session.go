@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/metadata"
+	"github.com/brodyxchen/vsock-sdk/models"
+)
+
+// Session pins calls to one conn checked out of the pool, for interactions
+// relying on per conn state on the server, e.g. a transaction spanning
+// several calls. Calls of a session are serialized, they are not retried on
+// another conn: once the conn broke every call fails with errors.ErrSessionBroken.
+// A session must be closed to return its conn to the pool.
+type Session struct {
+	cli  *Client
+	addr models.Addr
+
+	mutex  sync.Mutex // 守护以下3个变量, 同一连接上请求串行
+	conn   *PersistConn
+	broken error
+	closed bool
+}
+
+// Session checks out a conn to addr, ctx bounds waiting for it (cli.Timeout
+// if ctx has no deadline).
+func (cli *Client) Session(ctx context.Context, addr models.Addr) (*Session, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		if deadline := cli.deadline(); !deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+	}
+	conn, err := cli.transport.getConn(ctx, addr, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{cli: cli, addr: addr, conn: conn}, nil
+}
+
+// Call sends req to path on the session conn like Client.Call.
+func (s *Session) Call(ctx context.Context, path string, req []byte) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, errors.ErrSessionClosed
+	}
+	if s.broken != nil {
+		return nil, errors.Wrap(errors.ErrSessionBroken, s.broken)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		if deadline := s.cli.deadline(); !deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+	}
+	body, err := marshalRequest(ctx, path, req)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := s.cli.transport
+	tripNow := time.Now()
+	rsp, err := s.conn.roundTrip(&models.Request{
+		Ctx: ctx,
+		Header: models.Header{
+			Magic:   constant.DefaultMagic,
+			Version: tp.Version,
+			Code:    constant.FlagAcceptsTrailer,
+			Length:  uint16(len(body)),
+		},
+		Body: body,
+	})
+	tp.tripHist.Update(time.Since(tripNow).Milliseconds())
+	if err != nil {
+		// 连接上可能还留着这次的响应, 不能再用
+		s.broken = err
+		s.conn.close(err)
+		return nil, errors.Wrap(errors.ErrSessionBroken, err)
+	}
+
+	if trailer, ok := ctx.Value(trailerKey{}).(*metadata.MD); ok {
+		*trailer = rsp.Trailer
+	}
+	if rsp.Err != nil {
+		return rsp.Body, rsp.Err
+	}
+	return rsp.Body, nil
+}
+
+// Close returns the conn to the pool, or closes it if it broke. Calls
+// after Close fail with errors.ErrSessionClosed, closing twice is a no-op.
+func (s *Session) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.broken == nil && !s.conn.isClosed() {
+		s.cli.transport.putConn(s.conn)
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/socket"
+)
+
+// negotiate exchanges the ActionSettings frames on a new conn, before its
+// loops start, under the ctx deadline.
+func (pc *PersistConn) negotiate(ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+	_ = pc.conn.SetDeadline(deadline)
+	defer pc.conn.SetDeadline(time.Time{})
+
+	size := pc.transport.MaxFrameSize
+	if size > constant.MaxFrameBodySize {
+		size = constant.MaxFrameBodySize
+	}
+	window := pc.transport.StreamWindow
+	if window > 0 && window < constant.MinStreamWindow {
+		window = constant.MinStreamWindow
+	}
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: pc.transport.Version,
+		Code:    constant.ActionSettings,
+	}
+	settings := &protocols.Settings{MaxFrameSize: uint32(size), StreamWindow: uint32(window)}
+	if _, err := socket.WriteSocket(ctx, pc.bufWriter, header, settings.Marshal()); err != nil {
+		return errors.Wrap(errors.ErrSettings, err)
+	}
+
+	rspHeader, body, _, err := socket.ReadSocket(ctx, pc.bufReader)
+	if err != nil {
+		return errors.Wrap(errors.ErrSettings, err)
+	}
+	if rspHeader.Code != constant.ActionSettings {
+		// 旧的服务器当作请求处理, 回了status, 保持默认
+		return nil
+	}
+	settings, err = protocols.UnmarshalSettings(body)
+	if err != nil {
+		return errors.Wrap(errors.ErrSettings, err)
+	}
+	if peer := int(settings.MaxFrameSize); peer > 0 && peer < size {
+		size = peer
+	}
+	pc.maxFrame = size
+	// 不认识窗口的服务器不会回显, 也就不能给它发ActionWindowUpdate
+	if window > 0 {
+		pc.streamWindow = int(settings.StreamWindow)
+	}
+	return nil
+}
+
+// MaxFrameSize is the largest request frame body of the conn, agreed with
+// the server when Config.MaxFrameSize is set.
+func (pc *PersistConn) MaxFrameSize() int {
+	if pc.maxFrame > 0 {
+		return pc.maxFrame
+	}
+	return constant.MaxFrameBodySize
+}
+
+// streamGrant returns the progress callback of socket.ReadSocketProgress
+// granting the window back as a constant.FlagStreamWindow frame is read.
+// The frame needs Length-window bytes of grants on top of the initial
+// window, granting more would leave credit for the next one. Grants go out
+// in halves of the window to keep the update frames few. nil without flow
+// control.
+func (pc *PersistConn) streamGrant() func(header *models.Header, read int) {
+	window := pc.streamWindow
+	if window <= 0 {
+		return nil
+	}
+	granted := 0
+	return func(header *models.Header, read int) {
+		if header.Code&constant.FlagStreamWindow == 0 {
+			return
+		}
+		need := int(header.Length) - window
+		if read > need {
+			read = need
+		}
+		pending := read - granted
+		if pending <= 0 || (pending < window/2 && read < need) {
+			return
+		}
+		granted = read
+		pc.windowUpdate(pending)
+	}
+}
+
+// windowUpdate grants the server increment bytes through the writeLoop.
+func (pc *PersistConn) windowUpdate(increment int) {
+	req := &models.Request{
+		Ctx: context.Background(),
+		Header: models.Header{
+			Magic:   constant.DefaultMagic,
+			Version: pc.transport.Version,
+			Code:    constant.ActionWindowUpdate,
+		},
+		Body: (&protocols.WindowUpdate{Increment: uint32(increment)}).Marshal(),
+	}
+	select {
+	case pc.sendCh <- &models.SendRequest{Req: req, Reply: make(chan error, 1)}:
+	case <-pc.closedCh:
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+)
+
+const closePollInterval = 10 * time.Millisecond
+
+// Close shuts the client down like server.Shutdown: new calls fail with
+// errors.ErrClientClosed at once, idle conns are closed, and it waits for
+// the calls in flight (sessions and subscriptions included) to be done. When
+// ctx is done first the conns still active are closed, failing their calls;
+// forced is their number and err is ctx.Err().
+func (cli *Client) Close(ctx context.Context) (forced int, err error) {
+	tp := cli.transport
+	atomic.StoreInt32(&tp.inClose, 1)
+	tp.connPool.CloseIdle()
+
+	ticker := time.NewTicker(closePollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&tp.openConns) > 0 {
+		select {
+		case <-ctx.Done():
+			return tp.closeActive(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return 0, nil
+}
+
+func (tp *Transport) closing() bool {
+	return atomic.LoadInt32(&tp.inClose) != 0
+}
+
+// trackConn registers a new conn for Close, false if the client is closing.
+func (tp *Transport) trackConn(pc *PersistConn) bool {
+	tp.connMutex.Lock()
+	defer tp.connMutex.Unlock()
+	if tp.closing() {
+		return false
+	}
+	if tp.conns == nil {
+		tp.conns = make(map[*PersistConn]struct{})
+	}
+	tp.conns[pc] = struct{}{}
+	return true
+}
+
+func (tp *Transport) untrackConn(pc *PersistConn) {
+	tp.connMutex.Lock()
+	defer tp.connMutex.Unlock()
+	delete(tp.conns, pc)
+}
+
+// closeActive closes the conns left once Close gave up waiting.
+func (tp *Transport) closeActive() int {
+	tp.connMutex.Lock()
+	conns := make([]*PersistConn, 0, len(tp.conns))
+	for pc := range tp.conns {
+		conns = append(conns, pc)
+	}
+	tp.connMutex.Unlock()
+
+	forced := 0
+	for _, pc := range conns {
+		if !pc.isClosed() {
+			pc.close(errors.ErrClientClosed)
+			forced++
+		}
+	}
+	return forced
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Subscription receives the messages pushed by a server subscription path,
+// see server.HandleSubscribe. It owns a conn of its own, not pooled.
+type Subscription struct {
+	// C yields the pushed messages in order, it is closed once the
+	// subscription ended, Err tells why.
+	C  <-chan []byte
+	ch chan []byte
+
+	ID uint64 // given by the server
+
+	pc      *PersistConn
+	endOnce sync.Once
+	err     error
+}
+
+// Err is nil if the server handler ended the subscription cleanly, its
+// error as an errors.AppError, or why the conn closed: ErrSubscriptionClosed
+// after Close. Only valid once C is closed.
+func (sub *Subscription) Err() error {
+	return sub.err
+}
+
+// Close unsubscribes, the messages already in C can still be read before it closes.
+func (sub *Subscription) Close() {
+	sub.pc.close(errors.ErrSubscriptionClosed)
+}
+
+func (sub *Subscription) end(err error) {
+	sub.endOnce.Do(func() {
+		sub.err = err
+		close(sub.ch)
+	})
+}
+
+// Subscribe sends req to the subscription path and returns once the server
+// accepted it. ctx bounds the subscription: when it is done the subscription
+// is closed; cli.Timeout bounds the wait for the server's answer when ctx has
+// no deadline. When the client reads C slower than the server pushes, the
+// server SlowConsumer policy applies.
+func (cli *Client) Subscribe(ctx context.Context, addr models.Addr, path string, req []byte) (*Subscription, error) {
+	callCtx := ctx
+	if _, ok := ctx.Deadline(); !ok {
+		if deadline := cli.deadline(); !deadline.IsZero() {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+	}
+
+	body, err := marshalRequest(callCtx, path, req)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := cli.transport
+	pc, err := tp.getConn(callCtx, addr, 1) // 新建连接, 不从池里取
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []byte, constant.DefaultPushBuffer)
+	sub := &Subscription{C: ch, ch: ch, pc: pc}
+	if err := pc.setSubscription(sub); err != nil {
+		return nil, err
+	}
+
+	rsp, err := pc.roundTrip(&models.Request{
+		Ctx: callCtx,
+		Header: models.Header{
+			Magic:   constant.DefaultMagic,
+			Version: tp.Version,
+			Code:    constant.FlagAcceptsTrailer,
+			Length:  uint16(len(body)),
+		},
+		Body: body,
+	})
+	if err == nil {
+		err = rsp.Err
+	}
+	if err == nil {
+		var n int
+		if sub.ID, n = protowire.ConsumeVarint(rsp.Body); n < 0 {
+			err = errors.ErrInvalidPush
+		}
+	}
+	if err != nil {
+		pc.close(errors.ErrSubscriptionClosed)
+		return nil, err
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				sub.Close()
+			case <-pc.closedCh:
+			}
+		}()
+	}
+	return sub, nil
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/metadata"
+	"github.com/brodyxchen/vsock-sdk/models"
+)
+
+type trailerKey struct{}
+
+// WithTrailer makes a call with the returned ctx store the response trailer
+// into *trailer, nil if the server sent none. To get the timing breakdown set
+// metadata.WantTimingKey in the outgoing metadata as well:
+//
+//	var trailer metadata.MD
+//	ctx = metadata.AppendToOutgoingContext(ctx, metadata.WantTimingKey, "1")
+//	rsp, err := cli.Call(client.WithTrailer(ctx, &trailer), addr, path, req)
+//	log.Info(trailer[metadata.TimingHandlerKey])
+func WithTrailer(ctx context.Context, trailer *metadata.MD) context.Context {
+	return context.WithValue(ctx, trailerKey{}, trailer)
+}
+
+// streamFailure turns a stream response whose trailer reports a failure
+// midway into its valid part of the body and an errors.ErrStreamAborted
+// wrapping the handler's errors.AppError.
+func streamFailure(rsp *models.Response) {
+	message, ok := rsp.Trailer[metadata.StreamErrorKey]
+	if !ok || rsp.Err != nil {
+		return
+	}
+	code, _ := strconv.ParseInt(rsp.Trailer[metadata.StreamErrorCodeKey], 10, 32)
+	sent, err := strconv.Atoi(rsp.Trailer[metadata.StreamSentKey])
+	if err != nil || sent < 0 || sent > len(rsp.Body) {
+		sent = 0
+	}
+	rsp.Body = rsp.Body[:sent]
+	rsp.Err = errors.Wrap(errors.ErrStreamAborted, errors.NewAppError(int32(code), message, nil))
+}
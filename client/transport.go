@@ -2,12 +2,13 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"github.com/brodyxchen/vsock-sdk/constant"
 	"github.com/brodyxchen/vsock-sdk/errors"
 	"github.com/brodyxchen/vsock-sdk/log"
 	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
 	"github.com/brodyxchen/vsock-sdk/statistics/metrics"
-	"github.com/mdlayher/vsock"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -25,7 +26,33 @@ type Transport struct {
 	WriteBufferSize int
 	ReadBufferSize  int
 
+	PoolValidateAfter time.Duration // 0 disables validation
+
+	Version uint16 // Header.Version of the request frames, see Config.Version
+
+	Dialer Dialer // DefaultDialer if nil, see Config.Dialer
+	Signer *protocols.Signer
+
+	MaxFrameSize     int           // see Config.MaxFrameSize
+	StreamWindow     int           // see Config.StreamWindow
+	FirstByteTimeout time.Duration // see Config.FirstByteTimeout
+
+	breakers    breakers    // per address, see Config.Breaker
+	retryBudget retryBudget // client wide, see Config.RetryBudget
+
+	// MaxConnsPerHost caps the conns to one address, idle ones included.
+	// A call finding them all busy waits for one until its deadline, then
+	// fails with errors.StatusPoolExhausted. 0 means no limit.
+	MaxConnsPerHost int
+	hosts           map[connectKey]*hostConns
+	hostMutex       sync.Mutex
+
 	connIndex int64 // atomic visit
+	openConns int64 // atomic visit, dialed and not yet closed
+
+	inClose   int32                     // atomic visit, set by Client.Close
+	conns     map[*PersistConn]struct{} // open conns, for Client.Close to force the active ones
+	connMutex sync.Mutex
 
 	connGetHist metrics.Histogram
 	connNewHist metrics.Histogram
@@ -48,25 +75,10 @@ func (tp *Transport) DialTest(addr models.Addr) (*PersistConn, error) {
 	key.From(addr)
 
 	// 创建
-	var (
-		rwConn net.Conn
-		err    error
-	)
-
 	now := time.Now()
-	switch ad := addr.(type) {
-	case *models.VSockAddr:
-		rwConn, err = vsock.Dial(ad.ContextId, ad.Port, nil)
-		if err != nil {
-			return nil, err
-		}
-	case *models.HttpAddr:
-		rwConn, err = net.Dial("tcp", ad.GetAddr())
-		if err != nil {
-			return nil, err
-		}
-	default:
-		panic("invalid models addr")
+	rwConn, err := tp.dial(context.Background(), addr)
+	if err != nil {
+		return nil, err
 	}
 	tp.connNewHist.Update(time.Since(now).Milliseconds())
 
@@ -86,6 +98,7 @@ func (tp *Transport) DialTest(addr models.Addr) (*PersistConn, error) {
 	}
 	pConn.bufReader = bufio.NewReaderSize(pConn, tp.readBufferSize())
 	pConn.bufWriter = bufio.NewWriterSize(pConn, tp.writeBufferSize())
+	atomic.AddInt64(&tp.openConns, 1)
 
 	go pConn.readLoop()
 	go pConn.writeLoop()
@@ -95,39 +108,60 @@ func (tp *Transport) DialTest(addr models.Addr) (*PersistConn, error) {
 	return pConn, nil
 }
 
-func (tp *Transport) getConn(addr models.Addr, retryCount int) (*PersistConn, error) {
+// Dial connects to "vsock://cid:port", "tcp://host:port" or "unix:///path".
+func Dial(addr string) (net.Conn, error) {
+	adr, err := models.ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return DefaultDialer.DialContext(context.Background(), adr)
+}
+
+func (tp *Transport) getConn(ctx context.Context, addr models.Addr, retryCount int) (*PersistConn, error) {
 	now := time.Now()
+	if tp.closing() {
+		return nil, errors.ErrClientClosed
+	}
 
 	key := connectKey{}
 	key.From(addr)
 
-	if retryCount <= 0 {
-		// 查找缓存
-		findConn := tp.connPool.Get(key)
-		if findConn != nil {
-			tp.connGetHist.Update(time.Since(now).Milliseconds())
-			return findConn, nil
+	for {
+		ready := tp.hostReady(key)
+		if retryCount <= 0 {
+			// 查找缓存, 空闲太久的先ping一下, 避免拿到已被服务器关闭的连接
+			for {
+				findConn := tp.connPool.Get(key)
+				if findConn == nil {
+					break
+				}
+				if tp.PoolValidateAfter <= 0 || findConn.idleFor < tp.PoolValidateAfter ||
+					findConn.validate(ctx, constant.ConnPoolValidateTimeout) {
+					tp.connGetHist.Update(time.Since(now).Milliseconds())
+					return findConn, nil
+				}
+				findConn.close(errors.ErrConnStale)
+			}
+		}
+
+		// 达到MaxConnsPerHost, 等待有连接放回或关闭
+		if tp.reserveHost(key) {
+			break
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, errors.StatusPoolExhausted
 		}
 	}
 
 	// 创建
-	var (
-		rwConn net.Conn
-		err    error
-	)
-	switch ad := addr.(type) {
-	case *models.VSockAddr:
-		rwConn, err = vsock.Dial(ad.ContextId, ad.Port, nil)
-		if err != nil {
-			return nil, err
-		}
-	case *models.HttpAddr:
-		rwConn, err = net.Dial("tcp", ad.GetAddr())
-		if err != nil {
-			return nil, err
+	rwConn, err := tp.dial(ctx, addr)
+	if err != nil {
+		if tp.MaxConnsPerHost > 0 {
+			tp.releaseHost(key)
 		}
-	default:
-		panic("invalid models addr")
+		return nil, err
 	}
 
 	pConn := &PersistConn{
@@ -143,9 +177,21 @@ func (tp *Transport) getConn(addr models.Addr, retryCount int) (*PersistConn, er
 		closedMutex: sync.RWMutex{},
 		closed:      nil,
 		closedCh:    make(chan struct{}, 1),
+		hostSlot:    tp.MaxConnsPerHost > 0,
 	}
 	pConn.bufReader = bufio.NewReaderSize(pConn, tp.readBufferSize())
 	pConn.bufWriter = bufio.NewWriterSize(pConn, tp.writeBufferSize())
+	atomic.AddInt64(&tp.openConns, 1)
+	if !tp.trackConn(pConn) {
+		pConn.close(errors.ErrClientClosed) // Close期间新建的
+		return nil, errors.ErrClientClosed
+	}
+	if tp.MaxFrameSize > 0 || tp.StreamWindow > 0 {
+		if err := pConn.negotiate(ctx); err != nil {
+			pConn.close(err)
+			return nil, err
+		}
+	}
 
 	go pConn.readLoop()
 	go pConn.writeLoop()
@@ -171,17 +217,32 @@ func (tp *Transport) readBufferSize() int {
 }
 
 func (tp *Transport) putConn(pConn *PersistConn) {
+	if pConn.goingAway() {
+		pConn.close(errors.ErrServerGoAway)
+		return
+	}
+	if tp.closing() {
+		pConn.close(errors.ErrClientClosed)
+		return
+	}
 	tp.connPool.Put(pConn)
+	if pConn.hostSlot {
+		tp.signalHost(pConn.key)
+	}
 }
 
 func (tp *Transport) roundTrip(req *models.Request) (*models.Response, error) {
 	var (
 		ctx        = req.Context()
 		retryCount = 0
+		waitCount  = 0
+		retrying   = false // a retry budget token is taken for this attempt
 		conn       *PersistConn
 		err        error
 		sRsp       *models.Response
+		key        connectKey
 	)
+	key.From(req.Addr)
 
 	closeConn := func(pConn *PersistConn, err error) {
 		if pConn == nil {
@@ -191,7 +252,10 @@ func (tp *Transport) roundTrip(req *models.Request) (*models.Response, error) {
 	}
 
 	defer func() {
-		if err == nil && conn != nil && !conn.isClosed() {
+		if conn == nil {
+			return
+		}
+		if err == nil && !conn.isClosed() {
 			tp.putConn(conn)
 			return
 		}
@@ -214,9 +278,18 @@ func (tp *Transport) roundTrip(req *models.Request) (*models.Response, error) {
 		default:
 		}
 
-		conn, err = tp.getConn(req.Addr, retryCount)
+		if err := tp.breakers.allow(key); err != nil {
+			if retrying {
+				tp.retryBudget.refund() // 熔断拦下的重试没有发出去
+			}
+			return nil, err
+		}
+		retrying = false
+
+		conn, err = tp.getConn(ctx, req.Addr, retryCount)
 
 		if err != nil {
+			tp.breakers.record(key, breakerFailure(ctx, nil, err))
 			return nil, err
 		}
 
@@ -224,8 +297,8 @@ func (tp *Transport) roundTrip(req *models.Request) (*models.Response, error) {
 			Ctx: ctx,
 			Header: models.Header{
 				Magic:   constant.DefaultMagic,
-				Version: constant.DefaultVersion,
-				Code:    0, // 一些特殊设置: 比如keepAlive
+				Version: tp.Version,
+				Code:    constant.FlagAcceptsTrailer, // 一些特殊设置: 比如keepAlive
 				Length:  uint16(len(req.Body)),
 			},
 			Body: req.Body,
@@ -234,15 +307,32 @@ func (tp *Transport) roundTrip(req *models.Request) (*models.Response, error) {
 		tripNow := time.Now()
 		sRsp, err = conn.roundTrip(sReq)
 		tp.tripHist.Update(time.Since(tripNow).Milliseconds())
+		tp.breakers.record(key, breakerFailure(ctx, sRsp, err))
 
 		if err == nil {
+			// 服务器繁忙, 按照retry-after等待后重试
+			if wait := retryAfter(sRsp); wait > 0 && waitCount < maxRetryCount && tp.retryBudget.take() {
+				if !sleepCtx(ctx, wait) {
+					tp.retryBudget.refund()
+					return sRsp, nil
+				}
+				retrying = true
+				waitCount++
+				tp.putConn(conn)
+				conn = nil
+				continue
+			}
 			return sRsp, nil
 		}
 
-		// 是否重试	//FIXME 对于tempErr进行重试
-		if !conn.reused || retryCount > maxRetryCount {
+		// 是否重试: 没发出去的请求在复用的连接上重试, 发出去的只有幂等请求在连接断开时重放,
+		// 两者共用重试次数
+		unsent := conn.reused && errors.Is(err, errors.ErrSendErr)
+		replay := !unsent && req.Idempotent && connBroken(err)
+		if !(unsent || replay) || retryCount >= maxRetryCount || !tp.retryBudget.take() {
 			return nil, err
 		}
+		retrying = true
 
 		// 准备重试
 		retryCount++
@@ -251,6 +341,45 @@ func (tp *Transport) roundTrip(req *models.Request) (*models.Response, error) {
 	}
 }
 
+// connBroken tells err of a sent request came from the conn failing under
+// it, e.g. reset or closed by the server: the only errors an idempotent call
+// is replayed on. Timeouts and the end of ctx are not, a replay would run
+// into the same deadline.
+func connBroken(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errors.ErrCtxDone), errors.Is(err, errors.ErrWriteTimeout), errors.Is(err, errors.ErrTTFBTimeout):
+		return false
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return false
+	}
+	return errors.Is(err, errors.ErrSendErr) || errors.Is(err, errors.ErrReadSocketErr) || errors.Is(err, errors.ErrClosed)
+}
+
+// retryAfter returns the retry hint of a busy/rate limited status response.
+func retryAfter(rsp *models.Response) time.Duration {
+	status, ok := rsp.Err.(*errors.Status)
+	if !ok {
+		return 0
+	}
+	return status.RetryAfter()
+}
+
+// sleepCtx waits for d, false if ctx would end first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (tp *Transport) removeConn(target *PersistConn) bool {
 	return tp.connPool.Remove(target)
 }
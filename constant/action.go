@@ -0,0 +1,54 @@
+package constant
+
+// Actions carried in header.Code of a request frame, 0 is a normal request.
+// Control frames have no body and never reach a handler.
+const (
+	ActionPing = uint16(2)
+	ActionPong = uint16(3)
+
+	// ActionTrailer is a response side frame following a response flagged
+	// with FlagTrailer, its body is the trailer metadata (metadata.Encode).
+	ActionTrailer = uint16(4)
+
+	// ActionGoAway is sent by the server to tell the client to stop sending
+	// new requests on the conn, see Server.GoAway.
+	ActionGoAway = uint16(5)
+
+	// ActionPush and ActionPushEnd are server side frames of a subscription,
+	// their body is a protocols.Push: a pushed message, then the end of the
+	// subscription with the handler error. See Server.HandleSubscribe.
+	ActionPush    = uint16(6)
+	ActionPushEnd = uint16(7)
+
+	// ActionSettings is sent by a client as the first frame of a conn, the
+	// server answers with its own, the body is a protocols.Settings. Both
+	// sides then keep their frames within the smaller MaxFrameSize. Without
+	// it frames may take up to MaxFrameBodySize.
+	ActionSettings = uint16(8)
+
+	// ActionWindowUpdate is sent by a client reading a stream response, its
+	// body is a protocols.WindowUpdate granting the server more bytes of the
+	// frame. Only sent once the settings agreed a StreamWindow.
+	ActionWindowUpdate = uint16(9)
+)
+
+// FlagTrailer is set in header.Code of a response frame when a trailer frame
+// follows it. The server only sends trailers a request asked for, so older
+// clients never see one.
+const FlagTrailer = uint16(1 << 14)
+
+// FlagAcceptsTrailer is set in header.Code of a request frame by clients
+// reading trailers on any response. A stream response to it always has one,
+// reporting a failure after part of the body was written.
+const FlagAcceptsTrailer = uint16(1 << 13)
+
+// FlagMoreChunks is set in header.Code of a request frame when the body
+// continues in the next frame, the last chunk has it cleared. The chunks of
+// one request are written back to back, see socket.WriteChunked.
+const FlagMoreChunks = uint16(1 << 15)
+
+// FlagStreamWindow is set in header.Code of a stream response frame sent
+// under the flow control window of protocols.Settings.StreamWindow: the
+// client grants the rest of the frame with ActionWindowUpdate frames while
+// reading it. Other frames never wait for a grant.
+const FlagStreamWindow = uint16(1 << 12)
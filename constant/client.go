@@ -11,4 +11,15 @@ const (
 	MaxConnPoolCapacity = 1024 * 2
 
 	MaxConnPoolIdleTimeout = time.Minute
+
+	// pooled conns idle longer than this are pinged before reuse, keep it below the server IdleTimeout
+	ConnPoolValidateAfter   = time.Second * 30
+	ConnPoolValidateTimeout = time.Millisecond * 200
+
+	// defaults of client.BreakerConfig
+	BreakerWindow   = time.Second * 10
+	BreakerCooldown = time.Second * 5
+
+	// default of client.RetryBudgetConfig.Window
+	RetryBudgetWindow = time.Second * 10
 )
@@ -1,6 +1,28 @@
 package constant
 
+import "time"
+
 const (
 	DefaultMagic   = uint16(0x1617)
 	DefaultVersion = uint16(1)
+
+	// Frames of SentinelVersion and later end with FrameSentinel after the
+	// body (not counted in Length), a reader finding anything else there has
+	// lost the frame boundary.
+	SentinelVersion = uint16(2)
+	FrameSentinel   = uint16(0x1716)
+
+	MaxMetadataSize = 4 << 10 // sum of len(key)+len(value), leaves room for the body in a 64KB frame
+
+	MaxFrameBodySize       = 1<<16 - 1
+	DefaultMaxRequestBytes = 1 << 20 // reassembled size of a chunked request
+	DefaultMaxPathLength   = 256
+
+	MinStreamWindow = 1 << 10 // smaller protocols.Settings.StreamWindow are raised to it
 )
+
+// DefaultChunkTimeout bounds reading the remaining chunks of a request when the server has no ReadTimeout.
+const DefaultChunkTimeout = time.Second * 10
+
+// DefaultDrainTimeout bounds the shutdown of Server.ServeContext when the server has no DrainTimeout.
+const DefaultDrainTimeout = time.Second * 30
@@ -0,0 +1,27 @@
+package constant
+
+import "time"
+
+const (
+	// accept错误重试的退避区间
+	AcceptBackoffMin = time.Millisecond * 5
+	AcceptBackoffMax = time.Second
+)
+
+// DefaultGoAwayGrace is how long a conn keeps answering after Server.GoAway when the server has no GoAwayGrace.
+const DefaultGoAwayGrace = time.Second * 5
+
+// GoAwayLinger is how long a conn whose goaway grace ended still waits for a
+// request already on the way, so it gets StatusGoingAway instead of a reset.
+const GoAwayLinger = time.Millisecond * 10
+
+// RejectWriteTimeout bounds writing the status frame to a refused conn.
+const RejectWriteTimeout = time.Millisecond * 100
+
+// DefaultPushBuffer is how many pushed messages of a subscription may wait
+// to be written when its SubscribeConfig has no SendBuffer, and the size of
+// the client side channel.
+const DefaultPushBuffer = 64
+
+// DefaultEventBuffer is the capacity of Server.Events when the server has no EventBuffer.
+const DefaultEventBuffer = 1024
@@ -0,0 +1,34 @@
+package errors
+
+import "strconv"
+
+// AppError is an error returned by a handler and delivered in a successful
+// frame: the request reached the handler, which decided it failed. A call
+// ends one of three ways:
+//
+//   - transport OK, handler OK: the response body, nil error.
+//   - transport OK, handler error: an *AppError, not worth retrying as is.
+//     Handlers return one to choose the code and attach a body, any other
+//     error arrives as an *AppError with code protocols.StatusErr.
+//   - transport error: anything else, e.g. a *Status from the server
+//     (busy, deadline, ...) or a conn/timeout error; retrying may help.
+type AppError struct {
+	Code    int32 // not 0 nor protocols.StatusOK, those become protocols.StatusErr
+	Message string
+	Body    []byte
+}
+
+func NewAppError(code int32, message string, body []byte) *AppError {
+	return &AppError{
+		Code:    code,
+		Message: message,
+		Body:    body,
+	}
+}
+
+func (ae *AppError) Error() string {
+	if ae.Message == "" {
+		return "app error " + strconv.Itoa(int(ae.Code))
+	}
+	return ae.Message
+}
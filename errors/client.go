@@ -1,6 +1,9 @@
 package errors
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+)
 
 //type Error struct {
 //
@@ -27,16 +30,69 @@ var (
 	ErrCtxWriteDone = errors.New("context write done")
 
 	ErrConnIdleTimeout     = errors.New("conn idle timeout")
+	ErrConnStale           = errors.New("conn stale")
 	ErrOutOfConnectionPool = errors.New("out of connection pool")
 
 	ErrSendErr    = errors.New("client send data err")
 	ErrReceiveErr = errors.New("client receive data err")
 	ErrClosed     = errors.New("client conn is closed")
 
+	ErrClientClosed = errors.New("client closed")
+
 	ErrWriteSocketErr = errors.New("write socket err")
+	ErrWriteTimeout   = errors.New("write request timeout")
 	ErrReadSocketErr  = errors.New("read socket err")
+	ErrTTFBTimeout    = errors.New("response first byte timeout")
 
 	ErrPeekWritingErr = errors.New("peek waiting data err")
+	ErrSettings       = errors.New("settings exchange failed")
+	ErrInvalidTrailer = errors.New("invalid response trailer")
 
 	ErrTransportTripClose = errors.New("transport round trip close")
+
+	ErrExceedMetadata = errors.New("exceed metadata size")
+	ErrNoDetail       = errors.New("response has no detail")
+	ErrServerGoAway   = errors.New("server sent goaway")
+
+	ErrSubscriptionClosed = errors.New("subscription closed")
+	ErrInvalidPush        = errors.New("invalid push frame")
+
+	ErrStreamAborted = errors.New("stream response aborted midway")
+	ErrSessionClosed = errors.New("session closed")
+	ErrSessionBroken = errors.New("session conn broken")
 )
+
+// StatusPoolExhausted is returned by the client itself, never sent on the wire:
+// MaxConnsPerHost conns are busy and none came free before the call deadline.
+var StatusPoolExhausted = &Status{code: 1503, message: "connection pool exhausted"}
+
+// StatusCircuitOpen is returned by the client itself: the breaker of the
+// address tripped, the call was not sent. RetryAfter is the cooldown left.
+var StatusCircuitOpen = &Status{code: 1504, message: "circuit open"}
+
+// StatusUnexpectedCode is returned by the client itself: the call got a code
+// it was not told to expect, see UnexpectedCodeError.
+var StatusUnexpectedCode = &Status{code: 1505, message: "unexpected response code"}
+
+// UnexpectedCodeError is the StatusUnexpectedCode of a call, Code is the one
+// received and Err the error that came with it, nil for a success.
+type UnexpectedCodeError struct {
+	Code int32
+	Err  error
+}
+
+func (ue *UnexpectedCodeError) Error() string {
+	msg := StatusUnexpectedCode.Error() + " " + strconv.Itoa(int(ue.Code))
+	if ue.Err != nil {
+		msg += " | " + ue.Err.Error()
+	}
+	return msg
+}
+
+func (ue *UnexpectedCodeError) Unwrap() error {
+	return ue.Err
+}
+
+func (ue *UnexpectedCodeError) Is(target error) bool {
+	return target == StatusUnexpectedCode
+}
@@ -1,11 +1,72 @@
 package errors
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrInvalidAddr = errors.New("invalid address")
+)
 
 func New(text string) error {
 	return errors.New(text)
 }
 
+func Is(err, target error) bool {
+	return errors.Is(err, target)
+}
+
+func As(err error, target interface{}) bool {
+	return errors.As(err, target)
+}
+
+// Wrap tags reason with a classify error, the message stays
+// "classify | reason". Is matches both, As and Unwrap reach reason.
 func Wrap(classify, reason error) error {
-	return errors.New(classify.Error() + " | " + reason.Error())
+	return &wrapError{
+		classify: classify,
+		reason:   reason,
+	}
+}
+
+type wrapError struct {
+	classify error
+	reason   error
+}
+
+func (we *wrapError) Error() string {
+	return we.classify.Error() + " | " + we.reason.Error()
+}
+
+func (we *wrapError) Unwrap() error {
+	return we.reason
+}
+
+func (we *wrapError) Is(target error) bool {
+	return errors.Is(we.classify, target)
+}
+
+// Errors collects the failures of a batch of calls.
+type Errors []error
+
+func (es Errors) Error() string {
+	if len(es) == 1 {
+		return es[0].Error()
+	}
+	msg := strconv.Itoa(len(es)) + " errors"
+	for _, err := range es {
+		msg += " | " + err.Error()
+	}
+	return msg
+}
+
+// Is reports whether any of the collected errors matches target.
+func (es Errors) Is(target error) bool {
+	for _, err := range es {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
 }
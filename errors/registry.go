@@ -0,0 +1,11 @@
+package errors
+
+import "errors"
+
+var (
+	ErrInvalidMethod    = errors.New("invalid registry method")
+	ErrDuplicateMethod  = errors.New("duplicate registry path")
+	ErrUnknownMethod    = errors.New("path not in registry")
+	ErrMessageType      = errors.New("message type does not match the registry")
+	ErrRegistryMismatch = errors.New("server and client registry differ")
+)
@@ -1,12 +1,23 @@
 package errors
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
 
+// Status is sent as a status frame: header.Code carries the code and the body
+// carries the message. A retry hint is appended to the message as
+// ";retry-after=<ms>", clients that don't know it simply see a longer message.
 type Status struct {
-	code    uint16
-	message string
+	code       uint16
+	message    string
+	retryAfter time.Duration
 }
 
+const retryAfterSep = ";retry-after="
+
 func NewStatus(code uint16, msg string) *Status {
 	return &Status{
 		code:    code,
@@ -22,16 +33,91 @@ func (st *Status) Code() uint16 {
 	return st.code
 }
 
+// RetryAfter is how long the server asked the client to wait before retrying, 0 if no hint.
+func (st *Status) RetryAfter() time.Duration {
+	return st.retryAfter
+}
+
+// WithRetryAfter returns a copy of st carrying a retry hint.
+func (st *Status) WithRetryAfter(d time.Duration) *Status {
+	return &Status{
+		code:       st.code,
+		message:    st.message,
+		retryAfter: d,
+	}
+}
+
+// Encode returns the status frame body.
+func (st *Status) Encode() []byte {
+	if st.retryAfter <= 0 {
+		return []byte(st.message)
+	}
+	return []byte(st.message + retryAfterSep + strconv.FormatInt(st.retryAfter.Milliseconds(), 10))
+}
+
+// DecodeStatus parses a status frame body written by Encode.
+func DecodeStatus(code uint16, body []byte) *Status {
+	st := &Status{
+		code:    code,
+		message: string(body),
+	}
+	if index := strings.LastIndex(st.message, retryAfterSep); index >= 0 {
+		ms, err := strconv.ParseInt(st.message[index+len(retryAfterSep):], 10, 64)
+		if err == nil && ms > 0 {
+			st.message = st.message[:index]
+			st.retryAfter = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return st
+}
+
 var (
 	ErrExceedBody         = errors.New("exceed body size")
 	ErrInvalidHeader      = errors.New("invalid header")
 	ErrInvalidHeaderMagic = errors.New("invalid header magic number")
 	ErrInvalidBody        = errors.New("invalid body")
+	ErrFrameSentinel      = errors.New("frame sentinel mismatch, frame boundary lost")
 
-	ErrNoKeepAlive = errors.New("no keep alive")
+	ErrNoKeepAlive      = errors.New("no keep alive")
+	ErrServerClosed     = errors.New("server closed")
+	ErrPingTimeout      = errors.New("ping timeout")
+	ErrIdleTimeout      = errors.New("idle timeout")
+	ErrGoAway           = errors.New("goaway grace elapsed")
+	ErrFirstByteTimeout = errors.New("first byte timeout")
+	ErrRequestCanceled  = errors.New("request canceled before its response")
+
+	ErrHeaderReadTimeout  = errors.New("header read timeout")
+	ErrTLSHandshake       = errors.New("tls handshake failed")
+	ErrConnAuth           = errors.New("conn auth failed")
+	ErrTooManyConns       = errors.New("exceed max connections")
+	ErrChunkIncomplete    = errors.New("chunked request incomplete")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+	ErrHandlerNotFound = errors.New("handler not found")
+	ErrDuplicatePath   = errors.New("path already registered")
+	ErrTooManyPaths    = errors.New("too many registered paths")
+	ErrStreamBroken    = errors.New("stream response broken")
+	ErrStreamWindow    = errors.New("stream window update not received")
+
+	ErrPushDropped  = errors.New("push dropped, subscription send buffer full")
+	ErrSlowConsumer = errors.New("slow subscription consumer")
+	ErrConnClosed   = errors.New("conn closed")
+
+	ErrWriteQueueFull = errors.New("conn write queue full")
 )
 
 var (
-	StatusInvalidRequest *Status = &Status{401, "invalid request"}
-	StatusInvalidPath    *Status = &Status{402, "invalid path"}
+	StatusInvalidRequest   *Status = &Status{code: 401, message: "invalid request"}
+	StatusInvalidPath      *Status = &Status{code: 402, message: "invalid path"}
+	StatusSignatureInvalid *Status = &Status{code: 403, message: "signature invalid"}
+
+	StatusDeadlineExceeded   *Status = &Status{code: 408, message: "deadline exceeded"}
+	StatusGoingAway          *Status = &Status{code: 410, message: "server going away"}
+	StatusRequestTooLarge    *Status = &Status{code: 413, message: "request too large"}
+	StatusChunkTimeout       *Status = &Status{code: 419, message: "chunked request not completed in time"}
+	StatusTooManyConnections *Status = &Status{code: 421, message: "too many connections from this cid"}
+	StatusRateLimited        *Status = &Status{code: 429, message: "rate limited"}
+	StatusServerBusy         *Status = &Status{code: 503, message: "server busy"}
+	StatusUnsupportedVersion *Status = &Status{code: 505, message: "unsupported protocol version"}
+	StatusEmptyResponse      *Status = &Status{code: 520, message: "handler returned nil response"}
 )
@@ -1,6 +1,23 @@
 package log
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	mutex  sync.Mutex
+	output io.Writer = os.Stdout
+)
+
+// SetOutput redirects Info, Warnf and Errorf, os.Stdout by default.
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	output = w
+}
 
 func Debugf(format string, a ...interface{}) {
 	//fmt.Printf(format, a...)
@@ -10,13 +27,25 @@ func Debug(a ...interface{}) {
 }
 
 func Info(a ...interface{}) {
-	fmt.Println(a...)
+	mutex.Lock()
+	defer mutex.Unlock()
+	fmt.Fprintln(output, a...)
 }
 
 func Infof(format string, a ...interface{}) {
-	fmt.Printf(format, a...)
+	mutex.Lock()
+	defer mutex.Unlock()
+	fmt.Fprintf(output, format, a...)
+}
+
+func Warnf(format string, a ...interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	fmt.Fprintf(output, format, a...)
 }
 
 func Errorf(format string, a ...interface{}) {
-	fmt.Printf(format, a...)
+	mutex.Lock()
+	defer mutex.Unlock()
+	fmt.Fprintf(output, format, a...)
 }
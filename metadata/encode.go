@@ -0,0 +1,65 @@
+package metadata
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var errInvalidEncoding = errors.New("metadata: invalid encoding")
+
+// Encode marshals md like a protobuf `map<string, string> md = 1`, used as
+// the body of a trailer frame.
+func Encode(md MD) []byte {
+	var buf []byte
+	for k, v := range md {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, entry)
+	}
+	return buf
+}
+
+// Decode parses a body written by Encode.
+func Decode(buf []byte) (MD, error) {
+	md := MD{}
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 || num != 1 || typ != protowire.BytesType {
+			return nil, errInvalidEncoding
+		}
+		buf = buf[n:]
+		entry, n := protowire.ConsumeBytes(buf)
+		if n < 0 {
+			return nil, errInvalidEncoding
+		}
+		buf = buf[n:]
+
+		var k, v string
+		for len(entry) > 0 {
+			num, typ, n := protowire.ConsumeTag(entry)
+			if n < 0 || typ != protowire.BytesType {
+				return nil, errInvalidEncoding
+			}
+			entry = entry[n:]
+			value, n := protowire.ConsumeString(entry)
+			if n < 0 {
+				return nil, errInvalidEncoding
+			}
+			entry = entry[n:]
+			switch num {
+			case 1:
+				k = value
+			case 2:
+				v = value
+			}
+		}
+		md[k] = v
+	}
+	return md, nil
+}
@@ -0,0 +1,125 @@
+// Package metadata carries small key/value pairs (request id, tenant, ...)
+// from the client to the server handler alongside a request.
+//
+// The client reads the outgoing metadata from the call context and puts it
+// into protocols.Request.Meta; the server exposes it to the handler through
+// the incoming context. Metadata is optional and costs nothing on the wire
+// when empty.
+//
+// The whole request frame is limited to 64KB, so the encoded size of the
+// metadata (sum of len(key)+len(value)) must not exceed
+// constant.MaxMetadataSize, otherwise the call fails with
+// errors.ErrExceedMetadata before anything is sent.
+package metadata
+
+import "context"
+
+// IdempotencyKey marks retries of one logical request, paths with a dedup
+// cache (server.HandlerConfig.DedupSize) run the handler once per key.
+const IdempotencyKey = "idempotency-key"
+
+// RequestIDKey identifies a request, e.g. in server.Server.InFlight.
+const RequestIDKey = "request-id"
+
+// WantTimingKey asks the server for a timing breakdown of the request, it is
+// sent back in the response trailer under the Timing*Key keys, in microseconds.
+const WantTimingKey = "want-timing"
+
+// WriteTimeoutKey overrides the server WriteTimeout for the response of the
+// request, in milliseconds, e.g. for a one-off slow admin call. See
+// server.SetWriteTimeout for the precedence.
+const WriteTimeoutKey = "write-timeout-ms"
+
+const (
+	TimingReadKey      = "timing-read-us"      // reading the request frame(s)
+	TimingQueueKey     = "timing-queue-us"     // decode, dispatch and concurrency limit wait
+	TimingHandlerKey   = "timing-handler-us"   // the handler itself
+	TimingSerializeKey = "timing-serialize-us" // marshaling the response
+	TimingWriteKey     = "timing-write-us"     // writing the response frame
+)
+
+// Trailer keys of a stream response whose body failed after part of it was
+// written: only its first StreamSentKey bytes are valid.
+const (
+	StreamErrorCodeKey = "stream-error-code" // protocols.Response.Code of the error
+	StreamErrorKey     = "stream-error"
+	StreamSentKey      = "stream-sent"
+)
+
+type MD map[string]string
+
+type outgoingKey struct{}
+type incomingKey struct{}
+
+// Pairs returns an MD formed by the mapping of key, value ...
+// Pairs panics if len(kv) is odd.
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic("metadata: Pairs got an odd number of input pairs")
+	}
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+func (md MD) Set(key, value string) {
+	md[key] = value
+}
+
+// Copy returns a copy of md, so callers can modify it freely.
+func (md MD) Copy() MD {
+	out := make(MD, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+// Size returns the number of bytes md takes against constant.MaxMetadataSize.
+func (md MD) Size() int {
+	size := 0
+	for k, v := range md {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// NewOutgoingContext attaches md to ctx, to be sent with the next call made with ctx.
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a new context with the provided kv merged
+// with any existing outgoing metadata in ctx.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	merged := Pairs(kv...)
+	for k, v := range md {
+		if _, ok := merged[k]; !ok {
+			merged[k] = v
+		}
+	}
+	return NewOutgoingContext(ctx, merged)
+}
+
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext is used by the server to hand the received metadata to a handler.
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext returns the metadata sent by the client, if any.
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
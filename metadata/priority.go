@@ -0,0 +1,44 @@
+package metadata
+
+import "context"
+
+// PriorityKey carries the Priority of a request. Paths with a concurrency
+// limit (server.HandlerConfig.MaxConcurrency) admit waiting requests by
+// priority, and shed low priority ones first when busy.
+const PriorityKey = "priority"
+
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0 // default, also for unknown values
+	PriorityHigh   Priority = 1 // health, control, ...
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// ParsePriority returns the Priority of a PriorityKey value.
+func ParsePriority(value string) Priority {
+	switch value {
+	case "low":
+		return PriorityLow
+	case "high":
+		return PriorityHigh
+	default:
+		return PriorityNormal
+	}
+}
+
+// WithPriority returns a ctx whose calls carry priority p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return AppendToOutgoingContext(ctx, PriorityKey, p.String())
+}
@@ -23,3 +23,13 @@ type HttpAddr struct {
 func (ha *HttpAddr) GetAddr() string {
 	return ha.IP + ":" + strconv.FormatUint(uint64(ha.Port), 10)
 }
+
+// UnixAddr is a unix domain socket path, a test/dev transport closer to vsock
+// than tcp (stream, local only); not meant for production.
+type UnixAddr struct {
+	Path string
+}
+
+func (ua *UnixAddr) GetAddr() string {
+	return ua.Path
+}
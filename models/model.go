@@ -1,12 +1,15 @@
 package models
 
-import "context"
+import (
+	"context"
+	"github.com/brodyxchen/vsock-sdk/constant"
+)
 
 const (
 	HeaderSize = 8 // 8个Byte
 )
 
-//Header 一排32位
+// Header 一排32位
 type Header struct {
 	Magic   uint16 // 2个byte
 	Version uint16
@@ -15,12 +18,19 @@ type Header struct {
 	Length uint16 //64k
 }
 
+// MoreChunks reports whether the request body continues in the next frame.
+func (h *Header) MoreChunks() bool {
+	return h.Code&constant.FlagMoreChunks != 0
+}
+
 type Request struct {
 	Header
 
 	Ctx  context.Context
 	Addr Addr
 	Body []byte
+
+	Idempotent bool // may be replayed on a new conn after it was sent
 }
 
 func (r *Request) Context() context.Context {
@@ -37,6 +47,8 @@ type Response struct {
 	Body []byte
 	Err  error // 业务错误
 
+	Trailer map[string]string // sent after the response when the request asked for it
+
 	Req      *Request
 	ConnName int64
 }
@@ -51,6 +63,7 @@ type NotifyReceive struct {
 	Reply chan *ReceiveResponse
 
 	CallerGone <-chan struct{} // 没有调用者了
+	FirstByte  chan struct{}   // closed once the response started to arrive, nil if not watched
 }
 type ReceiveResponse struct {
 	Rsp *Response
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"fmt"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	SchemeVSock = "vsock"
+	SchemeTcp   = "tcp"
+	SchemeUnix  = "unix"
+)
+
+// ParseAddr parses "vsock://<cid>:<port>", "tcp://<host>:<port>" or
+// "unix:///<path>", so one binary can run inside a VM and in local development.
+func ParseAddr(addr string) (Addr, error) {
+	index := strings.Index(addr, "://")
+	if index < 0 {
+		return nil, fmt.Errorf("%w %q: missing scheme, want vsock://cid:port, tcp://host:port or unix:///path", errors.ErrInvalidAddr, addr)
+	}
+	scheme, rest := addr[:index], addr[index+len("://"):]
+
+	if scheme == SchemeUnix {
+		if rest == "" {
+			return nil, fmt.Errorf("%w %q: missing socket path", errors.ErrInvalidAddr, addr)
+		}
+		return &UnixAddr{Path: rest}, nil
+	}
+
+	host, port, err := net.SplitHostPort(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %v", errors.ErrInvalidAddr, addr, err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: invalid port %q", errors.ErrInvalidAddr, addr, port)
+	}
+
+	switch scheme {
+	case SchemeVSock:
+		cid, err := strconv.ParseUint(host, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: invalid context id %q", errors.ErrInvalidAddr, addr, host)
+		}
+		return &VSockAddr{
+			ContextId: uint32(cid),
+			Port:      uint32(portNum),
+		}, nil
+	case SchemeTcp:
+		if portNum > 65535 {
+			return nil, fmt.Errorf("%w %q: invalid port %q", errors.ErrInvalidAddr, addr, port)
+		}
+		return &HttpAddr{
+			IP:   host,
+			Port: uint32(portNum),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w %q: unknown scheme %q", errors.ErrInvalidAddr, addr, scheme)
+	}
+}
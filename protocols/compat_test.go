@@ -0,0 +1,233 @@
+package protocols
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The frozen schemas below are the messages as the first released peers
+// know them, encoded and decoded by hand so they never follow a change of
+// models.proto. New peers must keep talking to them both ways.
+//
+//	message Request  { string path = 1; bytes req = 2; }
+//	message Response { int32 code = 1; bytes rsp = 2; string err = 3; }
+
+type frozenRequest struct {
+	Path string
+	Req  []byte
+}
+
+type frozenResponse struct {
+	Code int32
+	Rsp  []byte
+	Err  string
+}
+
+func (r *frozenRequest) marshal() []byte {
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	buf = protowire.AppendString(buf, r.Path)
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	return protowire.AppendBytes(buf, r.Req)
+}
+
+func (r *frozenResponse) marshal() []byte {
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.VarintType)
+	buf = protowire.AppendVarint(buf, uint64(r.Code))
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	buf = protowire.AppendBytes(buf, r.Rsp)
+	buf = protowire.AppendTag(buf, 3, protowire.BytesType)
+	return protowire.AppendString(buf, r.Err)
+}
+
+// frozenFields decodes buf like an old peer: the known fields by number and
+// wire type, everything else skipped.
+func frozenFields(t *testing.T, buf []byte, known map[protowire.Number]protowire.Type, field func(num protowire.Number, buf []byte) int) {
+	t.Helper()
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			t.Fatalf("old peer can't parse tag: %v", protowire.ParseError(n))
+		}
+		buf = buf[n:]
+		if want, ok := known[num]; ok && want == typ {
+			n = field(num, buf)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			t.Fatalf("old peer can't parse field %v: %v", num, protowire.ParseError(n))
+		}
+		buf = buf[n:]
+	}
+}
+
+func unmarshalFrozenRequest(t *testing.T, buf []byte) *frozenRequest {
+	r := &frozenRequest{}
+	frozenFields(t, buf, map[protowire.Number]protowire.Type{1: protowire.BytesType, 2: protowire.BytesType},
+		func(num protowire.Number, buf []byte) int {
+			v, n := protowire.ConsumeBytes(buf)
+			if num == 1 {
+				r.Path = string(v)
+			} else {
+				r.Req = v
+			}
+			return n
+		})
+	return r
+}
+
+func unmarshalFrozenResponse(t *testing.T, buf []byte) *frozenResponse {
+	r := &frozenResponse{}
+	frozenFields(t, buf, map[protowire.Number]protowire.Type{1: protowire.VarintType, 2: protowire.BytesType, 3: protowire.BytesType},
+		func(num protowire.Number, buf []byte) int {
+			if num == 1 {
+				v, n := protowire.ConsumeVarint(buf)
+				r.Code = int32(v)
+				return n
+			}
+			v, n := protowire.ConsumeBytes(buf)
+			if num == 2 {
+				r.Rsp = v
+			} else {
+				r.Err = string(v)
+			}
+			return n
+		})
+	return r
+}
+
+// TestFieldNumbers locks the field numbers and kinds of the generated
+// messages: a field may be added under a new number, never renumbered,
+// retyped or reused, and none may take signatureField.
+func TestFieldNumbers(t *testing.T) {
+	frozen := map[string]map[string]struct {
+		num  protoreflect.FieldNumber
+		kind protoreflect.Kind
+	}{
+		"Request": {
+			"path":    {1, protoreflect.StringKind},
+			"req":     {2, protoreflect.BytesKind},
+			"meta":    {3, protoreflect.MessageKind}, // map<string, string>
+			"timeout": {4, protoreflect.Int64Kind},
+		},
+		"Response": {
+			"code": {1, protoreflect.Int32Kind},
+			"rsp":  {2, protoreflect.BytesKind},
+			"err":  {3, protoreflect.StringKind},
+		},
+	}
+	for _, msg := range []proto.Message{&Request{}, &Response{}} {
+		desc := msg.ProtoReflect().Descriptor()
+		fields := frozen[string(desc.Name())]
+		for i := 0; i < desc.Fields().Len(); i++ {
+			field := desc.Fields().Get(i)
+			if field.Number() == signatureField {
+				t.Fatalf("%v.%v takes the signature field %v", desc.Name(), field.Name(), signatureField)
+			}
+			want, ok := fields[string(field.Name())]
+			if !ok {
+				t.Errorf("%v.%v = %v is new: add it to this table, under a number never used before",
+					desc.Name(), field.Name(), field.Number())
+				continue
+			}
+			if field.Number() != want.num || field.Kind() != want.kind {
+				t.Errorf("%v.%v changed from %v %v to %v %v, old peers can no longer read it",
+					desc.Name(), field.Name(), want.num, want.kind, field.Number(), field.Kind())
+			}
+		}
+		for name := range fields {
+			if desc.Fields().ByName(protoreflect.Name(name)) == nil {
+				t.Errorf("%v.%v was removed, its number must stay reserved", desc.Name(), name)
+			}
+		}
+	}
+}
+
+func TestRequestCompat(t *testing.T) {
+	signer := &Signer{Key: []byte("secret")}
+
+	// 新的写, 旧的读: 新字段和签名都被跳过
+	current := &Request{
+		Path:    "lookup",
+		Req:     []byte("key"),
+		Meta:    map[string]string{"request-id": "1"},
+		Timeout: 500,
+	}
+	body, err := proto.Marshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range [][]byte{body, signer.Sign(body)} {
+		old := unmarshalFrozenRequest(t, buf)
+		if old.Path != current.Path || !bytes.Equal(old.Req, current.Req) {
+			t.Fatalf("old peer read %+v, want path and req of %+v", old, current)
+		}
+	}
+
+	// 旧的写, 新的读: 新字段取零值
+	old := &frozenRequest{Path: "lookup", Req: []byte("key")}
+	var got Request
+	if err := proto.Unmarshal(old.marshal(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Path != old.Path || !bytes.Equal(got.Req, old.Req) || got.Meta != nil || got.Timeout != 0 {
+		t.Fatalf("new peer read %v from an old request", &got)
+	}
+}
+
+func TestResponseCompat(t *testing.T) {
+	signer := &Signer{Key: []byte("secret")}
+
+	current := &Response{Code: StatusErr, Rsp: []byte("detail"), Err: "failed"}
+	body, err := proto.Marshal(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, buf := range [][]byte{body, signer.Sign(body)} {
+		old := unmarshalFrozenResponse(t, buf)
+		if old.Code != current.Code || !bytes.Equal(old.Rsp, current.Rsp) || old.Err != current.Err {
+			t.Fatalf("old peer read %+v, want %v", old, current)
+		}
+	}
+
+	old := &frozenResponse{Code: StatusOK, Rsp: []byte("ok")}
+	var got Response
+	if err := proto.Unmarshal(old.marshal(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Code != old.Code || !bytes.Equal(got.Rsp, old.Rsp) || got.Err != "" {
+		t.Fatalf("new peer read %v from an old response", &got)
+	}
+}
+
+// TestHandEncodedCompat checks the hand encoded messages skip the fields a
+// newer peer may add after the ones they know.
+func TestHandEncodedCompat(t *testing.T) {
+	newer := func(buf []byte) []byte {
+		buf = protowire.AppendTag(buf, 99, protowire.BytesType)
+		return protowire.AppendString(buf, "added later")
+	}
+
+	push, err := UnmarshalPush(newer((&Push{ID: 7, Msg: []byte("msg")}).Marshal()))
+	if err != nil || push.ID != 7 || string(push.Msg) != "msg" {
+		t.Fatalf("push: %+v %v", push, err)
+	}
+	settings, err := UnmarshalSettings(newer((&Settings{MaxFrameSize: 1000, StreamWindow: 4096}).Marshal()))
+	if err != nil || settings.MaxFrameSize != 1000 || settings.StreamWindow != 4096 {
+		t.Fatalf("settings: %+v %v", settings, err)
+	}
+	update, err := UnmarshalWindowUpdate(newer((&WindowUpdate{Increment: 2048}).Marshal()))
+	if err != nil || update.Increment != 2048 {
+		t.Fatalf("window update: %+v %v", update, err)
+	}
+	health, err := UnmarshalHealth(newer((&Health{Status: HealthReady, AliveConns: 3}).Marshal()))
+	if err != nil || health.Status != HealthReady || health.AliveConns != 3 {
+		t.Fatalf("health: %+v %v", health, err)
+	}
+}
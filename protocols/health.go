@@ -0,0 +1,80 @@
+package protocols
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Health states, from the most to the least severe.
+const (
+	HealthDraining    = "draining"    // shutting down, don't route new requests
+	HealthMaintenance = "maintenance" // in maintenance mode, requests are rejected
+	HealthOverloaded  = "overloaded"  // at MaxConnections or a path at MaxConcurrency
+	HealthReady       = "ready"
+)
+
+// Health is the Rsp of the handler installed by server.RegisterHealth. It is
+// encoded by hand, wire compatible with
+//
+//	message Health {
+//	  string status = 1;
+//	  int64 alive_conns = 2;
+//	  int64 in_flight = 3;
+//	  int64 max_connections = 4; // 0 is unlimited
+//	}
+type Health struct {
+	Status         string
+	AliveConns     int64
+	InFlight       int64
+	MaxConnections int64
+}
+
+var errInvalidHealth = errors.New("invalid health message")
+
+func (h *Health) Marshal() []byte {
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	buf = protowire.AppendString(buf, h.Status)
+	for i, value := range []int64{h.AliveConns, h.InFlight, h.MaxConnections} {
+		if value != 0 {
+			buf = protowire.AppendTag(buf, protowire.Number(i+2), protowire.VarintType)
+			buf = protowire.AppendVarint(buf, uint64(value))
+		}
+	}
+	return buf
+}
+
+// UnmarshalHealth parses a Health, unknown fields are skipped.
+func UnmarshalHealth(buf []byte) (*Health, error) {
+	h := &Health{}
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return nil, errInvalidHealth
+		}
+		buf = buf[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			h.Status, n = protowire.ConsumeString(buf)
+		case num >= 2 && num <= 4 && typ == protowire.VarintType:
+			var value uint64
+			value, n = protowire.ConsumeVarint(buf)
+			switch num {
+			case 2:
+				h.AliveConns = int64(value)
+			case 3:
+				h.InFlight = int64(value)
+			case 4:
+				h.MaxConnections = int64(value)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return nil, errInvalidHealth
+		}
+		buf = buf[n:]
+	}
+	return h, nil
+}
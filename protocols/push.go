@@ -0,0 +1,66 @@
+package protocols
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Push is the body of the server push frames of a subscription, see
+// constant.ActionPush and constant.ActionPushEnd. It is encoded by hand,
+// wire compatible with
+//
+//	message Push {
+//	  uint64 id = 1;  // subscription id, the Rsp of the subscribe request
+//	  bytes msg = 2;  // ActionPush only
+//	  string err = 3; // ActionPushEnd only, why the subscription ended, empty if the handler returned nil
+//	}
+type Push struct {
+	ID  uint64
+	Msg []byte
+	Err string
+}
+
+var errInvalidPush = errors.New("invalid push message")
+
+func (p *Push) Marshal() []byte {
+	buf := make([]byte, 0, 2*protowire.SizeVarint(p.ID)+len(p.Msg)+len(p.Err)+4)
+	buf = protowire.AppendTag(buf, 1, protowire.VarintType)
+	buf = protowire.AppendVarint(buf, p.ID)
+	if len(p.Msg) > 0 {
+		buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, p.Msg)
+	}
+	if p.Err != "" {
+		buf = protowire.AppendTag(buf, 3, protowire.BytesType)
+		buf = protowire.AppendString(buf, p.Err)
+	}
+	return buf
+}
+
+// UnmarshalPush parses a Push, unknown fields are skipped. Msg aliases buf.
+func UnmarshalPush(buf []byte) (*Push, error) {
+	p := &Push{}
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return nil, errInvalidPush
+		}
+		buf = buf[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			p.ID, n = protowire.ConsumeVarint(buf)
+		case num == 2 && typ == protowire.BytesType:
+			p.Msg, n = protowire.ConsumeBytes(buf)
+		case num == 3 && typ == protowire.BytesType:
+			p.Err, n = protowire.ConsumeString(buf)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return nil, errInvalidPush
+		}
+		buf = buf[n:]
+	}
+	return p, nil
+}
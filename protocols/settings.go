@@ -0,0 +1,113 @@
+package protocols
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Settings is the body of the constant.ActionSettings frames exchanged when
+// a conn opens. It is encoded by hand, wire compatible with
+//
+//	message Settings {
+//	  uint32 max_frame_size = 1; // largest frame body the sender is willing to receive
+//	  uint32 stream_window = 2;  // flow control window of stream responses, see below
+//	}
+//
+// A client sets StreamWindow to the bytes of a stream response frame it
+// takes before granting more with constant.ActionWindowUpdate frames, the
+// server echoes it when it honors the window. 0 means no flow control.
+type Settings struct {
+	MaxFrameSize uint32
+	StreamWindow uint32
+}
+
+var errInvalidSettings = errors.New("invalid settings message")
+
+func (s *Settings) Marshal() []byte {
+	buf := make([]byte, 0, 2+protowire.SizeVarint(uint64(s.MaxFrameSize))+protowire.SizeVarint(uint64(s.StreamWindow)))
+	if s.MaxFrameSize > 0 {
+		buf = protowire.AppendTag(buf, 1, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(s.MaxFrameSize))
+	}
+	if s.StreamWindow > 0 {
+		buf = protowire.AppendTag(buf, 2, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(s.StreamWindow))
+	}
+	return buf
+}
+
+// UnmarshalSettings parses a Settings, unknown fields are skipped.
+func UnmarshalSettings(buf []byte) (*Settings, error) {
+	s := &Settings{}
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return nil, errInvalidSettings
+		}
+		buf = buf[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(buf)
+			s.MaxFrameSize = uint32(v)
+		case num == 2 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(buf)
+			s.StreamWindow = uint32(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return nil, errInvalidSettings
+		}
+		buf = buf[n:]
+	}
+	return s, nil
+}
+
+// WindowUpdate is the body of a constant.ActionWindowUpdate frame, encoded
+// by hand like Settings:
+//
+//	message WindowUpdate {
+//	  uint32 increment = 1; // bytes of the stream frame the server may send on top of the window
+//	}
+type WindowUpdate struct {
+	Increment uint32
+}
+
+var errInvalidWindowUpdate = errors.New("invalid window update message")
+
+func (w *WindowUpdate) Marshal() []byte {
+	buf := make([]byte, 0, 1+protowire.SizeVarint(uint64(w.Increment)))
+	if w.Increment > 0 {
+		buf = protowire.AppendTag(buf, 1, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(w.Increment))
+	}
+	return buf
+}
+
+// UnmarshalWindowUpdate parses a WindowUpdate, unknown fields are skipped.
+func UnmarshalWindowUpdate(buf []byte) (*WindowUpdate, error) {
+	w := &WindowUpdate{}
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return nil, errInvalidWindowUpdate
+		}
+		buf = buf[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(buf)
+			w.Increment = uint32(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return nil, errInvalidWindowUpdate
+		}
+		buf = buf[n:]
+	}
+	return w, nil
+}
@@ -0,0 +1,73 @@
+package protocols
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// signatureField is the field of Request and Response holding the HMAC of
+// the bytes before it. It is always last, and skipped as unknown by peers
+// not signing.
+const signatureField = 15
+
+// Signer signs the marshaled Request and Response bodies with an HMAC keyed
+// by a secret shared by client and server, for tamper detection without
+// TLS. The HMAC of the body is appended as field 15, a bytes field; control,
+// status, trailer and push frames are not signed.
+type Signer struct {
+	Key []byte
+
+	// Hash is the hash of the HMAC, sha256.New if nil. Its Size must stay
+	// below 128 bytes, both sides must use the same one.
+	Hash func() hash.Hash
+}
+
+// New returns an HMAC to sign a body written piece by piece, see AppendSum.
+func (s *Signer) New() hash.Hash {
+	fn := s.Hash
+	if fn == nil {
+		fn = sha256.New
+	}
+	return hmac.New(fn, s.Key)
+}
+
+// Size is how many bytes the signature field adds to a body.
+func (s *Signer) Size() int {
+	return 2 + s.New().Size()
+}
+
+// AppendSum appends the signature field of the body written into mac to buf.
+func (s *Signer) AppendSum(buf []byte, mac hash.Hash) []byte {
+	buf = protowire.AppendTag(buf, signatureField, protowire.BytesType)
+	return protowire.AppendBytes(buf, mac.Sum(nil))
+}
+
+// Sign returns a copy of body followed by its signature field.
+func (s *Signer) Sign(body []byte) []byte {
+	mac := s.New()
+	mac.Write(body)
+	return s.AppendSum(append(make([]byte, 0, len(body)+s.Size()), body...), mac)
+}
+
+// Open checks the signature field ending body and returns the body before
+// it, false if it is missing or doesn't match. The comparison is constant time.
+func (s *Signer) Open(body []byte) ([]byte, bool) {
+	mac := s.New()
+	size := mac.Size()
+	start := len(body) - size - 2
+	if start < 0 {
+		return nil, false
+	}
+	num, typ, n := protowire.ConsumeTag(body[start:])
+	if n != 1 || num != signatureField || typ != protowire.BytesType || int(body[start+1]) != size {
+		return nil, false
+	}
+	mac.Write(body[:start])
+	if !hmac.Equal(mac.Sum(nil), body[start+2:]) {
+		return nil, false
+	}
+	return body[:start], true
+}
@@ -0,0 +1,199 @@
+// Package registry declares the paths of a service together with their
+// request/response messages, so server handlers and client calls are typed
+// from one place instead of a path string plus manual marshaling.
+//
+// Declare the registry once, shared by both sides:
+//
+//	var Users = registry.MustNew(
+//		registry.Method{Path: "user.get", Request: &pb.GetUserReq{}, Response: &pb.GetUserRsp{}},
+//	)
+//
+// The server binds handlers with Users.Handle and Users.Serve, a client stub
+// is a one liner over Call:
+//
+//	func GetUser(ctx context.Context, cli *client.Client, addr models.Addr, req *pb.GetUserReq) (*pb.GetUserRsp, error) {
+//		rsp, err := Users.Call(ctx, cli, addr, "user.get", req)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return rsp.(*pb.GetUserRsp), nil
+//	}
+//
+// Verify checks against a running server that both were built from the same registry.
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/brodyxchen/vsock-sdk/client"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/server"
+	"google.golang.org/protobuf/proto"
+)
+
+// DigestPath is answered by Serve with the registry digest, see Verify.
+const DigestPath = "_registry.digest"
+
+// Codec marshals the messages of a registry, proto by default.
+type Codec interface {
+	Marshal(msg proto.Message) ([]byte, error)
+	Unmarshal(data []byte, msg proto.Message) error
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Marshal(msg proto.Message) ([]byte, error)      { return proto.Marshal(msg) }
+func (protoCodec) Unmarshal(data []byte, msg proto.Message) error { return proto.Unmarshal(data, msg) }
+
+// Method binds a path to its messages, Request and Response are only used as prototypes.
+type Method struct {
+	Path     string
+	Request  proto.Message
+	Response proto.Message
+}
+
+type Registry struct {
+	Codec Codec // nil means proto
+
+	methods map[string]Method
+	digest  string
+}
+
+// HandlerFunc gets a Request of the method's type and must return its Response type.
+type HandlerFunc func(ctx context.Context, req proto.Message) (proto.Message, error)
+
+func New(methods ...Method) (*Registry, error) {
+	reg := &Registry{
+		methods: make(map[string]Method, len(methods)),
+	}
+	for _, method := range methods {
+		if method.Path == "" || method.Path == DigestPath || method.Request == nil || method.Response == nil {
+			return nil, errors.ErrInvalidMethod
+		}
+		if _, ok := reg.methods[method.Path]; ok {
+			return nil, errors.ErrDuplicateMethod
+		}
+		reg.methods[method.Path] = method
+	}
+	reg.digest = reg.computeDigest()
+	return reg, nil
+}
+
+// MustNew is New for package level declarations, it panics on an invalid registry.
+func MustNew(methods ...Method) *Registry {
+	reg, err := New(methods...)
+	if err != nil {
+		panic(err)
+	}
+	return reg
+}
+
+// Digest identifies the declared paths and message types, equal on both sides when they agree.
+func (reg *Registry) Digest() string {
+	return reg.digest
+}
+
+func (reg *Registry) computeDigest() string {
+	lines := make([]string, 0, len(reg.methods))
+	for path, method := range reg.methods {
+		lines = append(lines, path+" "+messageName(method.Request)+" "+messageName(method.Response)+"\n")
+	}
+	sort.Strings(lines)
+
+	hash := sha256.New()
+	for _, line := range lines {
+		_, _ = hash.Write([]byte(line))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Handle registers fn for a declared path on srv.
+func (reg *Registry) Handle(srv *server.Server, path string, fn HandlerFunc) error {
+	method, ok := reg.methods[path]
+	if !ok {
+		return errors.ErrUnknownMethod
+	}
+	codec := reg.codec()
+
+	return srv.HandleContext(path, func(ctx context.Context, body []byte) ([]byte, error) {
+		req := newMessage(method.Request)
+		if err := codec.Unmarshal(body, req); err != nil {
+			return nil, err
+		}
+		rsp, err := fn(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if messageName(rsp) != messageName(method.Response) {
+			return nil, errors.ErrMessageType
+		}
+		return codec.Marshal(rsp)
+	})
+}
+
+// Serve registers DigestPath on srv, so clients can Verify the registry.
+func (reg *Registry) Serve(srv *server.Server) error {
+	return srv.HandleFunc(DigestPath, func([]byte) ([]byte, error) {
+		return []byte(reg.digest), nil
+	})
+}
+
+// Call sends req to a declared path and returns the decoded Response of the method.
+func (reg *Registry) Call(ctx context.Context, cli *client.Client, addr models.Addr, path string, req proto.Message) (proto.Message, error) {
+	method, ok := reg.methods[path]
+	if !ok {
+		return nil, errors.ErrUnknownMethod
+	}
+	if messageName(req) != messageName(method.Request) {
+		return nil, errors.ErrMessageType
+	}
+	codec := reg.codec()
+
+	body, err := codec.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	rspBody, err := cli.Call(ctx, addr, path, body)
+	if err != nil {
+		return nil, err
+	}
+	rsp := newMessage(method.Response)
+	if err := codec.Unmarshal(rspBody, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// Verify asks the server at addr for its registry digest, errors.ErrRegistryMismatch if it differs.
+func (reg *Registry) Verify(ctx context.Context, cli *client.Client, addr models.Addr) error {
+	digest, err := cli.Call(ctx, addr, DigestPath, nil)
+	if err != nil {
+		return err
+	}
+	if string(digest) != reg.digest {
+		return errors.ErrRegistryMismatch
+	}
+	return nil
+}
+
+func (reg *Registry) codec() Codec {
+	if reg.Codec != nil {
+		return reg.Codec
+	}
+	return protoCodec{}
+}
+
+func newMessage(prototype proto.Message) proto.Message {
+	return prototype.ProtoReflect().New().Interface()
+}
+
+func messageName(msg proto.Message) string {
+	if msg == nil {
+		return ""
+	}
+	return string(msg.ProtoReflect().Descriptor().FullName())
+}
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/client"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/server"
+	"github.com/brodyxchen/vsock-sdk/statistics"
+	"google.golang.org/protobuf/proto"
+)
+
+func startServer(t *testing.T, reg *Registry) models.Addr {
+	statistics.InitServer()
+	srv := &server.Server{
+		Addr:         &models.HttpAddr{IP: "127.0.0.1"},
+		ReadTimeout:  time.Second * 5,
+		WriteTimeout: time.Second * 5,
+	}
+	srv.Init()
+	reg.Serve(srv)
+	err := reg.Handle(srv, "echo", func(ctx context.Context, req proto.Message) (proto.Message, error) {
+		return &protocols.Response{Rsp: req.(*protocols.Request).Req}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	return &models.HttpAddr{IP: tcpAddr.IP.String(), Port: uint32(tcpAddr.Port)}
+}
+
+func TestRegistry(t *testing.T) {
+	reg := MustNew(Method{Path: "echo", Request: &protocols.Request{}, Response: &protocols.Response{}})
+	addr := startServer(t, reg)
+
+	statistics.InitClient()
+	cli := &client.Client{Timeout: time.Second}
+	cli.Init(&client.Config{})
+	ctx := context.Background()
+
+	if err := reg.Verify(ctx, cli, addr); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := reg.Call(ctx, cli, addr, "echo", &protocols.Request{Req: []byte("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp.(*protocols.Response).Rsp) != "hi" {
+		t.Fatalf("unexpected response %v", rsp)
+	}
+
+	if _, err := reg.Call(ctx, cli, addr, "echo", &protocols.Response{}); err != errors.ErrMessageType {
+		t.Fatalf("expect ErrMessageType, got %v", err)
+	}
+	if _, err := reg.Call(ctx, cli, addr, "missing", &protocols.Request{}); err != errors.ErrUnknownMethod {
+		t.Fatalf("expect ErrUnknownMethod, got %v", err)
+	}
+
+	// 客户端的定义与服务端不一致
+	other := MustNew(Method{Path: "echo", Request: &protocols.Request{}, Response: &protocols.Request{}})
+	if err := other.Verify(ctx, cli, addr); err != errors.ErrRegistryMismatch {
+		t.Fatalf("expect ErrRegistryMismatch, got %v", err)
+	}
+
+	if _, err := New(Method{Path: "a", Request: &protocols.Request{}, Response: &protocols.Response{}},
+		Method{Path: "a", Request: &protocols.Request{}, Response: &protocols.Response{}}); err != errors.ErrDuplicateMethod {
+		t.Fatalf("expect ErrDuplicateMethod, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/log"
+)
+
+// BackgroundFunc is work a handler hands off to run after its response is written.
+type BackgroundFunc func(ctx context.Context) error
+
+type afterResponseKey struct{}
+
+// RunAfterResponse schedules fn to run once the response of the current
+// request is written, ctx must be the handler context. fn runs on the
+// server's background pool with a context that keeps the request values
+// (metadata ...) but not its deadline. Errors and panics of fn are logged
+// and counted in "srv.background.failed". Work of a request answered with a
+// status error (deadline exceeded ...) is dropped. Returns false when ctx is
+// not a handler context, fn is then not scheduled.
+func RunAfterResponse(ctx context.Context, fn BackgroundFunc) bool {
+	rp, ok := ctx.Value(afterResponseKey{}).(*reply)
+	if !ok {
+		return false
+	}
+	rp.afterMutex.Lock()
+	rp.after = append(rp.after, fn)
+	rp.afterMutex.Unlock()
+	return true
+}
+
+// backgroundPool runs BackgroundFuncs with at most size at once and tracks them for shutdown.
+type backgroundPool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newBackgroundPool(size int) *backgroundPool {
+	if size <= 0 {
+		size = runtime.GOMAXPROCS(0)
+	}
+	return &backgroundPool{
+		slots: make(chan struct{}, size),
+	}
+}
+
+func (srv *Server) runBackground(ctx context.Context, fns []BackgroundFunc) {
+	if len(fns) == 0 {
+		return
+	}
+	ctx = detachContext{ctx}
+	pool := srv.background
+
+	pool.wg.Add(len(fns))
+	for _, fn := range fns {
+		go func(fn BackgroundFunc) {
+			defer pool.wg.Done()
+			pool.slots <- struct{}{}
+			defer func() { <-pool.slots }()
+
+			srv.backgroundHist.Inc(1)
+			defer srv.backgroundHist.Dec(1)
+
+			if err := srv.callBackground(ctx, fn); err != nil {
+				srv.backgroundFailHist.Inc(1)
+				log.Errorf("srv background work failed: %v\n", err)
+			}
+		}(fn)
+	}
+}
+
+func (srv *Server) callBackground(ctx context.Context, fn BackgroundFunc) (err error) {
+	defer func() {
+		if srv.DisablePanicRecovery {
+			return
+		}
+		if r := recover(); r != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			err = fmt.Errorf("panic: %v\n%s", r, buf)
+		}
+	}()
+	return fn(ctx)
+}
+
+// WaitBackground blocks until all scheduled background work finished, or ctx is done.
+func (srv *Server) WaitBackground(ctx context.Context) error {
+	srv.ready()
+	done := make(chan struct{})
+	go func() {
+		srv.background.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// detachContext keeps the values of a request context without its deadline and cancellation.
+type detachContext struct {
+	parent context.Context
+}
+
+func (dc detachContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (dc detachContext) Done() <-chan struct{}             { return nil }
+func (dc detachContext) Err() error                        { return nil }
+func (dc detachContext) Value(key interface{}) interface{} { return dc.parent.Value(key) }
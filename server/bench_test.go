@@ -0,0 +1,430 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/mdlayher/vsock"
+)
+
+// BenchmarkFlushInterval pipelines a fast and a slow request and measures how
+// long the fast response takes to arrive.
+func BenchmarkFlushInterval(b *testing.B) {
+	cases := []struct {
+		name          string
+		coalescing    bool
+		flushInterval time.Duration
+	}{
+		{"NoCoalescing", false, 0},
+		{"Coalescing", true, 0},
+		{"CoalescingFlush500us", true, 500 * time.Microsecond},
+	}
+
+	for _, cs := range cases {
+		b.Run(cs.name, func(b *testing.B) {
+			srv := newTestServer()
+			srv.WriteCoalescing = cs.coalescing
+			srv.FlushInterval = cs.flushInterval
+			srv.HandleFunc("fast", func(bytes []byte) ([]byte, error) {
+				return bytes, nil
+			})
+			srv.HandleFunc("slow", func(bytes []byte) ([]byte, error) {
+				time.Sleep(time.Millisecond * 5)
+				return bytes, nil
+			})
+			tc := dialTestConn(b, startTestServer(b, srv))
+
+			latencies := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				now := time.Now()
+				_ = tc.queue(&protocols.Request{Path: "fast", Req: []byte("ping")})
+				if err := tc.send(&protocols.Request{Path: "slow", Req: []byte("ping")}); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, _, err := tc.receive(); err != nil {
+					b.Fatal(err)
+				}
+				latencies = append(latencies, time.Since(now))
+				if _, _, _, err := tc.receive(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*50/100].Microseconds()), "p50-us")
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-us")
+		})
+	}
+}
+
+// patternReader produces bytes on the fly, like a response rendered while it is written.
+type patternReader struct{}
+
+func (patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(i)
+	}
+	return len(p), nil
+}
+
+// BenchmarkStreamResponse compares a large buffered response with the same
+// response produced through HandleStream.
+func BenchmarkStreamResponse(b *testing.B) {
+	const size = 60 << 10
+
+	srv := newTestServer()
+	srv.HandleFunc("buffered", func(req []byte) ([]byte, error) {
+		rsp := make([]byte, size)
+		_, _ = patternReader{}.Read(rsp)
+		return rsp, nil
+	})
+	srv.HandleStream("stream", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		return io.LimitReader(patternReader{}, size), size, nil
+	}, nil)
+	tc := dialTestConn(b, startTestServer(b, srv))
+
+	for _, path := range []string{"buffered", "stream"} {
+		b.Run(path, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := tc.send(&protocols.Request{Path: path}); err != nil {
+					b.Fatal(err)
+				}
+				_, rsp, _, err := tc.receive()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(rsp.Rsp) != size {
+					b.Fatalf("unexpected size %v", len(rsp.Rsp))
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkServe is the throughput baseline on the in-memory listener:
+// payload size x keep-alive x concurrent conns. Compare runs with benchstat.
+func BenchmarkServe(b *testing.B) {
+	payloads := []struct {
+		name string
+		size int
+	}{
+		{"Small", 64},
+		{"Large", 32 << 10},
+	}
+
+	for _, payload := range payloads {
+		for _, keepAlive := range []bool{true, false} {
+			for _, conns := range []int{1, 8} {
+				name := fmt.Sprintf("%s/KeepAlive=%v/Conns=%d", payload.name, keepAlive, conns)
+				b.Run(name, func(b *testing.B) {
+					benchmarkServe(b, payload.size, keepAlive, conns)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkServe(b *testing.B, size int, keepAlive bool, conns int) {
+	srv := newTestServer()
+	if !keepAlive {
+		srv.DisableKeepAlives = 1
+	}
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	ln := startMemServer(b, srv)
+	req := &protocols.Request{Path: "echo", Req: make([]byte, size)}
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var (
+		wg       sync.WaitGroup
+		requests = int64(b.N)
+	)
+	errs := make(chan error, conns)
+	wg.Add(conns)
+	for i := 0; i < conns; i++ {
+		go func() {
+			defer wg.Done()
+			var tc *testConn
+			for atomic.AddInt64(&requests, -1) >= 0 {
+				if tc == nil {
+					tc = wrapTestConn(ln.dial(&vsock.Addr{ContextID: 3, Port: 1024}))
+				}
+				if err := tc.send(req); err != nil {
+					errs <- err
+					return
+				}
+				if _, _, _, err := tc.receive(); err != nil {
+					errs <- err
+					return
+				}
+				if !keepAlive {
+					_ = tc.Close()
+					tc = nil
+				}
+			}
+			if tc != nil {
+				_ = tc.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	close(errs)
+	for err := range errs {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkFileResponse sends a file through FileBody (sendfile on a tcp
+// conn), through the buffered chunk copy, and read into memory first.
+func BenchmarkFileResponse(b *testing.B) {
+	const size = 60 << 10
+
+	name := filepath.Join(b.TempDir(), "body")
+	content := make([]byte, size)
+	_, _ = patternReader{}.Read(content)
+	if err := os.WriteFile(name, content, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	srv := newTestServer()
+	srv.HandleStream("sendfile", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return FileBody(f)
+	}, nil)
+	srv.HandleStream("copy", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		// 包一层, 关闭快速路径
+		return struct {
+			io.Reader
+			io.Closer
+		}{f, f}, size, nil
+	}, nil)
+	srv.HandleFunc("readfile", func(req []byte) ([]byte, error) {
+		return os.ReadFile(name)
+	})
+	tc := dialTestConn(b, startTestServer(b, srv))
+
+	for _, path := range []string{"sendfile", "copy", "readfile"} {
+		b.Run(path, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := tc.send(&protocols.Request{Path: path}); err != nil {
+					b.Fatal(err)
+				}
+				_, rsp, _, err := tc.receive()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !bytes.Equal(rsp.Rsp, content) {
+					b.Fatal("unexpected body")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkResponseSizeHint compares a large response path registered with
+// and without ResponseSizeHint, see allocs and B/op.
+func BenchmarkResponseSizeHint(b *testing.B) {
+	const size = 48 << 10
+
+	srv := newTestServer()
+	rsp := make([]byte, size)
+	handler := func(ctx context.Context, req []byte) ([]byte, error) {
+		return rsp, nil
+	}
+	srv.HandleConfig("nohint", handler, nil)
+	srv.HandleConfig("hint", handler, &HandlerConfig{ResponseSizeHint: size + 16})
+	tc := dialTestConn(b, startTestServer(b, srv))
+
+	for _, path := range []string{"nohint", "hint"} {
+		b.Run(path, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := tc.send(&protocols.Request{Path: path}); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, _, err := tc.receive(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBimodalBodies sends mostly tiny requests and every 20th a large
+// one over parallel conns, with the tiered body pools and with a single pool
+// as baseline. With 4KB buffers every large request allocates (B/op), with
+// 64KB ones every tiny request holds a 64KB buffer (pooled-B, the capacity
+// of the buffers handed out per request).
+func BenchmarkBimodalBodies(b *testing.B) {
+	tiers := map[string][]int{
+		"Tiered":     bodyTiers,
+		"Single4KB":  {4 << 10},
+		"Single64KB": {64 << 10},
+	}
+	for _, name := range []string{"Single4KB", "Single64KB", "Tiered"} {
+		b.Run(name, func(b *testing.B) {
+			saved, savedPools := bodyTiers, bodyPools
+			bodyTiers, bodyPools = tiers[name], make([]sync.Pool, len(tiers[name]))
+			defer func() { bodyTiers, bodyPools = saved, savedPools }()
+
+			srv := newTestServer()
+			srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+				return nil, nil
+			})
+			ln := startMemServer(b, srv)
+			small := &protocols.Request{Path: "echo", Req: make([]byte, 64)}
+			large := &protocols.Request{Path: "echo", Req: make([]byte, 48<<10)}
+
+			var pooled int64
+			for i := 0; i < 20; i++ {
+				size := len(small.Req) + 16
+				if i == 0 {
+					size = len(large.Req) + 16
+				}
+				if tier := tierOf(bodyTiers, size); size <= bodyTiers[tier] {
+					pooled += int64(bodyTiers[tier])
+				}
+			}
+
+			b.ReportAllocs()
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				tc := wrapTestConn(ln.dial(&vsock.Addr{ContextID: 3, Port: 1024}))
+				defer tc.Close()
+				for i := 0; pb.Next(); i++ {
+					req := small
+					if i%20 == 0 {
+						req = large
+					}
+					if err := tc.send(req); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, _, _, err := tc.receive(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(pooled)/20, "pooled-B")
+		})
+	}
+}
+
+// BenchmarkHandlerWorkers runs a CPU bound handler from 64 conns, each on its
+// serve goroutine and on a GOMAXPROCS sized worker pool.
+func BenchmarkHandlerWorkers(b *testing.B) {
+	const conns = 64
+
+	for _, workers := range []int{0, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprintf("Workers=%d", workers), func(b *testing.B) {
+			srv := newTestServerWith(func(srv *Server) {
+				srv.HandlerWorkers = workers
+				srv.HandlerQueue = conns
+			})
+			srv.HandleFunc("hash", func(req []byte) ([]byte, error) {
+				sum := sha256.Sum256(req)
+				for i := 0; i < 200; i++ {
+					sum = sha256.Sum256(sum[:])
+				}
+				return sum[:], nil
+			})
+			ln := startMemServer(b, srv)
+			req := &protocols.Request{Path: "hash", Req: []byte("payload")}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			var (
+				wg       sync.WaitGroup
+				requests = int64(b.N)
+			)
+			errs := make(chan error, conns)
+			wg.Add(conns)
+			for i := 0; i < conns; i++ {
+				go func() {
+					defer wg.Done()
+					tc := wrapTestConn(ln.dial(&vsock.Addr{ContextID: 3, Port: 1024}))
+					defer tc.Close()
+					for atomic.AddInt64(&requests, -1) >= 0 {
+						if err := tc.send(req); err != nil {
+							errs <- err
+							return
+						}
+						if header, _, _, err := tc.receive(); err != nil || header.Code != 0 {
+							errs <- fmt.Errorf("%+v, %v", header, err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			close(errs)
+			for err := range errs {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkPipelineWrites answers pipelines of 32 requests, each on a new
+// conn, and reports the socket writes per pipeline; ns/op is the latency of
+// a whole pipeline, dial included.
+func BenchmarkPipelineWrites(b *testing.B) {
+	cases := []struct {
+		name      string
+		configure func(srv *Server)
+	}{
+		{"NoCoalescing", nil},
+		{"Coalescing", func(srv *Server) { srv.WriteCoalescing = true }},
+		{"CoalescingMax8KB", func(srv *Server) {
+			srv.WriteCoalescing = true
+			srv.WriteBufferSize = 64 << 10
+			srv.CoalesceMaxBytes = 8 << 10
+		}},
+	}
+	for _, cs := range cases {
+		b.Run(cs.name, func(b *testing.B) {
+			addr, closed := startPipelineServer(b, cs.configure)
+			writes := int64(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writes += pipelineWrites(b, addr, closed, 32)
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/socket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// readRequest reads the next request frame, reassembling a chunked body. It
+// returns like socket.ReadSocket; the chunks of an oversized request, and a
+// frame above Server.MaxFrameSize from a client ignoring the settings, are
+// read and dropped, it then fails with StatusRequestTooLarge, the conn stays
+// usable. When the chunks don't arrive within chunkTimeout it fails with
+// StatusChunkTimeout and broken set.
+func (c *Conn) readRequest(ctx context.Context) (*models.Header, []byte, bool, error) {
+	header, body, broken, err := socket.ReadSocketBuf(ctx, c.bufReader, getBody)
+	if err != nil {
+		return header, body, broken, err
+	}
+	maxFrame := c.server.maxFrameSize()
+	if !header.MoreChunks() {
+		if len(body) > maxFrame {
+			putBody(body)
+			return header, nil, false, errors.StatusRequestTooLarge
+		}
+		return header, body, false, nil
+	}
+
+	// 剩余分片必须在超时内到齐, 否则视为丢失最后一片
+	_ = c.rwc.SetReadDeadline(time.Now().Add(c.server.chunkTimeout()))
+
+	maxBytes := c.server.maxRequestBytes()
+	// 第一片就带着path, 按path的上限提早拒绝
+	if limit := c.server.pathMaxRequestBytes(body); limit > 0 && limit < maxBytes {
+		maxBytes = limit
+	}
+	tooLarge := len(body) > maxBytes || len(body) > maxFrame
+	for header.MoreChunks() {
+		chunkHeader, chunk, _, err := socket.ReadSocketBuf(ctx, c.bufReader, getBody)
+		if err != nil {
+			putBody(body)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, nil, true, errors.StatusChunkTimeout
+			}
+			return nil, nil, true, err
+		}
+		// 分片之间不允许插入其他帧
+		if chunkHeader.Code&^constant.FlagMoreChunks != header.Code&^constant.FlagMoreChunks {
+			putBody(body)
+			putBody(chunk)
+			return nil, nil, true, errors.ErrChunkIncomplete
+		}
+		header.Code = chunkHeader.Code
+		if tooLarge || len(chunk) > maxFrame || len(body)+len(chunk) > maxBytes {
+			tooLarge = true
+			putBody(chunk)
+			putBody(body)
+			body = nil
+			continue
+		}
+		body = append(body, chunk...)
+		putBody(chunk)
+	}
+	if tooLarge {
+		return header, nil, false, errors.StatusRequestTooLarge
+	}
+	return header, body, false, nil
+}
+
+func (srv *Server) chunkTimeout() time.Duration {
+	if srv.ChunkAssemblyTimeout > 0 {
+		return srv.ChunkAssemblyTimeout
+	}
+	if timeout := srv.readTimeout(); timeout != 0 {
+		return timeout
+	}
+	return constant.DefaultChunkTimeout
+}
+
+// pathMaxRequestBytes is HandlerConfig.MaxRequestBytes of the path body is
+// for, 0 if none. body may be the first chunk only: Path is field 1, marshaled
+// first.
+func (srv *Server) pathMaxRequestBytes(body []byte) int {
+	num, typ, n := protowire.ConsumeTag(body)
+	if n < 0 || num != 1 || typ != protowire.BytesType {
+		return 0
+	}
+	path, m := protowire.ConsumeBytes(body[n:])
+	if m < 0 {
+		return 0
+	}
+	if handler := srv.getHandler(string(path)); handler != nil {
+		return handler.config.MaxRequestBytes
+	}
+	return 0
+}
+
+func (srv *Server) maxRequestBytes() int {
+	if srv.MaxRequestBytes > 0 {
+		return srv.MaxRequestBytes
+	}
+	return constant.DefaultMaxRequestBytes
+}
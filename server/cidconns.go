@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/socket"
+	"github.com/mdlayher/vsock"
+)
+
+// cidConns counts the alive conns of each source CID for MaxConnectionsPerCID.
+type cidConns struct {
+	mutex  sync.Mutex
+	counts map[uint32]int
+}
+
+// acquire counts a conn of cid, false if cid already has max conns.
+func (cc *cidConns) acquire(cid uint32, max int) bool {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.counts == nil {
+		cc.counts = make(map[uint32]int)
+	}
+	if cc.counts[cid] >= max {
+		return false
+	}
+	cc.counts[cid]++
+	return true
+}
+
+func (cc *cidConns) release(cid uint32) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.counts[cid] <= 1 {
+		delete(cc.counts, cid) // 不保留已断开的CID
+		return
+	}
+	cc.counts[cid]--
+}
+
+// acquireCID applies MaxConnectionsPerCID to an accepted conn, conns not
+// over vsock are not limited.
+func (srv *Server) acquireCID(c *Conn) bool {
+	if srv.MaxConnectionsPerCID <= 0 {
+		return true
+	}
+	addr, ok := c.rwc.RemoteAddr().(*vsock.Addr)
+	if !ok {
+		return true
+	}
+	if !srv.cidConns.acquire(addr.ContextID, srv.MaxConnectionsPerCID) {
+		return false
+	}
+	c.cid, c.cidSlot = addr.ContextID, true
+	return true
+}
+
+// reject answers a refused conn with status and closes it, the write is
+// bounded so a peer that doesn't read can't hold it.
+func (srv *Server) reject(rwc net.Conn, status *errors.Status) {
+	defer rwc.Close()
+	_ = rwc.SetWriteDeadline(time.Now().Add(constant.RejectWriteTimeout))
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    status.Code(),
+	}
+	_, _ = socket.WriteSocket(context.Background(), bufio.NewWriter(rwc), header, status.Encode())
+}
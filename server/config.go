@@ -0,0 +1,91 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the settings that can be swapped while serving, see UpdateConfig.
+//
+// Taking effect:
+//   - ReadTimeout, WriteTimeout, IdleTimeout: from the next loop iteration of
+//     every conn, i.e. the next request; a request already being read, handled
+//     or written keeps the deadline set before the swap.
+//   - DisableKeepAlives: immediately, checked after every response.
+//   - MaxConnections: at the next accept, conns above a lowered limit are not closed.
+//   - SlowRequestThreshold: from the next response written.
+type Config struct {
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	MaxConnections       int // 0 means unlimited
+	DisableKeepAlives    bool
+	SlowRequestThreshold time.Duration
+}
+
+// UpdateConfig replaces the runtime settings, the corresponding Server fields
+// are only the initial values once it was called.
+func (srv *Server) UpdateConfig(cfg Config) {
+	disable := int32(0)
+	if cfg.DisableKeepAlives {
+		disable = 1
+	}
+	atomic.StoreInt32(&srv.DisableKeepAlives, disable)
+	srv.config.Store(&cfg)
+}
+
+// CurrentConfig returns the settings the serve loops are using.
+func (srv *Server) CurrentConfig() Config {
+	if cfg, ok := srv.config.Load().(*Config); ok {
+		current := *cfg
+		current.DisableKeepAlives = !srv.doKeepAlives()
+		return current
+	}
+	return Config{
+		ReadTimeout:          srv.ReadTimeout,
+		WriteTimeout:         srv.WriteTimeout,
+		IdleTimeout:          srv.IdleTimeout,
+		MaxConnections:       srv.MaxConnections,
+		DisableKeepAlives:    !srv.doKeepAlives(),
+		SlowRequestThreshold: srv.SlowRequestThreshold,
+	}
+}
+
+func (srv *Server) readTimeout() time.Duration {
+	if cfg, ok := srv.config.Load().(*Config); ok {
+		return cfg.ReadTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) writeTimeout() time.Duration {
+	if cfg, ok := srv.config.Load().(*Config); ok {
+		return cfg.WriteTimeout
+	}
+	return srv.WriteTimeout
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	idle := srv.IdleTimeout
+	if cfg, ok := srv.config.Load().(*Config); ok {
+		idle = cfg.IdleTimeout
+	}
+	if idle != 0 {
+		return idle
+	}
+	return srv.readTimeout()
+}
+
+func (srv *Server) maxConnections() int {
+	if cfg, ok := srv.config.Load().(*Config); ok {
+		return cfg.MaxConnections
+	}
+	return srv.MaxConnections
+}
+
+func (srv *Server) slowRequestThreshold() time.Duration {
+	if cfg, ok := srv.config.Load().(*Config); ok {
+		return cfg.SlowRequestThreshold
+	}
+	return srv.SlowRequestThreshold
+}
@@ -7,84 +7,451 @@ import (
 	"github.com/brodyxchen/vsock-sdk/constant"
 	"github.com/brodyxchen/vsock-sdk/errors"
 	"github.com/brodyxchen/vsock-sdk/log"
+	"github.com/brodyxchen/vsock-sdk/metadata"
 	"github.com/brodyxchen/vsock-sdk/models"
 	"github.com/brodyxchen/vsock-sdk/protocols"
 	"github.com/brodyxchen/vsock-sdk/socket"
 	"google.golang.org/protobuf/proto"
+	"math"
 	"net"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Conn is one accepted connection. Every frame goes out through the write
+// path (write/responseStream) under writeMutex, so responses finished
+// concurrently never interleave; handlers must not write to the conn directly.
 type Conn struct {
 	Name       int64
 	server     *Server
 	remoteAddr string
 
 	rwc       net.Conn
-	bufReader *bufio.Reader
+	bufReader *bufio.Reader // serve goroutine only
 	bufWriter *bufio.Writer
+
+	tls bool // handshake done, counted in server.tlsConns
+
+	versions []uint16 // accepted Header.Version, empty accepts any
+
+	parent context.Context // ServeContext ctx, cancels the handler contexts when done
+
+	cid     uint32 // source CID counted in server.cidConns when cidSlot
+	cidSlot bool
+
+	pipelined int32 // atomic visit, next request already buffered when the last one was read
+
+	maxFrame int32 // atomic visit, agreed by ActionSettings, 0 if none, see MaxFrameSize
+
+	streamWindow int32 // atomic visit, flow control window of stream responses agreed by ActionSettings, 0 if none
+
+	rspBytes int64 // body size of the last response, atomic: responseSuccess may run off the serve goroutine
+
+	idleMutex sync.Mutex // 守护idle, 与Shutdown的唤醒互斥
+	idle      bool
+
+	goAwayAt int64 // atomic visit, unix nano of Server.GoAway, 0 if not sent
+
+	subsMutex sync.Mutex // 守护subs
+	subs      map[uint64]*subscription
+	subIndex  int64 // atomic visit
+
+	writeMutex   sync.Mutex // 守护bufWriter及以下3个变量
+	flushTimer   *time.Timer
+	flushPending bool
+	closed       bool
+
+	closeOnce sync.Once
+	done      chan struct{} // closed by Close
+
+	writeQueue     chan queuedFrame // see Server.WriteQueue
+	writeQueueOnce sync.Once
+
+	openAt   time.Time
+	requests int64 // atomic visit
+	bytesIn  int64 // atomic visit
+	bytesOut int64 // atomic visit
+	writes   int64 // atomic visit
+
+	pendingWrite int64 // atomic visit, bytes buffered or in a socket write, see ConnStats.PendingWrite
+
+	statsMutex sync.Mutex // 守护以下2个变量
+	closeAt    time.Time
+	closeErr   error
 }
 
 func (c *Conn) Read(p []byte) (n int, err error) {
-	return c.rwc.Read(p)
+	n, err = c.rwc.Read(p)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	return n, err
 }
 
+// Write is the raw sink of bufWriter, use the frame write path instead.
 func (c *Conn) Write(p []byte) (n int, err error) {
-	return c.rwc.Write(p)
+	atomic.StoreInt64(&c.pendingWrite, int64(len(p)))
+	n, err = c.rwc.Write(p)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	atomic.AddInt64(&c.writes, 1)
+	// bufWriter要么已清空, 要么出错后连接会关闭
+	atomic.StoreInt64(&c.pendingWrite, int64(len(p)-n))
+	return n, err
 }
 
-func (c *Conn) handleServe(ctx context.Context, body []byte) ([]byte, error) {
-	wrap := func(bytes []byte, err error) []byte {
-		var rsp *protocols.Response
-		if err != nil {
-			rsp = &protocols.Response{
-				Code: protocols.StatusErr,
-				Rsp:  nil,
-				Err:  err.Error(),
-			}
-		} else {
-			rsp = &protocols.Response{
-				Code: protocols.StatusOK,
-				Rsp:  bytes,
-				Err:  "",
-			}
+// reply is what handleServe produced for one request.
+type reply struct {
+	path   string
+	body   []byte      // marshaled protocols.Response
+	code   uint16      // protocols.Response.Code of body or stream
+	stream *streamBody // set instead of body by a stream handler
+
+	progress *streamProgress // of the stream, listed by InFlight
+
+	releases []func() // run by finish once the response is written
+
+	timing *requestTiming // asked for with metadata.WantTimingKey
+
+	pathWriteTimeout time.Duration // HandlerConfig.WriteTimeout
+	writeTimeout     int64         // atomic visit, nanoseconds, set by SetWriteTimeout or metadata.WriteTimeoutKey
+
+	ctx        context.Context // handler context, its values are kept for the background work
+	abandoned  bool            // the conn closed and ctx was cancelled before the handler returned, nobody reads the response
+	afterMutex sync.Mutex
+	after      []BackgroundFunc // RunAfterResponse, started once the response is written
+}
+
+func (rp *reply) onFinish(fn func()) {
+	rp.releases = append(rp.releases, fn)
+}
+
+func (rp *reply) finish() {
+	for i := len(rp.releases) - 1; i >= 0; i-- {
+		rp.releases[i]()
+	}
+	rp.releases = nil
+}
+
+// context is the handler context, or fallback if the request never reached a handler.
+func (rp *reply) context(fallback context.Context) context.Context {
+	if rp.ctx != nil {
+		return rp.ctx
+	}
+	return fallback
+}
+
+// canceled reports if the handler context was cancelled, not timed out.
+func (rp *reply) canceled() bool {
+	return rp.ctx != nil && errors.Is(rp.ctx.Err(), context.Canceled)
+}
+
+func (rp *reply) takeAfter() []BackgroundFunc {
+	rp.afterMutex.Lock()
+	defer rp.afterMutex.Unlock()
+	after := rp.after
+	rp.after = nil
+	return after
+}
+
+func wrapResponse(bytes []byte, err error) []byte {
+	return appendResponse(nil, bytes, err)
+}
+
+// appendResponse marshals the protocols.Response of bytes/err appended to buf.
+func appendResponse(buf []byte, bytes []byte, err error) []byte {
+	var rsp *protocols.Response
+	var appErr *errors.AppError
+	if errors.As(err, &appErr) {
+		rsp = &protocols.Response{
+			Code: appErrorCode(appErr),
+			Rsp:  appErr.Body,
+			Err:  appErr.Message,
 		}
-		rspBytes, err := proto.Marshal(rsp)
-		if err != nil {
+	} else if err != nil {
+		rsp = &protocols.Response{
+			Code: protocols.StatusErr,
+			Rsp:  nil,
+			Err:  err.Error(),
+		}
+	} else {
+		rsp = &protocols.Response{
+			Code: protocols.StatusOK,
+			Rsp:  bytes,
+			Err:  "",
+		}
+	}
+	rspBytes, err := proto.MarshalOptions{}.MarshalAppend(buf, rsp)
+	if err != nil {
+		panic(err)
+	}
+	return rspBytes
+}
+
+func appErrorCode(appErr *errors.AppError) int32 {
+	if appErr.Code == 0 || appErr.Code == protocols.StatusOK {
+		return protocols.StatusErr
+	}
+	return appErr.Code
+}
+
+// responseCode is the protocols.Response.Code the handler result err gets.
+func responseCode(err error) uint16 {
+	var appErr *errors.AppError
+	if errors.As(err, &appErr) {
+		return uint16(appErrorCode(appErr))
+	}
+	if err != nil {
+		return uint16(protocols.StatusErr)
+	}
+	return uint16(protocols.StatusOK)
+}
+
+// handleServe dispatches one request, the caller must finish the reply after writing it.
+func (c *Conn) handleServe(ctx context.Context, header *models.Header, body []byte) (rp *reply, status error) {
+	rp = &reply{code: uint16(protocols.StatusOK)}
+	start := time.Now()
+	defer func() {
+		rp.abandoned = rp.canceled() && c.isClosed() // finish也会取消ctx, 先记下
+		if status != nil {
+			rp.finish()
+		} else if err := recover(); err != nil {
+			// handler panic了也要释放并发名额和InFlight, 500由serve回复
+			rp.finish()
 			panic(err)
 		}
-		return rspBytes
+	}()
+
+	c.server.reqSizeHist.Observe(int64(len(body)))
+	if signer := c.server.Signer; signer != nil {
+		var ok bool
+		if body, ok = signer.Open(body); !ok {
+			return rp, errors.StatusSignatureInvalid
+		}
+	}
+
+	if limit := c.server.pathMaxRequestBytes(body); limit > 0 && len(body) > limit {
+		return rp, errors.StatusRequestTooLarge
 	}
 
 	var request protocols.Request
 	err := proto.Unmarshal(body, &request)
 	if err != nil {
-		return nil, errors.StatusInvalidRequest
+		log.Warnf("conn[%v] %v: unmarshal request(path=%q, %v bytes) err: %v\n", c.Name, c.remoteAddr, c.server.loggedPath(request.Path), len(body), err)
+		if c.server.Verbose {
+			return rp, errors.NewStatus(errors.StatusInvalidRequest.Code(), errors.StatusInvalidRequest.Error()+": "+sanitizeReason(err))
+		}
+		return rp, errors.StatusInvalidRequest
 	}
+	if len(request.Path) > c.server.maxPathLength() {
+		return rp, errors.StatusInvalidPath
+	}
+	rp.path = request.Path
 
 	handler := c.server.getHandler(request.Path)
+	if status := c.server.maintenanceStatus(); status != nil && (handler == nil || !handler.health) {
+		c.server.maintenanceHist.Inc(1)
+		return rp, status
+	}
 	if handler == nil {
-		return nil, errors.StatusInvalidPath
+		return rp, errors.StatusInvalidPath
+	}
+
+	if len(request.Meta) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, request.Meta)
+		if request.Meta[metadata.WantTimingKey] != "" {
+			rp.timing = &requestTiming{last: start}
+		}
+		if ms, err := strconv.ParseInt(request.Meta[metadata.WriteTimeoutKey], 10, 64); err == nil && ms > 0 {
+			rp.setWriteTimeout(time.Duration(ms) * time.Millisecond)
+		}
+	}
+	rp.pathWriteTimeout = handler.config.WriteTimeout
+	ctx = context.WithValue(ctx, headerKey{}, *header)
+
+	ctx, cancel := c.handlerContext(ctx, request.Timeout)
+	rp.onFinish(cancel)
+	ctx = context.WithValue(ctx, afterResponseKey{}, rp)
+	rp.ctx = ctx
+	if ctx.Err() != nil {
+		return rp, errors.StatusDeadlineExceeded
+	}
+
+	if handler.streamFn != nil {
+		rp.progress = &streamProgress{}
+	}
+	untrack := c.server.inflight.track(c, RequestInfo{
+		ID:         requestID(ctx),
+		Path:       request.Path,
+		RemoteAddr: c.remoteAddr,
+		ConnName:   c.Name,
+		Start:      time.Now(),
+	}, cancel, rp.progress)
+	rp.onFinish(untrack)
+
+	run := func() error {
+		return c.dispatch(ctx, handler, rp, request.Req)
+	}
+	if group := handler.flight; group != nil {
+		if key := group.key(ctx, request.Req); key != "" {
+			dispatch := run
+			run = func() error {
+				return group.do(ctx, key, rp, dispatch)
+			}
+		}
+	}
+	if cache := handler.dedup; cache != nil {
+		if key := request.Meta[metadata.IdempotencyKey]; key != "" {
+			return rp, cache.do(ctx, key, rp, run)
+		}
+	}
+	return rp, run()
+}
+
+// invoke runs the handler, filling rp.body or rp.stream.
+func (c *Conn) invoke(ctx context.Context, handler *handlerEntry, rp *reply, req []byte) error {
+	if limiter := handler.limiter; limiter != nil {
+		priority := metadata.PriorityNormal
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			priority = metadata.ParsePriority(md[metadata.PriorityKey])
+		}
+		if !limiter.acquire(ctx, handler.config.QueueTimeout, priority) {
+			if ctx.Err() != nil {
+				return errors.StatusDeadlineExceeded
+			}
+			return c.server.busy()
+		}
+		rp.onFinish(limiter.release)
+	}
+	// 排队(worker或并发限制)期间已超时的请求没人在等, 不再执行handler
+	if ctx.Err() != nil {
+		return errors.StatusDeadlineExceeded
+	}
+	rp.timing.lap(timingQueue)
+
+	if handler.subscribeFn != nil {
+		c.subscribe(ctx, handler, rp, req)
+		return nil
+	}
+	if handler.streamFn != nil {
+		reader, length, err := handler.streamFn(ctx, req)
+		rp.timing.lap(timingHandler)
+		if err == nil {
+			rp.stream = &streamBody{reader: reader, length: length, progress: rp.progress}
+			return nil
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errors.StatusDeadlineExceeded
+		}
+		rp.body, rp.code = wrapResponse(nil, err), responseCode(err)
+		return nil
+	}
+
+	rspBytes, err := handler.fn(ctx, req)
+	rp.timing.lap(timingHandler)
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		return errors.StatusDeadlineExceeded
 	}
+	if rspBytes == nil && err == nil && c.server.StrictEmptyResponse {
+		return errors.StatusEmptyResponse
+	}
+
+	if pool := handler.rspBuffers; pool != nil {
+		buf := pool.Get().(*[]byte)
+		rp.body = appendResponse((*buf)[:0], rspBytes, err)
+		rp.onFinish(func() {
+			*buf = rp.body[:0] // 超出hint时留下扩容后的
+			pool.Put(buf)
+		})
+	} else {
+		rp.body = wrapResponse(rspBytes, err)
+	}
+	rp.code = responseCode(err)
+	rp.timing.lap(timingSerialize)
+
+	return nil
+}
+
+// sanitizeReason keeps an internal error short and single line before it is sent to a client.
+func sanitizeReason(err error) string {
+	const maxLen = 128
+	reason := strings.Join(strings.Fields(err.Error()), " ")
+	if len(reason) > maxLen {
+		reason = reason[:maxLen] + "..."
+	}
+	return reason
+}
 
-	rsp := wrap(handler(request.Req))
+func (srv *Server) maxPathLength() int {
+	if srv.MaxPathLength > 0 {
+		return srv.MaxPathLength
+	}
+	return constant.DefaultMaxPathLength
+}
+
+// loggedPath cuts a path beyond MaxPathLength before it is logged.
+func (srv *Server) loggedPath(path string) string {
+	if max := srv.maxPathLength(); len(path) > max {
+		return path[:max] + "..."
+	}
+	return path
+}
 
-	return rsp, nil
+// handlerContext derives the handler deadline from the client's remaining
+// timeout (ms) and the server's HandlerTimeout, the earlier one wins.
+func (c *Conn) handlerContext(ctx context.Context, clientTimeout int64) (context.Context, context.CancelFunc) {
+	var deadline time.Time
+	now := time.Now()
+	if clientTimeout > 0 {
+		deadline = now.Add(time.Duration(clientTimeout) * time.Millisecond)
+	}
+	if timeout := c.server.HandlerTimeout; timeout > 0 {
+		if serverDeadline := now.Add(timeout); deadline.IsZero() || serverDeadline.Before(deadline) {
+			deadline = serverDeadline
+		}
+	}
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	if c.parent != nil && c.parent.Done() != nil {
+		go func() {
+			select {
+			case <-c.parent.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
 }
 
 // Serve a new connection.
 func (c *Conn) serve(ctx context.Context) {
 	defer c.server.connsHist.Dec(1)
+	c.server.trackConn(c)
+	defer c.server.untrackConn(c)
+	if c.cidSlot {
+		defer c.server.cidConns.release(c.cid)
+	}
 
 	closeErr := errors.New("serve default close")
 	defer func() {
 		c.Close(closeErr)
+		// 缓冲只由serve自己归还, 外部Close时serve可能还在用
+		c.putBuffers()
 	}()
 
 	c.remoteAddr = c.rwc.RemoteAddr().String()
+	c.server.emit(Event{Kind: EventConnOpen, ConnName: c.Name, RemoteAddr: c.remoteAddr})
 
 	defer func() {
+		if c.server.DisablePanicRecovery {
+			return // 不调用recover, panic带原始堆栈继续向上
+		}
 		if err := recover(); err != nil {
 			const size = 64 << 10
 			buf := make([]byte, size)
@@ -94,7 +461,7 @@ func (c *Conn) serve(ctx context.Context) {
 			writeNow := time.Now()
 			panicErr := errors.NewStatus(500, fmt.Sprintf("panic serving : %v\n{%s}", err, string(buf)))
 			broken, err := c.responseStatus(ctx, panicErr)
-			c.server.writeHist.Update(time.Since(writeNow).Milliseconds())
+			c.server.writeHist.Observe(time.Since(writeNow).Milliseconds())
 			if err != nil && broken {
 				closeErr = err
 				return
@@ -102,53 +469,168 @@ func (c *Conn) serve(ctx context.Context) {
 		}
 	}()
 
-	c.bufReader = getBufReader(c)
-	c.bufWriter = getBufWriter(c)
+	c.bufReader = getBufReader(c, c.server.ReadBufferSize)
+	c.writeMutex.Lock() // GoAway可能已经在写
+	c.bufWriter = getBufWriter(c, c.server.WriteBufferSize)
+	c.writeMutex.Unlock()
+
+	ctx, err := c.handshake(ctx)
+	if err != nil {
+		closeErr = err
+		return
+	}
+	defer func() {
+		if c.tls {
+			atomic.AddInt64(&c.server.tlsConns, -1)
+		}
+	}()
+	if ctx, err = c.authenticate(ctx); err != nil {
+		closeErr = err
+		return
+	}
 
-	if c.server.ReadTimeout == 0 {
+	if c.server.readTimeout() == 0 {
 		_ = c.rwc.SetReadDeadline(time.Time{})
 	}
-	if c.server.WriteTimeout == 0 {
+	if c.server.writeTimeout() == 0 {
 		_ = c.rwc.SetWriteDeadline(time.Time{})
 	}
 
+	lastActive := time.Now()   // 最后一次收到请求, pong不算
+	lastHeard := lastActive    // 最后一次收到任何数据, pong也算, ping从这里开始计时
+	first := true              // 还没收到过任何数据
 	waitNext := func() error { // 阻塞等待 下一份数据
+		var pingAt time.Time // 已发出ping, 等待pong
 		for {
-			wait := c.server.idleTimeout()
+			var deadline time.Time
+			if timeout := c.server.FirstByteTimeout; first && timeout > 0 {
+				deadline = c.openAt.Add(timeout)
+			} else if wait := c.server.idleTimeout(); wait != 0 && !c.subscribed() {
+				deadline = lastActive.Add(wait)
+			}
+			if end := c.goAwayDeadline(); !end.IsZero() && (deadline.IsZero() || end.Before(deadline)) {
+				deadline = end
+			}
 
-			if wait != 0 {
-				_ = c.rwc.SetReadDeadline(time.Now().Add(wait))
-			} else {
-				_ = c.rwc.SetReadDeadline(time.Time{})
+			// 空闲超过PingInterval时探测对端, PingTimeout内没有任何数据则认为对端已死
+			var probeAt time.Time
+			if interval := c.server.PingInterval; interval > 0 {
+				if pingAt.IsZero() {
+					probeAt = lastHeard.Add(interval)
+				} else {
+					probeAt = pingAt.Add(c.server.pingTimeout())
+				}
+				if !deadline.IsZero() && !probeAt.Before(deadline) {
+					probeAt = time.Time{}
+				} else {
+					deadline = probeAt
+				}
 			}
 
-			_, err := c.bufReader.Peek(2) //models.HeaderSize
+			_ = c.rwc.SetReadDeadline(deadline)
+
+			// 已缓存的流水线请求关闭中也要答完
+			if c.bufReader.Buffered() == 0 && !c.setIdle(true) {
+				return errors.ErrServerClosed
+			}
+			// GoAway可能在计算deadline之后才发出
+			if end := c.goAwayDeadline(); !end.IsZero() && (deadline.IsZero() || end.Before(deadline)) {
+				deadline = end
+				_ = c.rwc.SetReadDeadline(deadline)
+			}
+			_, err := c.bufReader.Peek(1) // 第一个字节到达即开始计算HeaderReadTimeout
+			c.setIdle(false)
 			if err != nil {
-				return errors.Wrap(errors.ErrPeekWritingErr, err) // io.EOF 代表对面关闭了???  or i/o timeout
+				if c.server.shuttingDown() {
+					return errors.ErrServerClosed
+				}
+				if end := c.goAwayEnd(); !end.IsZero() && !time.Now().Before(end) {
+					return errors.ErrGoAway
+				}
+				ne, ok := err.(net.Error)
+				if !ok || !ne.Timeout() {
+					// 对端关闭(io.EOF)或连接出错, 不能再读
+					return errors.Wrap(errors.ErrPeekWritingErr, err)
+				}
+				if first && probeAt.IsZero() && c.server.FirstByteTimeout > 0 {
+					return errors.Wrap(errors.ErrFirstByteTimeout, err)
+				}
+				if !probeAt.IsZero() {
+					if !pingAt.IsZero() {
+						return errors.ErrPingTimeout
+					}
+					if err := c.ping(ctx); err != nil {
+						return err
+					}
+					pingAt = time.Now()
+					continue
+				}
+				if wait := c.server.idleTimeout(); wait != 0 && !c.subscribed() && !time.Now().Before(lastActive.Add(wait)) {
+					return errors.Wrap(errors.ErrIdleTimeout, err)
+				}
+				// deadline已经变了(UpdateConfig调大IdleTimeout, 新的订阅), 重新计算
+				continue
 			}
 
 			_ = c.rwc.SetReadDeadline(time.Time{})
+			first = false
+			lastHeard = time.Now()
 			return nil
 		}
 
 	}
 
 	for {
+		// 没有已缓存的请求, 阻塞读之前把合并中的响应发出去
+		if c.bufReader.Buffered() == 0 {
+			if err := c.flush(); err != nil {
+				closeErr = err
+				return
+			}
+		}
+
 		if err := waitNext(); err != nil {
 			closeErr = err
 			return
 		}
 
+		// 头部需要在HeaderReadTimeout内读完, 防止慢速客户端占住连接
+		if timeout := c.server.HeaderReadTimeout; timeout > 0 && c.bufReader.Buffered() < models.HeaderSize {
+			_ = c.rwc.SetReadDeadline(time.Now().Add(timeout))
+			if _, err := c.bufReader.Peek(models.HeaderSize); err != nil {
+				closeErr = errors.Wrap(errors.ErrHeaderReadTimeout, err)
+				return
+			}
+		}
+
 		// 设置底层conn read超时
 		now := time.Now()
-		if c.server.ReadTimeout != 0 {
-			_ = c.rwc.SetReadDeadline(now.Add(c.server.ReadTimeout))
+		if timeout := c.server.readTimeout(); timeout != 0 {
+			_ = c.rwc.SetReadDeadline(now.Add(timeout))
 		}
 
 		readNow := time.Now()
-		header, body, broken, err := socket.ReadSocket(ctx, c.bufReader)
-		c.server.readHist.Update(time.Since(readNow).Milliseconds())
-
+		header, body, broken, err := c.readRequest(ctx)
+		readCost := time.Since(readNow)
+		c.server.readHist.Observe(readCost.Milliseconds())
+		c.setPipelined(c.bufReader.Buffered() > 0)
+
+		if status, ok := err.(*errors.Status); ok {
+			if timeout := c.server.writeTimeout(); timeout != 0 {
+				_ = c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+			}
+			if broken, err := c.responseStatus(ctx, status); err != nil && broken {
+				closeErr = err
+				return
+			}
+			if broken {
+				// 分片没到齐, 后续数据无法可靠解析
+				_ = c.flush()
+				closeErr = errors.Wrap(errors.ErrChunkIncomplete, status)
+				return
+			}
+			continue
+		}
 		if err != nil {
 			if broken {
 				closeErr = err
@@ -157,42 +639,213 @@ func (c *Conn) serve(ctx context.Context) {
 			continue
 		}
 
+		if !c.acceptsVersion(header.Version) {
+			if timeout := c.server.writeTimeout(); timeout != 0 {
+				_ = c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+			}
+			status := errors.NewStatus(errors.StatusUnsupportedVersion.Code(),
+				fmt.Sprintf("%v %v, accepted %v", errors.StatusUnsupportedVersion.Error(), header.Version, c.versions))
+			_, err := c.responseStatus(ctx, status)
+			if err == nil {
+				err = c.flush()
+			}
+			if err != nil {
+				closeErr = err
+				return
+			}
+			// 版本不同帧格式可能不同, 后续数据无法可靠解析
+			closeErr = fmt.Errorf("%w %v", errors.ErrUnsupportedVersion, header.Version)
+			return
+		}
+
 		// 设置底层conn write超时
-		if c.server.WriteTimeout != 0 {
-			_ = c.rwc.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+		if timeout := c.server.writeTimeout(); timeout != 0 {
+			_ = c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+		} else {
+			_ = c.rwc.SetWriteDeadline(time.Time{}) // UpdateConfig可能去掉了超时
+		}
+
+		switch header.Code {
+		case constant.ActionPing:
+			broken, err := c.responsePong(ctx)
+			if err != nil && broken {
+				closeErr = err
+				return
+			}
+			continue
+		case constant.ActionPong:
+			continue
+		case constant.ActionWindowUpdate:
+			putBody(body) // 流已写完才到的多余额度
+			continue
+		case constant.ActionSettings:
+			broken, err := c.responseSettings(ctx, body)
+			putBody(body)
+			if err != nil && broken {
+				closeErr = err
+				return
+			}
+			continue
+		}
+		lastActive = time.Now()
+
+		// goaway的grace已过, 拒绝后关闭
+		if end := c.goAwayEnd(); !end.IsZero() && !lastActive.Before(end) {
+			_, err := c.responseStatus(ctx, errors.StatusGoingAway)
+			if err == nil {
+				err = c.flush()
+			}
+			closeErr = errors.ErrGoAway
+			if err != nil {
+				closeErr = err
+			}
+			return
 		}
+		atomic.AddInt64(&c.requests, 1)
+
 		// handle
-		rspBytes, status := c.handleServe(ctx, body)
+		handleNow := time.Now()
+		reqBytes := len(body)
+		atomic.StoreInt64(&c.rspBytes, 0)
+		rp, status := c.handleServe(ctx, header, body)
+		putBody(body) // 已解码, Request的字段都是拷贝
+
+		// 连接已关闭, handler因此被取消: 没人在等响应, 不再写, 免得卡在死连接上
+		if rp.abandoned {
+			if status == nil {
+				if rp.stream != nil {
+					rp.stream.close() // responseStream不会再调用
+				}
+				rp.finish()
+			}
+			closeErr = errors.ErrRequestCanceled
+			return
+		}
 
 		writeNow := time.Now()
+		if timeout, ok := rp.responseWriteTimeout(); ok {
+			_ = c.rwc.SetWriteDeadline(writeNow.Add(timeout))
+			if rp.stream != nil {
+				rp.stream.writeTimeout = timeout
+			}
+		}
+		code := rp.code
 		if status != nil {
+			code = status.(*errors.Status).Code()
 			broken, err := c.responseStatus(ctx, status.(*errors.Status))
-			c.server.writeHist.Update(time.Since(writeNow).Milliseconds())
+			c.server.writeHist.Observe(time.Since(writeNow).Milliseconds())
 			if err != nil && broken {
 				closeErr = err
 				return
 			}
 		} else {
-			broken, err := c.responseSuccess(ctx, header, rspBytes)
-			c.server.writeHist.Update(time.Since(writeNow).Milliseconds())
+			var (
+				broken bool
+				err    error
+			)
+			// 流式响应中途失败时靠trailer告知, 客户端支持时总是带上
+			acceptsTrailer := header.Code&constant.FlagAcceptsTrailer != 0
+			header.Code = 0
+			if rp.timing != nil || (rp.stream != nil && acceptsTrailer) {
+				header.Code = constant.FlagTrailer
+			}
+			if rp.stream != nil {
+				rp.stream.timing = rp.timing != nil
+				broken, err = c.responseStream(ctx, header, rp.path, rp.stream)
+				if rp.stream.failed != nil {
+					code = responseCode(rp.stream.failed)
+				} else if rp.stream.rejected != nil {
+					code = responseCode(rp.stream.rejected)
+				}
+			} else {
+				broken, err = c.responseSuccess(ctx, header, rp.path, rp.body)
+			}
+			rp.finish()
+			writeCost := time.Since(writeNow)
+			c.server.writeHist.Observe(writeCost.Milliseconds())
+			if header.Code&constant.FlagTrailer != 0 && err == nil {
+				trailer := metadata.MD{}
+				if rp.timing != nil {
+					rp.timing.laps[timingRead] = readCost
+					rp.timing.laps[timingWrite] = writeCost
+					trailer = rp.timing.trailer()
+				}
+				if rp.stream != nil && rp.stream.failed != nil {
+					rp.stream.failureTrailer(trailer)
+				}
+				// 客户端在等trailer, 写失败只能断开
+				if _, err = c.responseTrailer(ctx, trailer); err != nil {
+					broken = true
+				}
+			}
+			c.server.runBackground(rp.ctx, rp.takeAfter())
 			if err != nil && broken {
 				closeErr = err
 				return
 			}
 		}
+		c.emitRequest(rp.path, code, status, handleNow)
+		c.logSlowRequest(rp.path, code, time.Since(readNow), reqBytes)
 
 		// keepAlive
-		if !c.server.doKeepAlives() {
+		if !c.server.keepAlive(rp.context(ctx), rp.path, code) {
 			closeErr = errors.ErrNoKeepAlive
 			return
 		}
+		// 关闭中: 已读入的流水线请求按顺序答完, 只是不再读新数据
+		if c.server.shuttingDown() && c.bufReader.Buffered() == 0 {
+			if err := c.flush(); err != nil {
+				closeErr = err
+				return
+			}
+			closeErr = errors.ErrServerClosed
+			return
+		}
+	}
+}
+
+func (c *Conn) acceptsVersion(version uint16) bool {
+	if len(c.versions) == 0 {
+		return true
+	}
+	for _, v := range c.versions {
+		if v == version {
+			return true
+		}
 	}
+	return false
 }
 
-func (c *Conn) responseSuccess(ctx context.Context, header *models.Header, rspBytes []byte) (bool, error) {
-	header.Code = 0
+func (c *Conn) responseSuccess(ctx context.Context, header *models.Header, path string, rspBytes []byte) (bool, error) {
+	if signer := c.server.Signer; signer != nil {
+		rspBytes = signer.Sign(rspBytes) // 拷贝, rspBytes可能被缓存共用
+	}
+	if len(rspBytes) > math.MaxUint16 {
+		log.Warnf("conn[%v] %v: response of path %q is %v bytes, exceeds the %v bytes frame length\n",
+			c.Name, c.remoteAddr, path, len(rspBytes), math.MaxUint16)
+	} else if max := c.MaxFrameSize(); len(rspBytes) > max {
+		// 客户端收不下, 改为返回错误
+		log.Warnf("conn[%v] %v: response of path %q is %v bytes, exceeds the %v bytes agreed max frame size\n",
+			c.Name, c.remoteAddr, path, len(rspBytes), max)
+		rspBytes = wrapResponse(nil, errors.ErrExceedBody)
+		if signer := c.server.Signer; signer != nil {
+			rspBytes = signer.Sign(rspBytes)
+		}
+	}
 	header.Length = uint16(len(rspBytes))
-	return socket.WriteSocket(ctx, c.bufWriter, header, rspBytes)
+	c.server.rspSizeHist.Observe(int64(len(rspBytes)))
+	atomic.StoreInt64(&c.rspBytes, int64(len(rspBytes)))
+	return c.write(ctx, header, rspBytes)
+}
+
+// responseTrailer writes the trailer frame of the response just written with FlagTrailer.
+func (c *Conn) responseTrailer(ctx context.Context, md metadata.MD) (bool, error) {
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    constant.ActionTrailer,
+	}
+	return c.write(ctx, header, metadata.Encode(md))
 }
 
 func (c *Conn) responseStatus(ctx context.Context, status *errors.Status) (bool, error) {
@@ -202,16 +855,164 @@ func (c *Conn) responseStatus(ctx context.Context, status *errors.Status) (bool,
 		Code:    status.Code(),
 		Length:  0,
 	}
-	body := []byte(status.Error())
+	body := status.Encode()
 	header.Length = uint16(len(body))
+	atomic.StoreInt64(&c.rspBytes, int64(len(body)))
+
+	return c.write(ctx, header, body)
+}
+
+func (c *Conn) responsePong(ctx context.Context) (bool, error) {
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    constant.ActionPong,
+	}
+	return c.write(ctx, header, nil)
+}
+
+// ping probes an idle client, the client answers with a pong frame.
+func (c *Conn) ping(ctx context.Context) error {
+	if timeout := c.server.writeTimeout(); timeout != 0 {
+		_ = c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    constant.ActionPing,
+	}
+	if _, err := c.write(ctx, header, nil); err != nil {
+		return errors.Wrap(errors.ErrWriteSocketErr, err)
+	}
+	return nil
+}
+
+// write sends one frame. With WriteCoalescing the flush is skipped while the
+// next pipelined request is already buffered, the frame then leaves together
+// with the following responses, or after FlushInterval or once
+// CoalesceMaxBytes are buffered at the latest.
+func (c *Conn) write(ctx context.Context, header *models.Header, body []byte) (bool, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if !c.server.WriteCoalescing || atomic.LoadInt32(&c.pipelined) == 0 {
+		c.stopFlushTimerLocked()
+		return socket.WriteSocket(ctx, c.bufWriter, header, body)
+	}
+
+	broken, err := socket.WriteFrame(ctx, c.bufWriter, header, body)
+	if err != nil {
+		return broken, err
+	}
+	if max := c.server.CoalesceMaxBytes; max > 0 && c.bufWriter.Buffered() >= max {
+		c.stopFlushTimerLocked()
+		if err := c.bufWriter.Flush(); err != nil {
+			return true, err
+		}
+	}
+	if c.bufWriter.Buffered() > 0 {
+		atomic.StoreInt64(&c.pendingWrite, int64(c.bufWriter.Buffered()))
+		c.startFlushTimerLocked()
+	}
+	return false, nil
+}
+
+func (c *Conn) setPipelined(pipelined bool) {
+	value := int32(0)
+	if pipelined {
+		value = 1
+	}
+	atomic.StoreInt32(&c.pipelined, value)
+}
+
+// flush sends out everything left in bufWriter.
+func (c *Conn) flush() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.stopFlushTimerLocked()
+	if c.bufWriter.Buffered() == 0 {
+		return nil
+	}
+	if err := c.bufWriter.Flush(); err != nil {
+		return errors.Wrap(errors.ErrWriteSocketErr, err)
+	}
+	return nil
+}
+
+func (c *Conn) startFlushTimerLocked() {
+	interval := c.server.FlushInterval
+	if interval <= 0 || c.flushPending {
+		return
+	}
+	c.flushPending = true
+	if c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(interval, c.flushWhenIdle)
+	} else {
+		c.flushTimer.Reset(interval)
+	}
+}
+
+func (c *Conn) stopFlushTimerLocked() {
+	if !c.flushPending {
+		return
+	}
+	c.flushPending = false
+	c.flushTimer.Stop()
+}
+
+func (c *Conn) flushWhenIdle() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 
-	return socket.WriteSocket(ctx, c.bufWriter, header, body)
+	if c.closed || !c.flushPending {
+		return
+	}
+	c.flushPending = false
+	if c.bufWriter.Buffered() > 0 {
+		// 出错时bufWriter会记住err, 下一次写入会返回并关闭连接
+		_ = c.bufWriter.Flush()
+	}
 }
 
+// Close closes the conn, it is safe to call concurrently with the serve loop
+// and more than once: only the first call closes and reports err to OnConnClose.
+// The handlers still running on the conn see their context cancelled, their
+// responses are not written.
 func (c *Conn) Close(err error) {
-	fmt.Println("conn.close() ", c.Name, err)
-	_ = c.rwc.Close()
+	c.closeOnce.Do(func() {
+		fmt.Println("conn.close() ", c.Name, err)
+		_ = c.rwc.Close()
+
+		c.writeMutex.Lock()
+		c.closed = true
+		c.stopFlushTimerLocked()
+		c.writeMutex.Unlock()
+		close(c.done)
+		c.cancelSubscriptions()
+		c.server.inflight.cancelConn(c) // 客户端已不在, 通知在跑的handler
+
+		c.statsMutex.Lock()
+		c.closeAt, c.closeErr = time.Now(), err
+		c.statsMutex.Unlock()
+		c.server.connLifetimeHist.Observe(c.closeAt.Sub(c.openAt).Milliseconds())
+		c.server.connRequestsHist.Observe(atomic.LoadInt64(&c.requests))
+		c.server.emit(Event{Kind: EventConnClose, ConnName: c.Name, RemoteAddr: c.rwc.RemoteAddr().String(), Err: err})
+
+		if fn := c.server.OnConnClose; fn != nil {
+			fn(c, err)
+		}
+	})
+}
 
-	putBufReader(c.bufReader)
-	putBufWriter(c.bufWriter)
+// putBuffers returns the buffers to the pools once serve is done with them.
+func (c *Conn) putBuffers() {
+	if c.bufReader != nil {
+		putBufReader(c.bufReader)
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.bufWriter != nil {
+		putBufWriter(c.bufWriter)
+	}
 }
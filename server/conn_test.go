@@ -0,0 +1,1934 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/client"
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/metadata"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/socket"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestClientDeadlinePropagation(t *testing.T) {
+	srv := newTestServer()
+	srv.HandlerTimeout = time.Second * 10
+
+	deadlines := make(chan time.Duration, 1)
+	srv.HandleContext("wait", func(ctx context.Context, req []byte) ([]byte, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadlines <- -1
+			return nil, nil
+		}
+		deadlines <- time.Until(deadline)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	addr := startTestServer(t, srv)
+
+	cli := newTestClient(&client.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	now := time.Now()
+	_, err := cli.Call(ctx, modelsAddr(addr), "wait", nil)
+	if err == nil {
+		t.Fatal("call should fail")
+	}
+
+	remaining := <-deadlines
+	if remaining <= 0 || remaining > time.Millisecond*50 {
+		t.Fatalf("handler deadline should follow the client deadline, got %v", remaining)
+	}
+	if elapsed := time.Since(now); elapsed > time.Second {
+		t.Fatalf("call took %v", elapsed)
+	}
+}
+
+func TestHandlerTimeoutWins(t *testing.T) {
+	srv := newTestServer()
+	srv.HandlerTimeout = time.Millisecond * 20
+	srv.HandleContext("wait", func(ctx context.Context, req []byte) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	if err := tc.send(&protocols.Request{Path: "wait", Timeout: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	header, _, body, err := tc.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Code != errors.StatusDeadlineExceeded.Code() {
+		t.Fatalf("expect StatusDeadlineExceeded, got %v %s", header.Code, body)
+	}
+}
+
+func TestStrictEmptyResponse(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		srv := newTestServerWith(func(srv *Server) {
+			srv.StrictEmptyResponse = strict
+		})
+		srv.HandleFunc("nil", func(req []byte) ([]byte, error) {
+			return nil, nil
+		})
+		srv.HandleFunc("empty", func(req []byte) ([]byte, error) {
+			return []byte{}, nil
+		})
+		tc := dialTestConn(t, startTestServer(t, srv))
+
+		// 只有(nil, nil)在strict时算错误, 空切片是合法的空响应
+		if err := tc.send(&protocols.Request{Path: "nil"}); err != nil {
+			t.Fatal(err)
+		}
+		header, rsp, body, err := tc.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strict && header.Code != errors.StatusEmptyResponse.Code() {
+			t.Fatalf("strict: expect StatusEmptyResponse for (nil, nil), got %v %s", header.Code, body)
+		}
+		if !strict && (rsp == nil || rsp.Code != protocols.StatusOK || len(rsp.Rsp) != 0) {
+			t.Fatalf("lenient: expect an empty OK response for (nil, nil), got %v %v", header.Code, rsp)
+		}
+
+		if err := tc.send(&protocols.Request{Path: "empty"}); err != nil {
+			t.Fatal(err)
+		}
+		if header, rsp, _, err := tc.receive(); err != nil || rsp == nil || rsp.Code != protocols.StatusOK || len(rsp.Rsp) != 0 {
+			t.Fatalf("strict %v: expect an empty OK response for []byte{}, got %v %v %v", strict, header, rsp, err)
+		}
+	}
+}
+
+// TestInvalidRequestReason checks a body that is not a protocols.Request
+// gets a bare StatusInvalidRequest, with the decode error only when Verbose.
+func TestInvalidRequestReason(t *testing.T) {
+	for _, verbose := range []bool{false, true} {
+		srv := newTestServer()
+		srv.Verbose = verbose
+		tc := dialTestConn(t, startTestServer(t, srv))
+
+		// field 1 (path) 声明了255字节, 实际只有1字节
+		header := &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion}
+		if _, err := socket.WriteFrame(context.Background(), tc.writer, header, []byte{0x0a, 0xff, 0x01, 'x'}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		header, _, body, err := tc.receive()
+		if err != nil || header.Code != errors.StatusInvalidRequest.Code() {
+			t.Fatalf("expect StatusInvalidRequest, got %v %v", header, err)
+		}
+		reason := errors.DecodeStatus(header.Code, body).Error()
+		if !verbose {
+			if reason != errors.StatusInvalidRequest.Error() {
+				t.Fatalf("expect a bare status by default, got %q", reason)
+			}
+			continue
+		}
+		prefix := errors.StatusInvalidRequest.Error() + ": "
+		if !strings.HasPrefix(reason, prefix) || len(reason) == len(prefix) || strings.ContainsAny(reason, "\n\t") || len(reason) > len(prefix)+128+3 {
+			t.Fatalf("expect a short single line reason when verbose, got %q", reason)
+		}
+	}
+}
+
+// TestWriteTimeoutOverride runs handlers slower than WriteTimeout: the write
+// deadline set while reading the request has passed when they return, unless
+// an override renews it for the response.
+func TestWriteTimeoutOverride(t *testing.T) {
+	srv := newTestServer()
+	srv.WriteTimeout = time.Millisecond * 30
+	slow := func(ctx context.Context, req []byte) ([]byte, error) {
+		time.Sleep(time.Millisecond * 60)
+		if string(req) == "override" {
+			SetWriteTimeout(ctx, time.Second)
+		}
+		return req, nil
+	}
+	srv.HandleContext("slow", slow)
+	if err := srv.HandleConfig("admin", slow, &HandlerConfig{WriteTimeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, srv)
+
+	call := func(meta metadata.MD, path, req string) error {
+		tc := dialTestConn(t, addr)
+		defer tc.Close()
+		if err := tc.send(&protocols.Request{Path: path, Req: []byte(req), Meta: meta}); err != nil {
+			return err
+		}
+		_ = tc.SetReadDeadline(time.Now().Add(time.Second))
+		_, rsp, _, err := tc.receive()
+		if err == nil && string(rsp.Rsp) != req {
+			err = fmt.Errorf("unexpected rsp %q", rsp.Rsp)
+		}
+		return err
+	}
+
+	if err := call(nil, "slow", "plain"); err == nil {
+		t.Fatal("expect the write to miss the server WriteTimeout")
+	}
+	if err := call(nil, "slow", "override"); err != nil {
+		t.Fatalf("SetWriteTimeout should renew the deadline: %v", err)
+	}
+	if err := call(metadata.Pairs(metadata.WriteTimeoutKey, "1000"), "slow", "plain"); err != nil {
+		t.Fatalf("metadata.WriteTimeoutKey should renew the deadline: %v", err)
+	}
+	if err := call(nil, "admin", "plain"); err != nil {
+		t.Fatalf("HandlerConfig.WriteTimeout should renew the deadline: %v", err)
+	}
+}
+
+// TestConcurrentWritesSerialized completes many responses on one conn at once
+// and checks every frame arrives whole. Run with -race.
+func TestConcurrentWritesSerialized(t *testing.T) {
+	srv := newTestServer()
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	c := srv.newConn(serverSide)
+	c.bufReader = getBufReader(c, 0)
+	c.bufWriter = getBufWriter(c, 0)
+	defer c.Close(errors.ErrClosed)
+
+	const writers, perWriter = 16, 50
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			body := bytes.Repeat([]byte{byte('a' + i)}, 1000+i*100)
+			for j := 0; j < perWriter; j++ {
+				header := &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion}
+				if _, err := c.responseSuccess(context.Background(), header, "", body); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	reader := bufio.NewReader(clientSide)
+	for n := 0; n < writers*perWriter; n++ {
+		header, body, _, err := socket.ReadSocket(context.Background(), reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := int(body[0] - 'a')
+		if int(header.Length) != 1000+index*100 || !bytes.Equal(body, bytes.Repeat(body[:1], len(body))) {
+			t.Fatalf("frame %v interleaved: length %v, writer %v", n, header.Length, index)
+		}
+	}
+	wg.Wait()
+}
+
+// TestWriteQueue has many producers queue frames on one conn at once, the
+// writer goroutine must write every one whole. Run with -race.
+func TestWriteQueue(t *testing.T) {
+	srv := newTestServer()
+	srv.WriteQueue = 4
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	c := srv.newConn(serverSide)
+	c.bufReader = getBufReader(c, 0)
+	c.bufWriter = getBufWriter(c, 0)
+	defer c.Close(errors.ErrClosed)
+
+	const producers, perProducer = 8, 50
+	var wg sync.WaitGroup
+	wg.Add(producers)
+	for i := 0; i < producers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			body := bytes.Repeat([]byte{byte('a' + i)}, 500+i*100)
+			for j := 0; j < perProducer; j++ {
+				header := &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion, Code: constant.ActionPush}
+				if err := c.writeControl(header, body); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	reader := bufio.NewReader(clientSide)
+	for n := 0; n < producers*perProducer; n++ {
+		header, body, _, err := socket.ReadSocket(context.Background(), reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := int(body[0] - 'a')
+		if int(header.Length) != 500+index*100 || !bytes.Equal(body, bytes.Repeat(body[:1], len(body))) {
+			t.Fatalf("frame %v interleaved: length %v, producer %v", n, header.Length, index)
+		}
+	}
+	wg.Wait()
+
+	// 对端不读, 队列满了就丢弃
+	srv.WriteQueuePolicy = WriteQueueDrop
+	header := &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion, Code: constant.ActionPush}
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = c.writeControl(header, []byte("x"))
+	}
+	if !errors.Is(err, errors.ErrWriteQueueFull) {
+		t.Fatalf("expect ErrWriteQueueFull, got %v", err)
+	}
+
+	c.Close(errors.ErrClosed)
+	if err := c.writeControl(header, []byte("x")); !errors.Is(err, errors.ErrConnClosed) {
+		t.Fatalf("expect ErrConnClosed after close, got %v", err)
+	}
+}
+
+// TestHeaderReadTimeout trickles a header byte by byte, the server must drop
+// the conn after HeaderReadTimeout instead of waiting for ReadTimeout.
+func TestHeaderReadTimeout(t *testing.T) {
+	srv := newTestServer()
+	srv.HeaderReadTimeout = time.Millisecond * 50
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	// 正常请求不受影响
+	if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp, _, err := tc.receive(); err != nil || string(rsp.Rsp) != "hi" {
+		t.Fatalf("echo failed: %v %v", rsp, err)
+	}
+
+	header := make([]byte, models.HeaderSize)
+	socket.PutHeader(header, &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion})
+
+	now := time.Now()
+	for _, b := range header[:models.HeaderSize-1] {
+		if _, err := tc.Write([]byte{b}); err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	_ = tc.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := tc.reader.ReadByte(); err == nil {
+		t.Fatal("conn should be closed")
+	}
+	if elapsed := time.Since(now); elapsed > time.Second {
+		t.Fatalf("conn closed after %v, want about HeaderReadTimeout", elapsed)
+	}
+}
+
+func TestChunkedRequest(t *testing.T) {
+	srv := newTestServer()
+	srv.ReadTimeout = time.Millisecond * 200
+	srv.MaxRequestBytes = 256 << 10
+	srv.HandleFunc("len", func(req []byte) ([]byte, error) {
+		return []byte(strconv.Itoa(len(req))), nil
+	})
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	// 小请求和分片请求走同一个连接
+	for _, size := range []int{10, 200 << 10} {
+		rsp, err := cli.Do(modelsAddr(addr), "len", bytes.Repeat([]byte("x"), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rsp) != strconv.Itoa(size) {
+			t.Fatalf("handler got %s bytes, want %v", rsp, size)
+		}
+	}
+
+	_, err := cli.Do(modelsAddr(addr), "len", bytes.Repeat([]byte("x"), 300<<10))
+	if st, ok := err.(*errors.Status); !ok || st.Code() != errors.StatusRequestTooLarge.Code() {
+		t.Fatalf("expect StatusRequestTooLarge, got %v", err)
+	}
+	if _, err := cli.Do(modelsAddr(addr), "len", []byte("x")); err != nil {
+		t.Fatalf("conn should stay usable after a too large request: %v", err)
+	}
+
+	// 缺少最后一片
+	tc := dialTestConn(t, addr)
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    constant.FlagMoreChunks,
+	}
+	if _, err := socket.WriteSocket(context.Background(), tc.writer, header, []byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	_ = tc.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if header, _, _, err := tc.receive(); err != nil || header.Code != errors.StatusChunkTimeout.Code() {
+		t.Fatalf("expect StatusChunkTimeout, got %v, %v", header, err)
+	}
+	if _, err := tc.reader.ReadByte(); err == nil {
+		t.Fatal("conn should be closed when the last chunk never arrives")
+	}
+}
+
+func TestPathMaxRequestBytes(t *testing.T) {
+	srv := newTestServer()
+	srv.ReadTimeout = time.Second
+	called := int32(0)
+	lookup := func(ctx context.Context, req []byte) ([]byte, error) {
+		atomic.AddInt32(&called, 1)
+		return req, nil
+	}
+	if err := srv.HandleConfig("lookup", lookup, &HandlerConfig{MaxRequestBytes: 100}); err != nil {
+		t.Fatal(err)
+	}
+	srv.HandleFunc("len", func(req []byte) ([]byte, error) {
+		return []byte(strconv.Itoa(len(req))), nil
+	})
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	if rsp, err := cli.Do(modelsAddr(addr), "lookup", []byte("key")); err != nil || string(rsp) != "key" {
+		t.Fatalf("expect a small request to pass, got %q %v", rsp, err)
+	}
+	// 单帧和分片的请求都在handler之前被拒绝
+	for _, size := range []int{1000, 200 << 10} {
+		_, err := cli.Do(modelsAddr(addr), "lookup", bytes.Repeat([]byte("x"), size))
+		if st, ok := err.(*errors.Status); !ok || st.Code() != errors.StatusRequestTooLarge.Code() {
+			t.Fatalf("expect StatusRequestTooLarge for %v bytes, got %v", size, err)
+		}
+	}
+	if n := atomic.LoadInt32(&called); n != 1 {
+		t.Fatalf("expect the handler to run for the small request only, ran %v times", n)
+	}
+	// 其他path不受影响, 连接仍可用
+	if rsp, err := cli.Do(modelsAddr(addr), "len", bytes.Repeat([]byte("x"), 1000)); err != nil || string(rsp) != "1000" {
+		t.Fatalf("expect other paths unaffected, got %q %v", rsp, err)
+	}
+
+	if max := srv.Stats().PathMaxRequest; len(max) != 1 || max["lookup"] != 100 {
+		t.Fatalf("expect the path limit in stats, got %v", max)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	srv := newTestServer()
+	srv.MaxFrameSize = 1000
+	srv.HandleFunc("len", func(req []byte) ([]byte, error) {
+		return []byte(strconv.Itoa(len(req))), nil
+	})
+	srv.HandleFunc("big", func(req []byte) ([]byte, error) {
+		return bytes.Repeat([]byte("x"), 3000), nil
+	})
+	frames := make(chan int, 1)
+	srv.OnConnClose = func(c *Conn, err error) {
+		select {
+		case frames <- c.MaxFrameSize():
+		default:
+		}
+	}
+	addr := startTestServer(t, srv)
+
+	// 服务器回复自己的设置, 之后双方取较小值
+	tc := dialTestConn(t, addr)
+	header := &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion, Code: constant.ActionSettings}
+	if _, err := socket.WriteSocket(context.Background(), tc.writer, header, (&protocols.Settings{MaxFrameSize: 2000}).Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	header, body, _, err := socket.ReadSocket(context.Background(), tc.reader)
+	if err != nil || header.Code != constant.ActionSettings {
+		t.Fatalf("expect a settings answer, got %v %v", header, err)
+	}
+	if settings, err := protocols.UnmarshalSettings(body); err != nil || settings.MaxFrameSize != 1000 {
+		t.Fatalf("expect MaxFrameSize 1000, got %v %v", settings, err)
+	}
+	if err := tc.send(&protocols.Request{Path: "big"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp, _, err := tc.receive(); err != nil || rsp == nil || rsp.Err != errors.ErrExceedBody.Error() {
+		t.Fatalf("expect a response beyond the agreed size to fail, got %v %v", rsp, err)
+	}
+	_ = tc.Close()
+	if size := <-frames; size != 1000 {
+		t.Fatalf("expect the agreed size on the conn, got %v", size)
+	}
+
+	// 客户端按协商的大小分片
+	cli := newTestClient(&client.Config{MaxFrameSize: 4000})
+	rsp, err := cli.Do(modelsAddr(addr), "len", bytes.Repeat([]byte("x"), 5000))
+	if err != nil || string(rsp) != "5000" {
+		t.Fatalf("expect the chunked request reassembled, got %s %v", rsp, err)
+	}
+	if _, err := cli.Do(modelsAddr(addr), "big", nil); err == nil {
+		t.Fatal("expect the big response to fail")
+	}
+
+	// 不协商时保持原来的上限
+	tc = dialTestConn(t, addr)
+	if err := tc.send(&protocols.Request{Path: "big"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp, _, err := tc.receive(); err != nil || rsp == nil || len(rsp.Rsp) != 3000 {
+		t.Fatalf("expect the full response without settings, got %v %v", rsp, err)
+	}
+	_ = tc.Close()
+}
+
+// TestMaxFrameSizeEnforced sends frames above MaxFrameSize from a client
+// ignoring the settings: they are rejected and the conn stays usable.
+func TestMaxFrameSizeEnforced(t *testing.T) {
+	srv := newTestServer()
+	srv.MaxFrameSize = 1000
+	srv.HandleFunc("len", func(req []byte) ([]byte, error) {
+		return []byte(strconv.Itoa(len(req))), nil
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	if err := tc.send(&protocols.Request{Path: "len", Req: make([]byte, 2000)}); err != nil {
+		t.Fatal(err)
+	}
+	if header, _, _, err := tc.receive(); err != nil || header.Code != errors.StatusRequestTooLarge.Code() {
+		t.Fatalf("expect StatusRequestTooLarge, got %+v, %v", header, err)
+	}
+	if err := tc.send(&protocols.Request{Path: "len", Req: make([]byte, 10)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp, _, err := tc.receive(); err != nil || rsp == nil || string(rsp.Rsp) != "10" {
+		t.Fatalf("expect the conn still usable, got %v, %v", rsp, err)
+	}
+}
+
+func TestChunkAssemblyTimeout(t *testing.T) {
+	closed := make(chan error, 1)
+	srv := newTestServer()
+	srv.ReadTimeout = time.Second * 10
+	srv.ChunkAssemblyTimeout = time.Millisecond * 100
+	srv.OnConnClose = func(c *Conn, err error) {
+		closed <- err
+	}
+	addr := startTestServer(t, srv)
+
+	// 发了第一片后停住
+	tc := dialTestConn(t, addr)
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    constant.FlagMoreChunks,
+	}
+	start := time.Now()
+	if _, err := socket.WriteSocket(context.Background(), tc.writer, header, bytes.Repeat([]byte("x"), 60<<10)); err != nil {
+		t.Fatal(err)
+	}
+	_ = tc.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if header, _, _, err := tc.receive(); err != nil || header.Code != errors.StatusChunkTimeout.Code() {
+		t.Fatalf("expect StatusChunkTimeout, got %v, %v", header, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expect ChunkAssemblyTimeout to win over ReadTimeout, took %v", elapsed)
+	}
+	if err := <-closed; !errors.Is(err, errors.ErrChunkIncomplete) || !errors.Is(err, errors.StatusChunkTimeout) {
+		t.Fatalf("expect the conn closed for the incomplete request, got %v", err)
+	}
+}
+
+func TestCloseErrKeepsCause(t *testing.T) {
+	srv := newTestServer()
+	closed := make(chan error, 1)
+	srv.OnConnClose = func(c *Conn, err error) {
+		closed <- err
+	}
+	tc := dialTestConn(t, startTestServer(t, srv))
+	_ = tc.Close()
+
+	select {
+	case err := <-closed:
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("close err should wrap io.EOF, got %v", err)
+		}
+		if !errors.Is(err, errors.ErrPeekWritingErr) {
+			t.Fatalf("close err should keep its classify, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnClose not called")
+	}
+}
+
+func TestIdleTimeoutClose(t *testing.T) {
+	srv := newTestServer()
+	srv.IdleTimeout = time.Millisecond * 50
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	closed := make(chan error, 2)
+	srv.OnConnClose = func(c *Conn, err error) {
+		closed <- err
+	}
+	addr := startTestServer(t, srv)
+
+	// 空闲超时是正常关闭, 和连接出错区分开
+	tc := dialTestConn(t, addr)
+	select {
+	case err := <-closed:
+		if !errors.Is(err, errors.ErrIdleTimeout) || errors.Is(err, errors.ErrPeekWritingErr) {
+			t.Fatalf("expect an idle timeout close, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle conn not closed")
+	}
+	_ = tc.Close()
+
+	// 对端关闭是连接错误
+	tc = dialTestConn(t, addr)
+	_ = tc.Close()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, errors.ErrPeekWritingErr) || errors.Is(err, errors.ErrIdleTimeout) {
+			t.Fatalf("expect a peek err close, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnClose not called")
+	}
+
+	// 等待中调大IdleTimeout, 旧的deadline到了也不关闭
+	tc = dialTestConn(t, addr)
+	defer tc.Close()
+	cfg := srv.CurrentConfig()
+	cfg.IdleTimeout = time.Second
+	srv.UpdateConfig(cfg)
+	time.Sleep(time.Millisecond * 150)
+	if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp, _, err := tc.receive(); err != nil || rsp == nil || string(rsp.Rsp) != "hi" {
+		t.Fatalf("expect the conn kept past the old idle deadline, got %v %v", rsp, err)
+	}
+	select {
+	case err := <-closed:
+		t.Fatalf("conn closed early: %v", err)
+	default:
+	}
+}
+
+func TestTimingTrailer(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("slow", func(req []byte) ([]byte, error) {
+		time.Sleep(time.Millisecond * 20)
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	var trailer metadata.MD
+	ctx := metadata.AppendToOutgoingContext(context.Background(), metadata.WantTimingKey, "1")
+	rsp, err := cli.Call(client.WithTrailer(ctx, &trailer), modelsAddr(addr), "slow", []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "hi" {
+		t.Fatalf("unexpected rsp %q", rsp)
+	}
+	for _, key := range []string{metadata.TimingReadKey, metadata.TimingQueueKey, metadata.TimingHandlerKey,
+		metadata.TimingSerializeKey, metadata.TimingWriteKey} {
+		if _, err := strconv.ParseInt(trailer[key], 10, 64); err != nil {
+			t.Fatalf("trailer %v: %v", key, err)
+		}
+	}
+	if us, _ := strconv.ParseInt(trailer[metadata.TimingHandlerKey], 10, 64); us < 20000 {
+		t.Fatalf("handler took %vus, expect at least 20ms", us)
+	}
+
+	// 没有要求就没有trailer, 同一连接继续可用
+	trailer = nil
+	if _, err := cli.Call(client.WithTrailer(context.Background(), &trailer), modelsAddr(addr), "slow", nil); err != nil {
+		t.Fatal(err)
+	}
+	if trailer != nil {
+		t.Fatalf("unexpected trailer %v", trailer)
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	srv := newTestServer()
+	var closes int32
+	srv.OnConnClose = func(c *Conn, err error) {
+		atomic.AddInt32(&closes, 1)
+	}
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+	if err := tc.send(&protocols.Request{Path: "echo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := tc.receive(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.connMutex.Lock()
+	var conn *Conn
+	for c := range srv.conns {
+		conn = c
+	}
+	srv.connMutex.Unlock()
+
+	// 多个关闭方与serve自身的关闭同时发生
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Close(errors.New("reaper"))
+		}()
+	}
+	wg.Wait()
+
+	_ = tc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := tc.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("conn should be closed, got %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for srv.Stats().AliveConns != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if n := atomic.LoadInt32(&closes); n != 1 {
+		t.Fatalf("OnConnClose called %v times", n)
+	}
+}
+
+// TestClosedConnSkipsResponse closes the conn while the handler runs: the
+// handler context is cancelled and the response is never written.
+func TestClosedConnSkipsResponse(t *testing.T) {
+	srv := newTestServer()
+	started := make(chan struct{})
+	var after int32
+	srv.HandleContext("wait", func(ctx context.Context, req []byte) ([]byte, error) {
+		RunAfterResponse(ctx, func(ctx context.Context) error {
+			atomic.StoreInt32(&after, 1)
+			return nil
+		})
+		close(started)
+		<-ctx.Done()
+		return []byte("late"), nil
+	})
+	closed := make(chan ConnStats, 1)
+	srv.OnConnClose = func(c *Conn, err error) {
+		go func() {
+			// 等serve退出, 响应要写也已经写了
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 5) {
+				srv.connMutex.Lock()
+				_, alive := srv.conns[c]
+				srv.connMutex.Unlock()
+				if !alive {
+					break
+				}
+			}
+			closed <- c.Stats()
+		}()
+	}
+	tc := dialTestConn(t, startTestServer(t, srv))
+	if err := tc.send(&protocols.Request{Path: "wait"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	srv.connMutex.Lock()
+	var conn *Conn
+	for c := range srv.conns {
+		conn = c
+	}
+	srv.connMutex.Unlock()
+	conn.Close(errors.New("client gone"))
+
+	select {
+	case stats := <-closed:
+		if stats.Writes != 0 || stats.BytesOut != 0 {
+			t.Fatalf("expect no write to the closed conn, got %+v", stats)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("handler was not cancelled by the conn close")
+	}
+	if atomic.LoadInt32(&after) != 0 {
+		t.Fatal("after response work of a skipped response should be dropped")
+	}
+}
+
+// closeTracker is a reader telling when it was closed.
+type closeTracker struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (ct *closeTracker) Close() error {
+	close(ct.closed)
+	return nil
+}
+
+// TestClosedConnClosesStream closes the conn while a stream handler runs: the
+// skipped response must still close its reader.
+func TestClosedConnClosesStream(t *testing.T) {
+	srv := newTestServer()
+	started := make(chan struct{})
+	body := &closeTracker{Reader: strings.NewReader("late"), closed: make(chan struct{})}
+	srv.HandleStream("wait", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		close(started)
+		<-ctx.Done()
+		return body, 4, nil
+	}, nil)
+	tc := dialTestConn(t, startTestServer(t, srv))
+	if err := tc.send(&protocols.Request{Path: "wait"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	srv.connMutex.Lock()
+	var conn *Conn
+	for c := range srv.conns {
+		conn = c
+	}
+	srv.connMutex.Unlock()
+	conn.Close(errors.New("client gone"))
+
+	select {
+	case <-body.closed:
+	case <-time.After(time.Second * 2):
+		t.Fatal("reader of the skipped stream response was not closed")
+	}
+}
+
+// TestCancelConnIndex checks cancelConn reaches only the requests of its conn
+// and the per conn index empties as they finish.
+func TestCancelConnIndex(t *testing.T) {
+	var ir inflightRegistry
+	first, second := &Conn{Name: 1}, &Conn{Name: 2}
+	var canceled []int64
+	track := func(c *Conn) func() {
+		return ir.track(c, RequestInfo{ConnName: c.Name}, func() {
+			canceled = append(canceled, c.Name)
+		}, nil)
+	}
+	untrack := []func(){track(first), track(first), track(second)}
+
+	ir.cancelConn(first)
+	if len(canceled) != 2 || canceled[0] != 1 || canceled[1] != 1 {
+		t.Fatalf("expect the 2 requests of conn 1 canceled, got %v", canceled)
+	}
+	for _, fn := range untrack {
+		fn()
+	}
+	if len(ir.requests) != 0 || len(ir.byConn) != 0 {
+		t.Fatalf("expect an empty registry, got %v requests of %v conns", len(ir.requests), len(ir.byConn))
+	}
+}
+
+// TestConcurrencyLimit checks a request beyond MaxConcurrency waits up to
+// QueueTimeout: it is rejected with StatusServerBusy when no slot frees in
+// time, and admitted once the held one finishes within it.
+func TestConcurrencyLimit(t *testing.T) {
+	const queueTimeout = time.Millisecond * 100
+	srv := newTestServer()
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	srv.HandleConfig("work", func(ctx context.Context, req []byte) ([]byte, error) {
+		if string(req) == "hold" {
+			started <- struct{}{}
+			<-release
+		}
+		return req, nil
+	}, &HandlerConfig{MaxConcurrency: 1, QueueTimeout: queueTimeout})
+	addr := startTestServer(t, srv)
+
+	held, waiting := dialTestConn(t, addr), dialTestConn(t, addr)
+	if err := held.send(&protocols.Request{Path: "work", Req: []byte("hold")}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if n := srv.Stats().PathInFlight["work"]; n != 1 {
+		t.Fatalf("expect 1 request in flight, got %v", n)
+	}
+
+	now := time.Now()
+	if err := waiting.send(&protocols.Request{Path: "work", Req: []byte("rejected")}); err != nil {
+		t.Fatal(err)
+	}
+	header, _, _, err := waiting.receive()
+	if err != nil || header.Code != errors.StatusServerBusy.Code() {
+		t.Fatalf("expect StatusServerBusy, got %+v, %v", header, err)
+	}
+	if elapsed := time.Since(now); elapsed < queueTimeout {
+		t.Fatalf("rejected after %v, expect to wait QueueTimeout %v", elapsed, queueTimeout)
+	}
+
+	// 排队期间空出来的位置交给等待者
+	if err := waiting.send(&protocols.Request{Path: "work", Req: []byte("admitted")}); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(queueTimeout/4, func() { close(release) })
+	for _, tc := range []*testConn{waiting, held} {
+		if _, rsp, _, err := tc.receive(); err != nil || rsp.Code != protocols.StatusOK {
+			t.Fatalf("unexpected response %+v, %v", rsp, err)
+		}
+	}
+	// 响应写完才释放
+	deadline := time.Now().Add(time.Second)
+	for srv.Stats().PathInFlight["work"] != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := srv.Stats().PathInFlight["work"]; n != 0 {
+		t.Fatalf("expect the slots released, got %v in flight", n)
+	}
+}
+
+func TestPriorityAdmission(t *testing.T) {
+	srv := newTestServer()
+	release := make(chan struct{})
+	order := make(chan string, 4)
+	srv.HandleConfig("work", func(ctx context.Context, req []byte) ([]byte, error) {
+		if string(req) == "hold" {
+			<-release
+		}
+		order <- string(req)
+		return req, nil
+	}, &HandlerConfig{MaxConcurrency: 1, QueueTimeout: time.Second * 5})
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	call := func(priority metadata.Priority, name string) chan error {
+		done := make(chan error, 1)
+		go func() {
+			ctx := metadata.WithPriority(context.Background(), priority)
+			_, err := cli.Call(ctx, modelsAddr(addr), "work", []byte(name))
+			done <- err
+		}()
+		time.Sleep(time.Millisecond * 50) // 按顺序排队
+		return done
+	}
+
+	held := call(metadata.PriorityNormal, "hold")
+	normal := call(metadata.PriorityNormal, "normal")
+	high := call(metadata.PriorityHigh, "high")
+
+	// 已满时低优先级直接被拒绝
+	_, err := cli.Call(metadata.WithPriority(context.Background(), metadata.PriorityLow), modelsAddr(addr), "work", []byte("low"))
+	var status *errors.Status
+	if !errors.As(err, &status) || status.Code() != errors.StatusServerBusy.Code() {
+		t.Fatalf("low priority should be shed, got %v", err)
+	}
+
+	close(release)
+	for _, done := range []chan error{held, normal, high} {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"hold", "high", "normal"} {
+		if got := <-order; got != want {
+			t.Fatalf("admitted %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAppError(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("app", func(req []byte) ([]byte, error) {
+		return nil, errors.NewAppError(42, "no such account", []byte("id=7"))
+	})
+	srv.HandleFunc("plain", func(req []byte) ([]byte, error) {
+		return nil, errors.New("plain failure")
+	})
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	for _, cs := range []struct {
+		path string
+		want errors.AppError
+	}{
+		{"app", errors.AppError{Code: 42, Message: "no such account", Body: []byte("id=7")}},
+		{"plain", errors.AppError{Code: protocols.StatusErr, Message: "plain failure"}},
+	} {
+		_, err := cli.Call(context.Background(), modelsAddr(addr), cs.path, nil)
+		var appErr *errors.AppError
+		if !errors.As(err, &appErr) {
+			t.Fatalf("%v: expect an app error, got %v", cs.path, err)
+		}
+		if appErr.Code != cs.want.Code || appErr.Message != cs.want.Message || !bytes.Equal(appErr.Body, cs.want.Body) {
+			t.Fatalf("%v: got %+v, want %+v", cs.path, appErr, cs.want)
+		}
+	}
+	// 应用错误不影响连接
+	if stats := cli.PoolStats(); stats.Idle != 1 {
+		t.Fatalf("conn should be back in the pool: %+v", stats)
+	}
+}
+
+func TestCallResponse(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("app", func(req []byte) ([]byte, error) {
+		detail, _ := proto.Marshal(&protocols.Request{Path: "account/7"})
+		return nil, errors.NewAppError(42, "no such account", detail)
+	})
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	rsp, err := cli.CallResponse(context.Background(), modelsAddr(addr), "app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.OK() || rsp.Code != 42 || rsp.Err != "no such account" {
+		t.Fatalf("unexpected response %+v", rsp)
+	}
+	var detail protocols.Request
+	if err := rsp.UnmarshalDetail(&detail); err != nil || detail.Path != "account/7" {
+		t.Fatalf("detail %v, %v", detail.Path, err)
+	}
+
+	rsp, err = cli.CallResponse(context.Background(), modelsAddr(addr), "echo", []byte("hi"))
+	if err != nil || !rsp.OK() || string(rsp.Body) != "hi" {
+		t.Fatalf("unexpected response %+v, %v", rsp, err)
+	}
+	if err := rsp.UnmarshalDetail(&detail); err != errors.ErrNoDetail {
+		t.Fatalf("expect ErrNoDetail, got %v", err)
+	}
+
+	// 未到达handler仍然是error
+	if _, err := cli.CallResponse(context.Background(), modelsAddr(addr), "missing", nil); err == nil {
+		t.Fatal("expect an error for an unknown path")
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	srv := newTestServer()
+	closed := make(chan ConnStats, 1)
+	srv.OnConnClose = func(c *Conn, err error) {
+		closed <- c.Stats()
+	}
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+	for i := 0; i < 3; i++ {
+		if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := tc.receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 20)
+	_ = tc.Close()
+
+	stats := <-closed
+	if stats.Requests != 3 {
+		t.Fatalf("requests %v, want 3", stats.Requests)
+	}
+	if stats.BytesIn == 0 || stats.BytesOut == 0 {
+		t.Fatalf("bytes not counted: %+v", stats)
+	}
+	if stats.CloseAt.IsZero() || stats.Lifetime() < time.Millisecond*20 || !errors.Is(stats.CloseErr, io.EOF) {
+		t.Fatalf("unexpected close stats: %+v", stats)
+	}
+	if dist := srv.Stats().ConnRequests; dist.Count < 1 || dist.Max < 3 {
+		t.Fatalf("unexpected distribution %+v", dist)
+	}
+}
+
+func TestStatsDistributions(t *testing.T) {
+	for _, decaying := range []bool{false, true} {
+		srv := newTestServerWith(func(srv *Server) {
+			srv.DecayingHistograms = decaying
+		})
+		srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+			return req, nil
+		})
+		tc := dialTestConn(t, startTestServer(t, srv))
+		for i := 1; i <= 4; i++ {
+			if err := tc.send(&protocols.Request{Path: "echo", Req: make([]byte, i*100)}); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, err := tc.receive(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stats := srv.Stats()
+		if stats.ReadMs.Count != 4 || stats.WriteMs.Count != 4 {
+			t.Fatalf("decaying %v: unexpected latency counts %+v %+v", decaying, stats.ReadMs, stats.WriteMs)
+		}
+		if dist := stats.RequestBytes; dist.Count != 4 || dist.Min < 100 || dist.Max < 400 || dist.P50 < float64(dist.Min) {
+			t.Fatalf("decaying %v: unexpected request sizes %+v", decaying, dist)
+		}
+		// 读取不清空
+		if again := srv.Stats().RequestBytes; again != stats.RequestBytes {
+			t.Fatalf("decaying %v: snapshot changed %+v", decaying, again)
+		}
+	}
+}
+
+// countingHistogram is a Histogram keeping only count and sum.
+type countingHistogram struct {
+	count, sum int64 // atomic visit
+}
+
+func (ch *countingHistogram) Observe(value int64) {
+	atomic.AddInt64(&ch.count, 1)
+	atomic.AddInt64(&ch.sum, value)
+}
+
+func (ch *countingHistogram) Distribution() Distribution {
+	return Distribution{Count: atomic.LoadInt64(&ch.count), Max: atomic.LoadInt64(&ch.sum)}
+}
+
+func TestResetStats(t *testing.T) {
+	srv := newTestServer()
+	srv.EventBuffer = 1
+	srv.Events()
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+	echo := func() {
+		if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := tc.receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		echo()
+	}
+	for srv.Stats().EventsDropped == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	srv.ResetStats()
+	stats := srv.Stats()
+	for name, dist := range map[string]Distribution{
+		"accept": stats.AcceptMs, "read": stats.ReadMs, "write": stats.WriteMs,
+		"request bytes": stats.RequestBytes, "response bytes": stats.ResponseBytes,
+	} {
+		if dist != (Distribution{}) {
+			t.Fatalf("%v not reset: %+v", name, dist)
+		}
+	}
+	if stats.EventsDropped != 0 || stats.AliveConns != 1 {
+		t.Fatalf("expect the counters reset and the conn kept, got %+v", stats)
+	}
+
+	// 连接不受影响, 之后重新计数
+	echo()
+	if dist := srv.Stats().RequestBytes; dist.Count != 1 {
+		t.Fatalf("expect one request after the reset, got %+v", dist)
+	}
+}
+
+func TestHistogramFactory(t *testing.T) {
+	hists := make(map[string]*countingHistogram)
+	srv := newTestServerWith(func(srv *Server) {
+		srv.NewHistogram = func(name string) Histogram {
+			hists[name] = &countingHistogram{}
+			return hists[name]
+		}
+	})
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+	for i := 0; i < 3; i++ {
+		if err := tc.send(&protocols.Request{Path: "echo", Req: make([]byte, 100)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := tc.receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := hists["srv.req.bytes"]
+	if req == nil || atomic.LoadInt64(&req.count) != 3 {
+		t.Fatalf("expect 3 request sizes observed, got %+v", req)
+	}
+	if stats := srv.Stats(); stats.RequestBytes != req.Distribution() || stats.ReadMs.Count != 3 {
+		t.Fatalf("expect stats from the factory histograms, got %+v", stats)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	srv := newTestServer()
+	stopped := make(chan error, 1)
+	srv.HandleSubscribe("ticks", func(ctx context.Context, req []byte, send func(msg []byte) error) error {
+		for i := 0; i < 3; i++ {
+			if err := send([]byte(fmt.Sprintf("%s-%d", req, i))); err != nil {
+				return err
+			}
+		}
+		if string(req) == "end" {
+			return errors.NewAppError(7, "feed ended", nil)
+		}
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return nil
+	}, nil)
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	sub, err := cli.Subscribe(context.Background(), modelsAddr(addr), "ticks", []byte("end"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for msg := range sub.C {
+		got = append(got, string(msg))
+	}
+	if strings.Join(got, ",") != "end-0,end-1,end-2" {
+		t.Fatalf("unexpected messages %v", got)
+	}
+	var appErr *errors.AppError
+	if !errors.As(sub.Err(), &appErr) || appErr.Message != "feed ended" {
+		t.Fatalf("expect the handler error, got %v", sub.Err())
+	}
+
+	// 客户端取消订阅, handler的ctx结束
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err = cli.Subscribe(ctx, modelsAddr(addr), "ticks", []byte("live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if msg := <-sub.C; string(msg) != fmt.Sprintf("live-%d", i) {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler ctx not done after unsubscribe")
+	}
+	for range sub.C {
+	}
+	if sub.Err() != errors.ErrSubscriptionClosed {
+		t.Fatalf("expect ErrSubscriptionClosed, got %v", sub.Err())
+	}
+}
+
+func TestSubscribeSlowConsumer(t *testing.T) {
+	const total = 400
+	msg := make([]byte, 32<<10)
+	srv := newTestServer()
+	sent := make(chan int, 2)
+	handler := func(ctx context.Context, req []byte, send func(msg []byte) error) error {
+		n := 0
+		for i := 0; i < total; i++ {
+			err := send(msg)
+			if err == nil {
+				n++
+			} else if err != errors.ErrPushDropped {
+				break
+			}
+		}
+		sent <- n
+		return nil
+	}
+	srv.HandleSubscribe("drop", handler, &SubscribeConfig{SendBuffer: 4})
+	srv.HandleSubscribe("disconnect", handler, &SubscribeConfig{SendBuffer: 4, SlowConsumer: SlowConsumerDisconnect})
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	// 客户端不读, 发送缓冲很快填满
+	sub, err := cli.Subscribe(context.Background(), modelsAddr(addr), "drop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := <-sent
+	if n == total {
+		t.Fatal("expect pushes dropped for a consumer not reading")
+	}
+	received := 0
+	for range sub.C {
+		received++
+	}
+	if received != n || sub.Err() != nil {
+		t.Fatalf("received %v of %v sent, err %v", received, n, sub.Err())
+	}
+
+	sub, err = cli.Subscribe(context.Background(), modelsAddr(addr), "disconnect", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sent
+	for range sub.C {
+	}
+	if sub.Err() == nil {
+		t.Fatal("expect the slow consumer disconnected")
+	}
+}
+
+func TestInFlightCancel(t *testing.T) {
+	srv := newTestServer()
+	started := make(chan struct{}, 2)
+	srv.HandleContext("wait", func(ctx context.Context, req []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	addr := startTestServer(t, srv)
+	named, anonymous := dialTestConn(t, addr), dialTestConn(t, addr)
+	if err := named.send(&protocols.Request{Path: "wait", Meta: map[string]string{metadata.RequestIDKey: "req-1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := anonymous.send(&protocols.Request{Path: "wait"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	<-started
+
+	infos := srv.InFlight()
+	if len(infos) != 2 {
+		t.Fatalf("expect 2 requests in flight, got %+v", infos)
+	}
+	var generated string
+	for _, info := range infos {
+		if info.Path != "wait" || info.RemoteAddr == "" || info.Elapsed <= 0 {
+			t.Fatalf("unexpected info %+v", info)
+		}
+		if info.ID != "req-1" {
+			generated = info.ID
+		}
+	}
+	if generated == "" {
+		t.Fatalf("expect an id generated for the request without one, got %+v", infos)
+	}
+
+	// 按id取消, 只有对应的handler返回
+	if srv.Cancel("no-such-request") {
+		t.Fatal("Cancel of an unknown id should report false")
+	}
+	if !srv.Cancel("req-1") {
+		t.Fatal("Cancel should find req-1")
+	}
+	if _, _, _, err := named.receive(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(srv.InFlight()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if infos := srv.InFlight(); len(infos) != 1 || infos[0].ID != generated {
+		t.Fatalf("expect only %v left, got %+v", generated, infos)
+	}
+	if !srv.Cancel(generated) {
+		t.Fatalf("Cancel should find %v", generated)
+	}
+	if _, _, _, err := anonymous.receive(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamProgress(t *testing.T) {
+	const size = 20 << 10
+	pr, pw := io.Pipe()
+	srv := newTestServer()
+	srv.HandleStream("slow", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		return pr, size, nil
+	}, nil)
+	tc := dialTestConn(t, startTestServer(t, srv))
+	if err := tc.send(&protocols.Request{Path: "slow"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写出2个chunk后卡在handler的reader上
+	if _, err := pw.Write(make([]byte, 2*defaultStreamChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		infos := srv.InFlight()
+		if len(infos) == 1 && infos[0].StreamWritten == 2*defaultStreamChunkSize && infos[0].StreamReading {
+			if infos[0].StreamLength != size {
+				t.Fatalf("expect length %v, got %v", size, infos[0].StreamLength)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected in flight %+v", infos)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	go func() {
+		_, _ = pw.Write(make([]byte, size-2*defaultStreamChunkSize))
+	}()
+	_, rsp, _, err := tc.receive()
+	if err != nil || len(rsp.Rsp) != size {
+		t.Fatalf("unexpected response %v, %v", rsp, err)
+	}
+}
+
+// producedReader yields n bytes of 'x', counting what was read from it.
+type producedReader struct {
+	n        int
+	produced int64 // atomic visit
+}
+
+func (pr *producedReader) Read(p []byte) (int, error) {
+	n := minInt(len(p), pr.n-int(atomic.LoadInt64(&pr.produced)))
+	if n == 0 {
+		return 0, io.EOF
+	}
+	for i := range p[:n] {
+		p[i] = 'x'
+	}
+	atomic.AddInt64(&pr.produced, int64(n))
+	return n, nil
+}
+
+// settled waits for the count of pr to settle.
+func (pr *producedReader) settled() int {
+	last := int64(-1)
+	for {
+		time.Sleep(time.Millisecond * 50)
+		produced := atomic.LoadInt64(&pr.produced)
+		if produced == last {
+			return int(produced)
+		}
+		last = produced
+	}
+}
+
+// TestStreamWindow checks a client that doesn't grant more stops the
+// producer of a stream response once the window is used up.
+func TestStreamWindow(t *testing.T) {
+	const size, window = 40000, 4096
+	reader := &producedReader{n: size}
+	srv := newTestServer()
+	srv.HandleStream("stream", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		return reader, size, nil
+	}, nil)
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	header := &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion, Code: constant.ActionSettings}
+	if _, err := socket.WriteSocket(context.Background(), tc.writer, header, (&protocols.Settings{StreamWindow: window}).Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	header, body, _, err := socket.ReadSocket(context.Background(), tc.reader)
+	if err != nil || header.Code != constant.ActionSettings {
+		t.Fatalf("expect a settings answer, got %v %v", header, err)
+	}
+	if settings, err := protocols.UnmarshalSettings(body); err != nil || settings.StreamWindow != window {
+		t.Fatalf("expect the window echoed, got %v %v", settings, err)
+	}
+
+	grant := func(increment uint32) {
+		header := &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion, Code: constant.ActionWindowUpdate}
+		if _, err := socket.WriteSocket(context.Background(), tc.writer, header, (&protocols.WindowUpdate{Increment: increment}).Marshal()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 客户端不读也不授权, 生产停在窗口内
+	if err := tc.send(&protocols.Request{Path: "stream"}); err != nil {
+		t.Fatal(err)
+	}
+	if produced := reader.settled(); produced == 0 || produced > window {
+		t.Fatalf("expect the producer stopped within the window, produced %v", produced)
+	}
+	grant(window * 2)
+	if produced := reader.settled(); produced <= window || produced > window*3 {
+		t.Fatalf("expect the grant let %v more bytes out, produced %v", window*2, produced)
+	}
+
+	grant(size)
+	header, body, _, err = socket.ReadSocket(context.Background(), tc.reader)
+	if err != nil || header.Code != constant.FlagStreamWindow {
+		t.Fatalf("expect a windowed stream frame, got %v %v", header, err)
+	}
+	var rsp protocols.Response
+	if err := proto.Unmarshal(body, &rsp); err != nil || !bytes.Equal(rsp.Rsp, bytes.Repeat([]byte("x"), size)) {
+		t.Fatalf("unexpected response of %v bytes, %v", len(rsp.Rsp), err)
+	}
+}
+
+// TestStreamWindowClient checks streams read through a client with a window
+// arrive whole and leave the conn usable.
+func TestStreamWindowClient(t *testing.T) {
+	const size = 40000
+	srv := newTestServer()
+	srv.HandleStream("stream", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		return &producedReader{n: size}, size, nil
+	}, nil)
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := modelsAddr(startTestServer(t, srv))
+	cli := newTestClient(&client.Config{StreamWindow: 2048})
+
+	for i := 0; i < 3; i++ {
+		rsp, err := cli.Call(context.Background(), addr, "stream", nil)
+		if err != nil || !bytes.Equal(rsp, bytes.Repeat([]byte("x"), size)) {
+			t.Fatalf("unexpected response of %v bytes, %v", len(rsp), err)
+		}
+		if rsp, err := cli.Call(context.Background(), addr, "echo", []byte("hi")); err != nil || string(rsp) != "hi" {
+			t.Fatalf("unexpected response %q, %v", rsp, err)
+		}
+	}
+	if stats := cli.PoolStats(); stats.Idle != 1 {
+		t.Fatalf("expect one conn reused, got %+v", stats)
+	}
+}
+
+func TestPendingWrite(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("big", func(req []byte) ([]byte, error) {
+		return make([]byte, 60<<10), nil
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+	// 客户端不读, socket缓冲写满后卡在写入上
+	for i := 0; i < 200; i++ {
+		if err := tc.send(&protocols.Request{Path: "big"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		infos := srv.InFlight()
+		if len(infos) == 1 && infos[0].ConnPendingWrite > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect bytes pending write, got %+v", infos)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// failingReader yields n bytes, then fails with err.
+type failingReader struct {
+	n   int
+	err error
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.n == 0 {
+		return 0, fr.err
+	}
+	n := minInt(len(p), fr.n)
+	for i := range p[:n] {
+		p[i] = 'x'
+	}
+	fr.n -= n
+	return n, nil
+}
+
+func TestStreamFailsMidway(t *testing.T) {
+	const sent = 6000
+	srv := newTestServer()
+	srv.HandleStream("broken", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		return &failingReader{n: sent, err: errors.NewAppError(9, "disk gone", nil)}, 3 * sent, nil
+	}, nil)
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := modelsAddr(startTestServer(t, srv))
+	cli := newTestClient(&client.Config{})
+
+	rsp, err := cli.Call(context.Background(), addr, "broken", nil)
+	if !errors.Is(err, errors.ErrStreamAborted) {
+		t.Fatalf("expect ErrStreamAborted, got %v", err)
+	}
+	var appErr *errors.AppError
+	if !errors.As(err, &appErr) || appErr.Code != 9 || appErr.Message != "disk gone" {
+		t.Fatalf("expect the reader error, got %v", err)
+	}
+	if len(rsp) != sent || !bytes.Equal(rsp, bytes.Repeat([]byte("x"), sent)) {
+		t.Fatalf("expect the %v bytes sent, got %v", sent, len(rsp))
+	}
+
+	// 帧是完整的, 连接还能继续用
+	if rsp, err := cli.Call(context.Background(), addr, "echo", []byte("hi")); err != nil || string(rsp) != "hi" {
+		t.Fatalf("unexpected response %q, %v", rsp, err)
+	}
+	if stats := cli.PoolStats(); stats.Idle != 1 {
+		t.Fatalf("expect the conn reused, got %+v", stats)
+	}
+}
+
+// TestStreamFailsBeforeData checks a stream failing before its first byte is
+// answered with a plain error response, no stream body and no trailer.
+func TestStreamFailsBeforeData(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleStream("broken", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		return &failingReader{err: errors.NewAppError(9, "disk gone", nil)}, 100, nil
+	}, nil)
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+
+	tc := dialTestConn(t, addr)
+	body, err := proto.Marshal(&protocols.Request{Path: "broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    constant.FlagAcceptsTrailer,
+	}
+	if _, err := socket.WriteFrame(context.Background(), tc.writer, header, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	rspHeader, rsp, _, err := tc.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rspHeader.Code != 0 || rsp.Code != 9 || rsp.Err != "disk gone" {
+		t.Fatalf("expect a plain error response, got %+v %v", rspHeader, rsp)
+	}
+	// 没有trailer, 下一帧就是下一个请求的响应
+	if _, rsp, _, err := tc.receive(); err != nil || rsp == nil || string(rsp.Rsp) != "hi" {
+		t.Fatalf("expect the echo response next, got %v %v", rsp, err)
+	}
+
+	cli := newTestClient(&client.Config{})
+	_, err = cli.Call(context.Background(), modelsAddr(addr), "broken", nil)
+	var appErr *errors.AppError
+	if errors.Is(err, errors.ErrStreamAborted) || !errors.As(err, &appErr) || appErr.Code != 9 {
+		t.Fatalf("expect the handler error, got %v", err)
+	}
+}
+
+// startPipelineServer serves 1KB responses, the stats of each closed conn are sent to the channel.
+func startPipelineServer(tb testing.TB, configure func(srv *Server)) (net.Addr, chan ConnStats) {
+	srv := newTestServerWith(configure)
+	closed := make(chan ConnStats, 1)
+	srv.OnConnClose = func(c *Conn, err error) {
+		closed <- c.Stats()
+	}
+	srv.HandleFunc("kb", func(req []byte) ([]byte, error) {
+		return make([]byte, 1000), nil
+	})
+	return startTestServer(tb, srv), closed
+}
+
+// pipelineWrites answers a pipeline of requests on a new conn and returns
+// the write calls the server needed.
+func pipelineWrites(tb testing.TB, addr net.Addr, closed chan ConnStats, requests int) int64 {
+	tc := dialTestConn(tb, addr)
+	for i := 0; i < requests; i++ {
+		if err := tc.queue(&protocols.Request{Path: "kb"}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := tc.writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < requests; i++ {
+		if _, _, _, err := tc.receive(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	_ = tc.Close()
+	return (<-closed).Writes
+}
+
+func TestCoalesceMaxBytes(t *testing.T) {
+	writes := func(configure func(srv *Server)) int64 {
+		addr, closed := startPipelineServer(t, configure)
+		return pipelineWrites(t, addr, closed, 8)
+	}
+	if n := writes(nil); n != 8 {
+		t.Fatalf("expect a write per response, got %v", n)
+	}
+	uncapped := writes(func(srv *Server) { srv.WriteCoalescing = true })
+	// 每2个响应超过1500字节, flush一次
+	capped := writes(func(srv *Server) {
+		srv.WriteCoalescing = true
+		srv.CoalesceMaxBytes = 1500
+	})
+	if capped != 4 || uncapped >= capped {
+		t.Fatalf("unexpected writes: %v capped, %v uncapped", capped, uncapped)
+	}
+}
+
+func TestDeadlineExpiredInQueue(t *testing.T) {
+	for _, queue := range []string{"limiter", "workers"} {
+		srv := newTestServerWith(func(srv *Server) {
+			if queue == "workers" {
+				srv.HandlerWorkers = 1
+			}
+		})
+		var invoked int64
+		release := make(chan struct{})
+		cfg := &HandlerConfig{MaxConcurrency: 1, QueueTimeout: time.Second * 5}
+		if queue == "workers" {
+			cfg = nil
+		}
+		srv.HandleConfig("work", func(ctx context.Context, req []byte) ([]byte, error) {
+			atomic.AddInt64(&invoked, 1)
+			if string(req) == "hold" {
+				<-release
+			}
+			return req, nil
+		}, cfg)
+		addr := startTestServer(t, srv)
+
+		holder := dialTestConn(t, addr)
+		if err := holder.send(&protocols.Request{Path: "work", Req: []byte("hold")}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 20)
+
+		// 排队时超时, 放行后不再执行
+		late := dialTestConn(t, addr)
+		if err := late.send(&protocols.Request{Path: "work", Req: []byte("late"), Timeout: 50}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 100)
+		close(release)
+
+		header, _, _, err := late.receive()
+		if err != nil || header.Code != errors.StatusDeadlineExceeded.Code() {
+			t.Fatalf("%v: expect StatusDeadlineExceeded, got %+v, %v", queue, header, err)
+		}
+		if _, _, _, err := holder.receive(); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt64(&invoked); n != 1 {
+			t.Fatalf("%v: expect only the holder handled, got %v", queue, n)
+		}
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	srv := newTestServer()
+	var calls int64
+	release := make(chan chan struct{}, 1)
+	srv.HandleConfig("read", func(ctx context.Context, req []byte) ([]byte, error) {
+		n := atomic.AddInt64(&calls, 1)
+		<-<-release
+		switch string(req) {
+		case "fail":
+			return nil, errors.New("backend down")
+		case "panic":
+			panic("leader panic")
+		}
+		return []byte(fmt.Sprint("result ", n)), nil
+	}, &HandlerConfig{CoalesceKey: func(ctx context.Context, req []byte) string {
+		return string(req)
+	}})
+	addr := startTestServer(t, srv)
+
+	const waiters = 5
+	conns := make([]*testConn, waiters)
+	for i := range conns {
+		conns[i] = dialTestConn(t, addr)
+	}
+	round := func(req string) []string {
+		before := atomic.LoadInt64(&calls)
+		for _, tc := range conns {
+			if err := tc.send(&protocols.Request{Path: "read", Req: []byte(req)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for len(srv.InFlight()) != waiters {
+			time.Sleep(time.Millisecond)
+		}
+		gate := make(chan struct{})
+		release <- gate
+		close(gate)
+
+		var results []string
+		for _, tc := range conns {
+			header, rsp, body, err := tc.receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rsp == nil {
+				results = append(results, fmt.Sprintf("status %v %s", header.Code, body))
+			} else {
+				results = append(results, fmt.Sprintf("%v %s %s", rsp.Code, rsp.Rsp, rsp.Err))
+			}
+		}
+		if n := atomic.LoadInt64(&calls) - before; n != 1 {
+			t.Fatalf("%v: expect the handler to run once, ran %v times", req, n)
+		}
+		return results
+	}
+	shared := func(results []string, want string) {
+		for _, result := range results {
+			if result != results[0] || !strings.Contains(result, want) {
+				t.Fatalf("expect the waiters to share %q, got %q", want, results)
+			}
+		}
+	}
+
+	shared(round("ok"), "result")
+	shared(round("fail"), "backend down")
+	// leader自己收到panic的响应, 等待者不会卡住
+	var waited []string
+	for _, result := range round("panic") {
+		if !strings.Contains(result, "panic serving") {
+			waited = append(waited, result)
+		}
+	}
+	if len(waited) != waiters-1 {
+		t.Fatalf("expect %v waiters, got %q", waiters-1, waited)
+	}
+	shared(waited, "status 500 panic in coalesced handler")
+	// panic后leader的连接被关闭, 之后的请求照常执行
+	for i := range conns {
+		conns[i] = dialTestConn(t, addr)
+	}
+	shared(round("ok"), "result")
+}
+
+func TestDedupLeaderPanic(t *testing.T) {
+	srv := newTestServer()
+	var calls int64
+	release := make(chan struct{})
+	srv.HandleConfig("pay", func(ctx context.Context, req []byte) ([]byte, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			<-release
+			panic("leader panic")
+		}
+		return []byte("paid"), nil
+	}, &HandlerConfig{DedupSize: 8})
+	addr := startTestServer(t, srv)
+
+	pay := &protocols.Request{Path: "pay", Meta: map[string]string{metadata.IdempotencyKey: "order-1"}}
+	leader, duplicate := dialTestConn(t, addr), dialTestConn(t, addr)
+	if err := leader.send(pay); err != nil {
+		t.Fatal(err)
+	}
+	for len(srv.InFlight()) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := duplicate.send(pay); err != nil {
+		t.Fatal(err)
+	}
+	for len(srv.InFlight()) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	// leader收到panic的响应, 等待的重复请求不会卡住, 接着执行handler
+	if header, _, body, err := leader.receive(); err != nil || header.Code != 500 {
+		t.Fatalf("expect the leader to get the panic status, got %v %s %v", header, body, err)
+	}
+	_ = duplicate.SetReadDeadline(time.Now().Add(time.Second))
+	if _, rsp, _, err := duplicate.receive(); err != nil || rsp == nil || string(rsp.Rsp) != "paid" {
+		t.Fatalf("expect the duplicate to run the handler, got %v %v", rsp, err)
+	}
+	// key可以继续使用, 之后的重复请求拿到缓存的响应
+	if err := duplicate.send(pay); err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp, _, err := duplicate.receive(); err != nil || rsp == nil || string(rsp.Rsp) != "paid" {
+		t.Fatalf("expect the cached response, got %v %v", rsp, err)
+	}
+	if n := atomic.LoadInt64(&calls); n != 2 {
+		t.Fatalf("expect the handler to run twice, ran %v times", n)
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	srv := newTestServer()
+	long := strings.Repeat("p", constant.DefaultMaxPathLength+1)
+	fits := long[:constant.DefaultMaxPathLength]
+	for _, path := range []string{long, fits} {
+		srv.HandleFunc(path, func(req []byte) ([]byte, error) {
+			return []byte("ok"), nil
+		})
+	}
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	for _, cs := range []struct {
+		path string
+		code uint16
+	}{
+		{long, errors.StatusInvalidPath.Code()},
+		{strings.Repeat("p", 1<<15), errors.StatusInvalidPath.Code()},
+		{fits, 0}, // 连接照常可用
+	} {
+		if err := tc.send(&protocols.Request{Path: cs.path}); err != nil {
+			t.Fatal(err)
+		}
+		header, _, _, err := tc.receive()
+		if err != nil || header.Code != cs.code {
+			t.Fatalf("path of %v bytes: expect code %v, got %v, %v", len(cs.path), cs.code, header, err)
+		}
+	}
+}
+
+func TestSigner(t *testing.T) {
+	key := []byte("shared secret")
+	var calls int64
+	srv := newTestServer()
+	srv.Signer = &protocols.Signer{Key: key, Hash: sha512.New}
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		atomic.AddInt64(&calls, 1)
+		return req, nil
+	})
+	srv.HandleStream("stream", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		return bytes.NewReader(bytes.Repeat([]byte("s"), 10000)), 10000, nil
+	}, nil)
+	addr := modelsAddr(startTestServer(t, srv))
+
+	signed := newTestClient(&client.Config{Signer: &protocols.Signer{Key: key, Hash: sha512.New}})
+	if rsp, err := signed.Call(context.Background(), addr, "echo", []byte("hello")); err != nil || string(rsp) != "hello" {
+		t.Fatalf("signed call failed: %q, %v", rsp, err)
+	}
+	if rsp, err := signed.Call(context.Background(), addr, "stream", nil); err != nil || len(rsp) != 10000 {
+		t.Fatalf("signed stream failed: %v bytes, %v", len(rsp), err)
+	}
+
+	for name, cfg := range map[string]*client.Config{
+		"unsigned":  {},
+		"wrong key": {Signer: &protocols.Signer{Key: []byte("guess"), Hash: sha512.New}},
+		"wrong mac": {Signer: &protocols.Signer{Key: key}},
+	} {
+		before := atomic.LoadInt64(&calls)
+		_, err := newTestClient(cfg).Call(context.Background(), addr, "echo", []byte("hello"))
+		if status, ok := err.(*errors.Status); !ok || status.Code() != errors.StatusSignatureInvalid.Code() {
+			t.Fatalf("%v: expect StatusSignatureInvalid, got %v", name, err)
+		}
+		if atomic.LoadInt64(&calls) != before {
+			t.Fatalf("%v: the handler should not run", name)
+		}
+	}
+
+	// 响应没有签名, 客户端拒绝
+	plain := newTestServer()
+	plain.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	plainAddr := modelsAddr(startTestServer(t, plain))
+	_, err := newTestClient(&client.Config{Signer: &protocols.Signer{Key: key}}).Call(context.Background(), plainAddr, "echo", []byte("hello"))
+	if status, ok := err.(*errors.Status); !ok || status.Code() != errors.StatusSignatureInvalid.Code() {
+		t.Fatalf("expect the unsigned response rejected, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/metadata"
+)
+
+type connMetaKey struct{}
+
+// connMeta is the metadata of a conn, set by Server.ConnAuth or SetConnMetadata.
+type connMeta struct {
+	mutex sync.RWMutex
+	md    metadata.MD
+}
+
+// ConnMetadata returns a copy of the metadata of the conn a request came in
+// on, e.g. the tenant Server.ConnAuth identified. It is not the request
+// metadata, see metadata.FromIncomingContext.
+func ConnMetadata(ctx context.Context) metadata.MD {
+	meta, ok := ctx.Value(connMetaKey{}).(*connMeta)
+	if !ok {
+		return nil
+	}
+	meta.mutex.RLock()
+	defer meta.mutex.RUnlock()
+	return meta.md.Copy()
+}
+
+// SetConnMetadata sets key on the metadata of the conn a request came in on,
+// the following requests of the conn see it. For an auth handshake done by a
+// request, e.g. a login path, instead of Server.ConnAuth.
+func SetConnMetadata(ctx context.Context, key, value string) {
+	meta, ok := ctx.Value(connMetaKey{}).(*connMeta)
+	if !ok {
+		return
+	}
+	meta.mutex.Lock()
+	defer meta.mutex.Unlock()
+	if meta.md == nil {
+		meta.md = metadata.MD{}
+	}
+	meta.md.Set(key, value)
+}
+
+// authenticate runs ConnAuth and attaches the conn metadata to ctx.
+func (c *Conn) authenticate(ctx context.Context) (context.Context, error) {
+	meta := &connMeta{}
+	if auth := c.server.ConnAuth; auth != nil {
+		md, err := auth(ctx, c.rwc.RemoteAddr())
+		if err != nil {
+			return ctx, errors.Wrap(errors.ErrConnAuth, err)
+		}
+		meta.md = md.Copy()
+	}
+	return context.WithValue(ctx, connMetaKey{}, meta), nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/statistics/metrics"
+)
+
+// ConnStats describes one conn, it is final once the conn is closed, e.g.
+// when read in OnConnClose.
+type ConnStats struct {
+	OpenAt   time.Time // accepted
+	CloseAt  time.Time // zero while open
+	Requests int64     // requests answered, pings not counted
+	BytesIn  int64
+	BytesOut int64
+	Writes   int64 // write calls on the socket, WriteCoalescing lowers it
+	CloseErr error // the err passed to OnConnClose
+
+	// PendingWrite is how many bytes are buffered but not yet written to
+	// the socket, or stuck in a socket write: a conn keeping it high has a
+	// client not reading its responses fast enough.
+	PendingWrite int64
+}
+
+// Lifetime is how long the conn has been, or was, open.
+func (cs *ConnStats) Lifetime() time.Duration {
+	if cs.CloseAt.IsZero() {
+		return time.Since(cs.OpenAt)
+	}
+	return cs.CloseAt.Sub(cs.OpenAt)
+}
+
+func (c *Conn) Stats() ConnStats {
+	c.statsMutex.Lock()
+	closeAt, closeErr := c.closeAt, c.closeErr
+	c.statsMutex.Unlock()
+	return ConnStats{
+		OpenAt:   c.openAt,
+		CloseAt:  closeAt,
+		Requests: atomic.LoadInt64(&c.requests),
+		BytesIn:  atomic.LoadInt64(&c.bytesIn),
+		BytesOut: atomic.LoadInt64(&c.bytesOut),
+		Writes:   atomic.LoadInt64(&c.writes),
+		CloseErr: closeErr,
+
+		PendingWrite: atomic.LoadInt64(&c.pendingWrite),
+	}
+}
+
+// Distribution summarizes a histogram at the moment it is taken, nothing is
+// reset. Count is all time, the others are over the histogram sample: all
+// time, or mostly the last minutes with Server.DecayingHistograms. A
+// Server.NewHistogram histogram fills it as it sees fit.
+type Distribution struct {
+	Count         int64
+	Min, Max      int64
+	Mean          float64
+	P50, P90, P99 float64
+}
+
+func newDistribution(h metrics.Histogram) Distribution {
+	snapshot := h.Snapshot()
+	ps := snapshot.Percentiles([]float64{0.5, 0.9, 0.99})
+	return Distribution{
+		Count: snapshot.Count(),
+		Min:   snapshot.Min(),
+		Max:   snapshot.Max(),
+		Mean:  snapshot.Mean(),
+		P50:   ps[0],
+		P90:   ps[1],
+		P99:   ps[2],
+	}
+}
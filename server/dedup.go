@@ -0,0 +1,116 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+)
+
+// dedupCache maps an idempotency key to the response of the first request
+// carrying it, least recently used keys are evicted beyond size.
+type dedupCache struct {
+	size int
+	ttl  time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element // of *dedupEntry
+	lru     *list.List               // front is the most recently used
+}
+
+type dedupEntry struct {
+	key      string
+	done     chan struct{} // closed once body is set or the first request failed
+	body     []byte        // marshaled protocols.Response, nil if the first request failed
+	code     uint16        // reply.code of body
+	expireAt time.Time
+}
+
+func newDedupCache(size int, ttl time.Duration) *dedupCache {
+	if size <= 0 {
+		return nil
+	}
+	return &dedupCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// do runs fn for the first request of key and replays its response to the
+// duplicates. A duplicate arriving while the first is running waits for it;
+// if the first ends with a status error nothing is cached and the next one runs fn.
+func (dc *dedupCache) do(ctx context.Context, key string, rp *reply, fn func() error) error {
+	for {
+		dc.mutex.Lock()
+		if entry := dc.lookupLocked(key); entry != nil {
+			dc.mutex.Unlock()
+			select {
+			case <-entry.done:
+			case <-ctx.Done():
+				return errors.StatusDeadlineExceeded
+			}
+			if entry.body != nil {
+				rp.body, rp.code = entry.body, entry.code
+				return nil
+			}
+			continue
+		}
+		entry := &dedupEntry{key: key, done: make(chan struct{})}
+		dc.addLocked(entry)
+		dc.mutex.Unlock()
+
+		var err error
+		finished := false
+		defer func() {
+			// fn panic了也要移除并唤醒等待者, panic继续向上交给serve处理
+			dc.mutex.Lock()
+			if finished && err == nil && rp.body != nil {
+				entry.body, entry.code = rp.body, rp.code
+				entry.expireAt = time.Now().Add(dc.ttl)
+			} else {
+				dc.removeLocked(entry)
+			}
+			dc.mutex.Unlock()
+			close(entry.done)
+		}()
+
+		err = fn()
+		finished = true
+		return err
+	}
+}
+
+func (dc *dedupCache) lookupLocked(key string) *dedupEntry {
+	elem, ok := dc.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*dedupEntry)
+	// 执行中的不过期
+	if dc.ttl > 0 && !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+		dc.removeLocked(entry)
+		return nil
+	}
+	dc.lru.MoveToFront(elem)
+	return entry
+}
+
+func (dc *dedupCache) addLocked(entry *dedupEntry) {
+	dc.entries[entry.key] = dc.lru.PushFront(entry)
+	for dc.lru.Len() > dc.size {
+		dc.removeLocked(dc.lru.Back().Value.(*dedupEntry))
+	}
+}
+
+func (dc *dedupCache) removeLocked(entry *dedupEntry) {
+	elem, ok := dc.entries[entry.key]
+	if !ok || elem.Value.(*dedupEntry) != entry {
+		return // 已被淘汰或替换
+	}
+	delete(dc.entries, entry.key)
+	dc.lru.Remove(elem)
+}
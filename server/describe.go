@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// HandlerKind is how a registered path answers.
+type HandlerKind int
+
+const (
+	HandlerUnary     HandlerKind = iota + 1 // HandleFunc, HandleContext, HandleConfig
+	HandlerStream                           // HandleStream
+	HandlerSubscribe                        // HandleSubscribe
+	HandlerHealth                           // RegisterHealth, RegisterDescribe
+)
+
+func (k HandlerKind) String() string {
+	switch k {
+	case HandlerUnary:
+		return "unary"
+	case HandlerStream:
+		return "stream"
+	case HandlerSubscribe:
+		return "subscribe"
+	case HandlerHealth:
+		return "health"
+	}
+	return "unknown"
+}
+
+func (k HandlerKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *HandlerKind) UnmarshalText(text []byte) error {
+	for kind := HandlerUnary; kind <= HandlerHealth; kind++ {
+		if kind.String() == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown handler kind %q", text)
+}
+
+// HandlerInfo describes a registered path, see DescribeHandlers.
+type HandlerInfo struct {
+	Path         string      `json:"path"`
+	Kind         HandlerKind `json:"kind"`
+	Description  string      `json:"description,omitempty"`
+	RequestType  string      `json:"request_type,omitempty"`
+	ResponseType string      `json:"response_type,omitempty"`
+	Deduped      bool        `json:"deduped,omitempty"`   // DedupSize > 0
+	Coalesced    bool        `json:"coalesced,omitempty"` // CoalesceKey set
+
+	MaxConcurrency  int           `json:"max_concurrency,omitempty"`
+	QueueTimeout    time.Duration `json:"queue_timeout,omitempty"`
+	MaxRequestBytes int           `json:"max_request_bytes,omitempty"`
+	WriteTimeout    time.Duration `json:"write_timeout,omitempty"`
+}
+
+// DescribeHandlers lists the registered paths sorted by path, with the
+// HandlerConfig they were registered with, for API explorers and tooling.
+func (srv *Server) DescribeHandlers() []HandlerInfo {
+	srv.mutex.RLock()
+	infos := make([]HandlerInfo, 0, len(srv.handlers))
+	for _, entry := range srv.handlers {
+		infos = append(infos, entry.describe())
+	}
+	srv.mutex.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+	return infos
+}
+
+// RegisterDescribe installs a handler at path answering DescribeHandlers as
+// JSON, a discovery endpoint for CLI tooling. Like RegisterHealth it is
+// answered in maintenance mode as well.
+func (srv *Server) RegisterDescribe(path string) error {
+	entry := &handlerEntry{
+		path:   path,
+		health: true,
+		fn: func(ctx context.Context, req []byte) ([]byte, error) {
+			return json.Marshal(srv.DescribeHandlers())
+		},
+	}
+
+	return srv.register(entry)
+}
+
+func (entry *handlerEntry) describe() HandlerInfo {
+	cfg := entry.config
+	info := HandlerInfo{
+		Path:            entry.path,
+		Kind:            HandlerUnary,
+		Description:     cfg.Description,
+		RequestType:     cfg.RequestType,
+		ResponseType:    cfg.ResponseType,
+		Deduped:         entry.dedup != nil,
+		Coalesced:       entry.flight != nil,
+		MaxConcurrency:  cfg.MaxConcurrency,
+		QueueTimeout:    cfg.QueueTimeout,
+		MaxRequestBytes: cfg.MaxRequestBytes,
+		WriteTimeout:    cfg.WriteTimeout,
+	}
+	switch {
+	case entry.health:
+		info.Kind = HandlerHealth
+	case entry.streamFn != nil:
+		info.Kind = HandlerStream
+	case entry.subscribeFn != nil:
+		info.Kind = HandlerSubscribe
+	}
+	return info
+}
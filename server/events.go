@@ -0,0 +1,106 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+)
+
+// EventKind tells what an Event reports.
+type EventKind int
+
+const (
+	EventConnOpen     EventKind = iota + 1 // a conn was accepted
+	EventConnClose                         // a conn closed, Err is why
+	EventRequest                           // a request was answered with StatusOK
+	EventRequestError                      // a request was answered with another code
+	EventOverload                          // a request or conn was refused for load, Code is the status
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventConnOpen:
+		return "conn_open"
+	case EventConnClose:
+		return "conn_close"
+	case EventRequest:
+		return "request"
+	case EventRequestError:
+		return "request_error"
+	case EventOverload:
+		return "overload"
+	}
+	return "unknown"
+}
+
+// Event is emitted on Server.Events, the fields not applying to its Kind are zero.
+type Event struct {
+	Kind       EventKind
+	Time       time.Time
+	ConnName   int64
+	RemoteAddr string
+
+	Path    string
+	Code    uint16        // response code, a status code for status responses
+	Elapsed time.Duration // from reading the request to its response written
+	Err     error         // the status of a status response, or why a conn closed
+}
+
+// Events returns the channel the server events are emitted on, they are only
+// emitted once it was called. Emitting never blocks: an event finding the
+// channel full, EventBuffer events, is dropped and counted in
+// Stats.EventsDropped. Consumers should read it continuously.
+func (srv *Server) Events() <-chan Event {
+	srv.eventsOnce.Do(func() {
+		size := srv.EventBuffer
+		if size <= 0 {
+			size = constant.DefaultEventBuffer
+		}
+		srv.events.Store(make(chan Event, size))
+	})
+	return srv.events.Load().(chan Event)
+}
+
+func (srv *Server) emit(event Event) {
+	events, ok := srv.events.Load().(chan Event)
+	if !ok {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case events <- event:
+	default:
+		atomic.AddInt64(&srv.eventsDropped, 1)
+	}
+}
+
+func (srv *Server) emitting() bool {
+	_, ok := srv.events.Load().(chan Event)
+	return ok
+}
+
+// emitRequest reports a request once its response is written.
+func (c *Conn) emitRequest(path string, code uint16, status error, start time.Time) {
+	if !c.server.emitting() {
+		return
+	}
+	event := Event{
+		Kind:       EventRequest,
+		ConnName:   c.Name,
+		RemoteAddr: c.remoteAddr,
+		Path:       path,
+		Code:       code,
+		Elapsed:    time.Since(start),
+		Err:        status,
+	}
+	switch {
+	case code == errors.StatusServerBusy.Code() || code == errors.StatusRateLimited.Code():
+		event.Kind = EventOverload
+	case code != uint16(protocols.StatusOK):
+		event.Kind = EventRequestError
+	}
+	c.server.emit(event)
+}
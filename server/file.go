@@ -0,0 +1,51 @@
+package server
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+)
+
+// FileBody returns f as a stream handler response from its current offset to
+// the end, see HandleStream; f is closed once written.
+//
+// On Linux a file body on a TCP conn is sent with sendfile(2) through
+// net.TCPConn.ReadFrom, without copying it through user space. Other conns
+// (vsock, TLS) and other platforms fall back to the buffered chunk copy.
+func FileBody(f *os.File) (io.Reader, int, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, int(info.Size() - offset), nil
+}
+
+// sendFile writes the remaining bytes of a file body straight to the conn,
+// ok is false if the fast path does not apply and nothing was written.
+func (c *Conn) sendFile(sb *streamBody, remaining int) (ok bool, err error) {
+	file, ok := sb.reader.(*os.File)
+	if !ok {
+		return false, nil
+	}
+	if _, ok := c.rwc.(io.ReaderFrom); !ok {
+		return false, nil
+	}
+
+	if err := c.bufWriter.Flush(); err != nil {
+		return true, err
+	}
+	c.setChunkWriteDeadline(sb)
+	// io.CopyN hands the LimitedReader of the file to rwc.ReadFrom (sendfile)
+	n, err := io.CopyN(c.rwc, file, int64(remaining))
+	atomic.AddInt64(&c.bytesOut, n) // 绕过了Conn.Write
+	if err != nil {
+		return true, errors.Wrap(errors.ErrStreamBroken, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/log"
+	"github.com/brodyxchen/vsock-sdk/models"
+)
+
+// GoAway asks the clients of every alive conn to move elsewhere, e.g. before
+// a rolling restart, without stopping the server: each conn gets a goaway
+// frame, then keeps answering its requests (pipelined ones and those still
+// arriving) for GoAwayGrace. After it idle conns are closed and a request is
+// answered with errors.StatusGoingAway before the close.
+//
+// Conns accepted afterwards are not affected. Shutdown during the grace
+// still closes idle conns at once, and its ctx (DrainTimeout for
+// ServeContext) bounds the wait whatever is left of the grace.
+func (srv *Server) GoAway() {
+	srv.connMutex.Lock()
+	conns := make([]*Conn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.connMutex.Unlock()
+
+	for _, c := range conns {
+		if atomic.CompareAndSwapInt64(&c.goAwayAt, 0, time.Now().UnixNano()) {
+			go c.sendGoAway() // 慢的客户端不拖住其他连接
+		}
+	}
+}
+
+func (srv *Server) goAwayGrace() time.Duration {
+	if srv.GoAwayGrace > 0 {
+		return srv.GoAwayGrace
+	}
+	return constant.DefaultGoAwayGrace
+}
+
+// goAwayDeadline is the read deadline of an idle conn after GoAway, zero if none was sent.
+func (c *Conn) goAwayDeadline() time.Time {
+	end := c.goAwayEnd()
+	if end.IsZero() {
+		return end
+	}
+	if linger := time.Now().Add(constant.GoAwayLinger); end.Before(linger) {
+		return linger
+	}
+	return end
+}
+
+// goAwayEnd is when the grace of a GoAway ends, zero if none was sent.
+func (c *Conn) goAwayEnd() time.Time {
+	at := atomic.LoadInt64(&c.goAwayAt)
+	if at == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, at).Add(c.server.goAwayGrace())
+}
+
+func (c *Conn) sendGoAway() {
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    constant.ActionGoAway,
+	}
+	if err := c.writeControl(header, nil); err != nil {
+		log.Debugf("conn[%v] %v: write goaway err: %v\n", c.Name, c.remoteAddr, err)
+	}
+
+	// 空闲的连接在grace结束时醒来关闭
+	c.idleMutex.Lock()
+	defer c.idleMutex.Unlock()
+	if c.idle {
+		_ = c.rwc.SetReadDeadline(c.goAwayDeadline())
+	}
+}
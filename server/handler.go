@@ -0,0 +1,191 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"github.com/brodyxchen/vsock-sdk/metadata"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"sync"
+	"time"
+)
+
+// HandlerConfig holds per path settings given at registration.
+type HandlerConfig struct {
+	// MaxConcurrency caps the requests of this path running at once, 0 is unlimited.
+	// Requests above the cap wait up to QueueTimeout for a slot, then get StatusServerBusy.
+	// Waiting requests get the slot by metadata.PriorityKey, high first; low
+	// priority requests don't wait and are rejected as soon as the path is full.
+	MaxConcurrency int
+	QueueTimeout   time.Duration
+
+	// DedupSize > 0 enables the idempotency cache: requests carrying the same
+	// metadata.IdempotencyKey get the response of the first one for DedupTTL
+	// (0 keeps it until evicted), the handler runs once. At most DedupSize keys
+	// are kept, least recently used first out. Ignored by HandleStream.
+	DedupSize int
+	DedupTTL  time.Duration
+
+	// ResponseSizeHint is the expected size of a marshaled response in bytes,
+	// responses are then marshaled into pooled buffers of that capacity
+	// instead of a new allocation each. For paths with known large
+	// responses, not used with DedupSize, CoalesceKey or by HandleStream.
+	ResponseSizeHint int
+
+	// CoalesceKey enables single flight: requests with the same non empty
+	// key arriving while the handler runs for one of them wait for it and
+	// share its response, errors included, instead of running it again. The
+	// key is computed from the request, e.g. the cache key of a read path, ""
+	// runs the request on its own. Ignored by HandleStream.
+	CoalesceKey func(ctx context.Context, req []byte) string
+
+	// MaxRequestBytes caps the marshaled request of this path below
+	// Server.MaxRequestBytes, e.g. for a key lookup taking tiny requests
+	// only. A larger one is answered with StatusRequestTooLarge before it is
+	// decoded; a chunked one as soon as its chunks pass the cap, the rest is
+	// discarded unread into memory. 0 keeps the server wide cap.
+	MaxRequestBytes int
+
+	// WriteTimeout replaces Server.WriteTimeout for the responses of this
+	// path, a SetWriteTimeout or metadata.WriteTimeoutKey override still wins.
+	WriteTimeout time.Duration
+
+	// Description, RequestType and ResponseType document the path for
+	// DescribeHandlers, e.g. "fetch a key" and "pb.GetReq"; never used to
+	// dispatch.
+	Description  string
+	RequestType  string
+	ResponseType string
+}
+
+type headerKey struct{}
+
+// HeaderFromContext returns the header of the request being handled, after
+// chunk reassembly. It is a copy, changing it does not affect the response.
+func HeaderFromContext(ctx context.Context) (models.Header, bool) {
+	header, ok := ctx.Value(headerKey{}).(models.Header)
+	return header, ok
+}
+
+// handlerEntry is immutable once registered, ReplaceHandler installs a new one.
+type handlerEntry struct {
+	path     string
+	fn       HandleContextFunc
+	streamFn StreamHandleFunc // set instead of fn by HandleStream
+	config   HandlerConfig
+	limiter  *pathLimiter // nil if unlimited
+	dedup    *dedupCache  // nil if not enabled
+	flight   *flightGroup // nil without CoalesceKey
+	health   bool         // RegisterHealth, answered in maintenance mode
+
+	rspBuffers *sync.Pool // *[]byte of ResponseSizeHint capacity, nil without hint
+
+	subscribeFn SubscribeFunc // set instead of fn by HandleSubscribe
+	subscribe   SubscribeConfig
+}
+
+// pathLimiter admits at most max requests at once. Waiting requests are
+// admitted high priority first, FIFO within a priority.
+type pathLimiter struct {
+	max int
+
+	mutex    sync.Mutex // 守护以下2个变量
+	inFlight int64
+	waiters  [3]*list.List // *limitWaiter per priority, low to high
+}
+
+type limitWaiter struct {
+	ready chan struct{} // closed once release handed the slot over
+}
+
+func newPathLimiter(maxConcurrency int) *pathLimiter {
+	if maxConcurrency <= 0 {
+		return nil
+	}
+	pl := &pathLimiter{max: maxConcurrency}
+	for i := range pl.waiters {
+		pl.waiters[i] = list.New()
+	}
+	return pl
+}
+
+// acquire takes a slot, waiting at most timeout, false if the path stays
+// busy. A low priority request doesn't wait, it is shed at once.
+func (pl *pathLimiter) acquire(ctx context.Context, timeout time.Duration, priority metadata.Priority) bool {
+	pl.mutex.Lock()
+	if pl.inFlight < int64(pl.max) {
+		pl.inFlight++
+		pl.mutex.Unlock()
+		return true
+	}
+	if timeout <= 0 || priority == metadata.PriorityLow {
+		pl.mutex.Unlock()
+		return false
+	}
+	waiter := &limitWaiter{ready: make(chan struct{})}
+	queue := pl.waiters[priorityIndex(priority)]
+	elem := queue.PushBack(waiter)
+	pl.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	select {
+	case <-waiter.ready:
+		// 超时的同时被交接了名额, 直接使用
+		return true
+	default:
+	}
+	queue.Remove(elem)
+	return false
+}
+
+func (pl *pathLimiter) release() {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	for i := len(pl.waiters) - 1; i >= 0; i-- {
+		if front := pl.waiters[i].Front(); front != nil {
+			// 名额直接交给优先级最高的等待者, inFlight不变
+			pl.waiters[i].Remove(front)
+			close(front.Value.(*limitWaiter).ready)
+			return
+		}
+	}
+	pl.inFlight--
+}
+
+func (pl *pathLimiter) InFlight() int64 {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	return pl.inFlight
+}
+
+func priorityIndex(priority metadata.Priority) int {
+	switch {
+	case priority < metadata.PriorityNormal:
+		return 0
+	case priority > metadata.PriorityNormal:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func newResponseBuffers(sizeHint int) *sync.Pool {
+	if sizeHint <= 0 {
+		return nil
+	}
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, 0, sizeHint)
+			return &buf
+		},
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+
+	"github.com/brodyxchen/vsock-sdk/protocols"
+)
+
+// RegisterHealth installs a handler at path answering a protocols.Health,
+// so probes can use a normal Call and decode it with protocols.UnmarshalHealth.
+// It is answered in maintenance mode as well, reporting HealthMaintenance.
+func (srv *Server) RegisterHealth(path string) error {
+	entry := &handlerEntry{
+		path:   path,
+		health: true,
+		fn: func(ctx context.Context, req []byte) ([]byte, error) {
+			return srv.Health().Marshal(), nil
+		},
+	}
+
+	return srv.register(entry)
+}
+
+// Health reports the state a load balancer should route by.
+func (srv *Server) Health() *protocols.Health {
+	srv.ready()
+	health := &protocols.Health{
+		Status:         protocols.HealthReady,
+		AliveConns:     srv.connsHist.Count(),
+		InFlight:       int64(len(srv.InFlight())),
+		MaxConnections: int64(srv.maxConnections()),
+	}
+	switch {
+	case srv.shuttingDown():
+		health.Status = protocols.HealthDraining
+	case srv.maintenanceStatus() != nil:
+		health.Status = protocols.HealthMaintenance
+	case srv.overloaded():
+		health.Status = protocols.HealthOverloaded
+	}
+	return health
+}
+
+func (srv *Server) overloaded() bool {
+	if max := srv.maxConnections(); max > 0 && srv.connsHist.Count() >= int64(max) {
+		return true
+	}
+	srv.mutex.RLock()
+	defer srv.mutex.RUnlock()
+	for _, entry := range srv.handlers {
+		if entry.limiter != nil && entry.limiter.InFlight() >= int64(entry.limiter.max) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/client"
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/socket"
+	"github.com/brodyxchen/vsock-sdk/statistics"
+	"github.com/mdlayher/vsock"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestServer() *Server {
+	return newTestServerWith(nil)
+}
+
+// newTestServerWith lets configure set the fields read at Init.
+func newTestServerWith(configure func(srv *Server)) *Server {
+	statistics.InitServer()
+
+	srv := &Server{
+		Addr:         &models.HttpAddr{IP: "127.0.0.1"},
+		ReadTimeout:  time.Second * 5,
+		WriteTimeout: time.Second * 10,
+		IdleTimeout:  time.Minute,
+	}
+	if configure != nil {
+		configure(srv)
+	}
+	srv.Init()
+	return srv
+}
+
+// startTestServer serves srv on a loopback tcp listener until the test ends.
+func startTestServer(tb testing.TB, srv *Server) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { closeTestServer(srv, ln) })
+
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return ln.Addr()
+}
+
+// closeTestServer stops accepting without waiting for the conns, so the
+// listener close is not logged as an accept failure.
+func closeTestServer(srv *Server, ln net.Listener) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = srv.Shutdown(ctx)
+	_ = ln.Close()
+}
+
+func newTestClient(cfg *client.Config) *client.Client {
+	statistics.InitClient()
+
+	cli := &client.Client{
+		Timeout: cfg.GetTimeout(),
+	}
+	cli.Init(cfg)
+	return cli
+}
+
+// mockListener hands out conns pushed by the test.
+type mockListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newMockListener() *mockListener {
+	return &mockListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (ln *mockListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (ln *mockListener) Close() error {
+	ln.once.Do(func() { close(ln.done) })
+	return nil
+}
+
+func (ln *mockListener) Addr() net.Addr {
+	return &vsock.Addr{ContextID: vsock.Host, Port: 1024}
+}
+
+// dial pushes the server side of a pipe whose peer claims remoteAddr.
+func (ln *mockListener) dial(remoteAddr net.Addr) net.Conn {
+	server, client := net.Pipe()
+	ln.conns <- &addrConn{Conn: server, remoteAddr: remoteAddr}
+	return client
+}
+
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// startMemServer serves srv on an in-memory listener until the test ends,
+// conns come from ln.dial.
+func startMemServer(tb testing.TB, srv *Server) *mockListener {
+	ln := newMockListener()
+	tb.Cleanup(func() { closeTestServer(srv, ln) })
+
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return ln
+}
+
+// modelsAddr converts a listener address for the client.
+func modelsAddr(addr net.Addr) models.Addr {
+	tcpAddr := addr.(*net.TCPAddr)
+	return &models.HttpAddr{
+		IP:   tcpAddr.IP.String(),
+		Port: uint32(tcpAddr.Port),
+	}
+}
+
+// testConn speaks the raw frame protocol, so tests can pipeline or misbehave.
+type testConn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	version uint16 // Header.Version of the requests, constant.DefaultVersion if 0
+}
+
+func dialTestConn(tb testing.TB, addr net.Addr) *testConn {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	return wrapTestConn(conn)
+}
+
+func wrapTestConn(conn net.Conn) *testConn {
+	return &testConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+// queue buffers a request frame without flushing it.
+func (tc *testConn) queue(req *protocols.Request) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+	}
+	if tc.version != 0 {
+		header.Version = tc.version
+	}
+	_, err = socket.WriteFrame(context.Background(), tc.writer, header, body)
+	return err
+}
+
+func (tc *testConn) send(req *protocols.Request) error {
+	if err := tc.queue(req); err != nil {
+		return err
+	}
+	return tc.writer.Flush()
+}
+
+// receive reads one frame, pb is nil for status frames (header.Code != 0).
+func (tc *testConn) receive() (*models.Header, *protocols.Response, []byte, error) {
+	header, body, _, err := socket.ReadSocket(context.Background(), tc.reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if header.Code != 0 {
+		return header, nil, body, nil
+	}
+	var rsp protocols.Response
+	if err := proto.Unmarshal(body, &rsp); err != nil {
+		return nil, nil, nil, err
+	}
+	return header, &rsp, body, nil
+}
+
+// checkGoroutines fails the test if goroutines started during it are still
+// running at its end, call it first so the server and conns are cleaned up
+// before the check runs.
+func checkGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(time.Second * 2)
+		for {
+			after := runtime.NumGoroutine()
+			if after <= before {
+				return
+			}
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Fatalf("%v goroutines leaked (%v serve loops):\n%s", after-before, serveLoops(buf), buf)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+}
+
+// serveLoops counts the Conn.serve goroutines in a runtime.Stack dump.
+func serveLoops(stacks []byte) int {
+	return strings.Count(string(stacks), "server.(*Conn).serve(")
+}
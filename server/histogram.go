@@ -0,0 +1,40 @@
+package server
+
+import (
+	"github.com/brodyxchen/vsock-sdk/statistics"
+	"github.com/brodyxchen/vsock-sdk/statistics/metrics"
+)
+
+// Histogram receives the latency (ms) and size samples of the server, see
+// Server.NewHistogram. It must be safe for concurrent use. One also having a
+// Clear() method is emptied by Server.ResetStats.
+type Histogram interface {
+	Observe(value int64)
+
+	// Distribution summarizes the samples so far for Stats.
+	Distribution() Distribution
+}
+
+// sampleHistogram is the default Histogram over a metrics.Histogram.
+type sampleHistogram struct {
+	metrics.Histogram
+}
+
+func (sh sampleHistogram) Observe(value int64) {
+	sh.Update(value)
+}
+
+func (sh sampleHistogram) Distribution() Distribution {
+	return newDistribution(sh.Histogram)
+}
+
+// histogram creates the histogram of the statistic name with NewHistogram,
+// or a sampled one registered in statistics.ServerReg.
+func (srv *Server) histogram(name string) Histogram {
+	if srv.NewHistogram != nil {
+		return srv.NewHistogram(name)
+	}
+	h := srv.newHistogram()
+	_ = statistics.ServerReg.Register(name, h)
+	return sampleHistogram{h}
+}
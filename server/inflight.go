@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/metadata"
+)
+
+// RequestInfo describes a request whose handler is running.
+type RequestInfo struct {
+	ID         string // metadata.RequestIDKey of the client, generated if absent
+	Path       string
+	RemoteAddr string // vsock peers show their CID, e.g. "vm(3):1024"
+	ConnName   int64
+	Start      time.Time
+	Elapsed    time.Duration
+
+	// Progress of a stream handler response, all zero for other handlers and
+	// until the handler returned. StreamReading tells a stuck transfer waiting
+	// for the handler's reader from one waiting for the client to consume.
+	// A file body sent with sendfile jumps to StreamLength at once.
+	StreamLength  int
+	StreamWritten int64
+	StreamReading bool
+
+	ConnPendingWrite int64 // ConnStats.PendingWrite of the request's conn
+}
+
+type inflightRequest struct {
+	info     RequestInfo
+	conn     *Conn
+	cancel   context.CancelFunc
+	progress *streamProgress // nil unless a stream handler
+}
+
+// streamProgress is updated by responseStream as the chunks are written.
+type streamProgress struct {
+	length  int64 // atomic visit
+	written int64 // atomic visit
+	reading int32 // atomic visit
+}
+
+func (sp *streamProgress) start(length int) {
+	if sp != nil {
+		atomic.StoreInt64(&sp.length, int64(length))
+	}
+}
+
+func (sp *streamProgress) wrote(n int) {
+	if sp != nil {
+		atomic.AddInt64(&sp.written, int64(n))
+	}
+}
+
+func (sp *streamProgress) setReading(reading bool) {
+	if sp == nil {
+		return
+	}
+	value := int32(0)
+	if reading {
+		value = 1
+	}
+	atomic.StoreInt32(&sp.reading, value)
+}
+
+// inflightRegistry tracks the running handlers for InFlight and Cancel.
+type inflightRegistry struct {
+	mutex    sync.Mutex
+	requests map[string]*inflightRequest
+	byConn   map[*Conn]map[string]*inflightRequest // requests indexed by conn, for cancelConn
+	seq      int64                                 // atomic visit
+}
+
+// track registers a request, the returned func removes it again.
+func (ir *inflightRegistry) track(conn *Conn, info RequestInfo, cancel context.CancelFunc, progress *streamProgress) func() {
+	seq := atomic.AddInt64(&ir.seq, 1)
+	if info.ID == "" {
+		info.ID = strconv.FormatInt(info.ConnName, 10) + "-" + strconv.FormatInt(seq, 10)
+	}
+
+	ir.mutex.Lock()
+	defer ir.mutex.Unlock()
+	if ir.requests == nil {
+		ir.requests = make(map[string]*inflightRequest)
+		ir.byConn = make(map[*Conn]map[string]*inflightRequest)
+	}
+	// 同一个id同时出现多次时加后缀区分
+	if _, ok := ir.requests[info.ID]; ok {
+		info.ID += "#" + strconv.FormatInt(seq, 10)
+	}
+	request := &inflightRequest{info: info, conn: conn, cancel: cancel, progress: progress}
+	ir.requests[info.ID] = request
+	connRequests := ir.byConn[conn]
+	if connRequests == nil {
+		connRequests = make(map[string]*inflightRequest)
+		ir.byConn[conn] = connRequests
+	}
+	connRequests[info.ID] = request
+
+	id := info.ID
+	return func() {
+		ir.mutex.Lock()
+		defer ir.mutex.Unlock()
+		delete(ir.requests, id)
+		delete(connRequests, id)
+		if len(connRequests) == 0 {
+			delete(ir.byConn, conn)
+		}
+	}
+}
+
+// cancelConn cancels the contexts of the running requests of conn.
+func (ir *inflightRegistry) cancelConn(conn *Conn) {
+	ir.mutex.Lock()
+	defer ir.mutex.Unlock()
+	for _, request := range ir.byConn[conn] {
+		request.cancel()
+	}
+}
+
+// InFlight lists the requests whose handler is running, in no particular order.
+func (srv *Server) InFlight() []RequestInfo {
+	ir := &srv.inflight
+	ir.mutex.Lock()
+	defer ir.mutex.Unlock()
+
+	now := time.Now()
+	infos := make([]RequestInfo, 0, len(ir.requests))
+	for _, request := range ir.requests {
+		info := request.info
+		info.Elapsed = now.Sub(info.Start)
+		info.ConnPendingWrite = atomic.LoadInt64(&request.conn.pendingWrite)
+		if sp := request.progress; sp != nil {
+			info.StreamLength = int(atomic.LoadInt64(&sp.length))
+			info.StreamWritten = atomic.LoadInt64(&sp.written)
+			info.StreamReading = atomic.LoadInt32(&sp.reading) != 0
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Cancel cancels the context of the running request with requestID, as listed
+// by InFlight. Only handlers watching ctx stop, false if no such request.
+func (srv *Server) Cancel(requestID string) bool {
+	ir := &srv.inflight
+	ir.mutex.Lock()
+	request, ok := ir.requests[requestID]
+	ir.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	request.cancel()
+	return true
+}
+
+func requestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return md.Get(metadata.RequestIDKey)
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"github.com/brodyxchen/vsock-sdk/errors"
+)
+
+// SetMaintenanceMode answers every request with the status code/message
+// without dispatching it while on, conns stay open and keep-alive goes on
+// as usual. Rejections are counted in "srv.maintenance.rejected".
+func (srv *Server) SetMaintenanceMode(on bool, code uint16, message string) {
+	if !on {
+		srv.maintenance.Store((*errors.Status)(nil))
+		return
+	}
+	srv.maintenance.Store(errors.NewStatus(code, message))
+}
+
+// maintenanceStatus returns the status to reject with, nil if not in maintenance.
+func (srv *Server) maintenanceStatus() *errors.Status {
+	status, _ := srv.maintenance.Load().(*errors.Status)
+	return status
+}
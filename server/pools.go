@@ -6,37 +6,95 @@ import (
 	"sync"
 )
 
+// Buffers are pooled in size tiers, so a few huge messages don't make
+// every pooled buffer huge and tiny ones don't grow a buffer each time.
+// A buffer goes back to the tier of its capacity.
 var (
-	bufReaderPool sync.Pool
-	bufWriterPool sync.Pool
+	bufTiers  = []int{4 << 10, 16 << 10, 64 << 10}
+	bodyTiers = []int{1 << 10, 8 << 10, 64 << 10}
+
+	bufReaderPools = make([]sync.Pool, len(bufTiers))
+	bufWriterPools = make([]sync.Pool, len(bufTiers))
+	bodyPools      = make([]sync.Pool, len(bodyTiers))
 )
 
-func getBufReader(r io.Reader) *bufio.Reader {
-	if v := bufReaderPool.Get(); v != nil {
+// tierOf returns the smallest tier holding size, the largest if none does.
+func tierOf(tiers []int, size int) int {
+	for i, tierSize := range tiers {
+		if size <= tierSize {
+			return i
+		}
+	}
+	return len(tiers) - 1
+}
+
+// exactTier returns the tier of exactly size, -1 if size is not a tier size.
+func exactTier(tiers []int, size int) int {
+	for i, tierSize := range tiers {
+		if size == tierSize {
+			return i
+		}
+	}
+	return -1
+}
+
+// getBufReader returns a reader of the tier for size, 0 is the smallest.
+func getBufReader(r io.Reader, size int) *bufio.Reader {
+	tier := tierOf(bufTiers, size)
+	if v := bufReaderPools[tier].Get(); v != nil {
 		br := v.(*bufio.Reader)
 		br.Reset(r)
 		return br
 	}
-	// Note: if this reader size is ever changed, update
-	// TestHandlerBodyClose's assumptions.
-	return bufio.NewReader(r)
+	return bufio.NewReaderSize(r, bufTiers[tier])
 }
 
 func putBufReader(br *bufio.Reader) {
+	tier := exactTier(bufTiers, br.Size())
+	if tier < 0 {
+		return
+	}
 	br.Reset(nil)
-	bufReaderPool.Put(br)
+	bufReaderPools[tier].Put(br)
 }
 
-func getBufWriter(w io.Writer) *bufio.Writer {
-	if v := bufWriterPool.Get(); v != nil {
+func getBufWriter(w io.Writer, size int) *bufio.Writer {
+	tier := tierOf(bufTiers, size)
+	if v := bufWriterPools[tier].Get(); v != nil {
 		bw := v.(*bufio.Writer)
 		bw.Reset(w)
 		return bw
 	}
-	return bufio.NewWriter(w)
+	return bufio.NewWriterSize(w, bufTiers[tier])
 }
 
 func putBufWriter(bw *bufio.Writer) {
+	tier := exactTier(bufTiers, bw.Size())
+	if tier < 0 {
+		return
+	}
 	bw.Reset(nil)
-	bufWriterPool.Put(bw)
+	bufWriterPools[tier].Put(bw)
+}
+
+// getBody returns a request body buffer of length n.
+func getBody(n int) []byte {
+	tier := tierOf(bodyTiers, n)
+	if n > bodyTiers[tier] {
+		return make([]byte, n)
+	}
+	if v := bodyPools[tier].Get(); v != nil {
+		return (*v.(*[]byte))[:n]
+	}
+	return make([]byte, n, bodyTiers[tier])
+}
+
+// putBody returns a buffer of getBody, the caller must not keep any reference to it.
+func putBody(body []byte) {
+	tier := exactTier(bodyTiers, cap(body))
+	if tier < 0 {
+		return
+	}
+	body = body[:0]
+	bodyPools[tier].Put(&body)
 }
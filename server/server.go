@@ -2,11 +2,17 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
 	"github.com/brodyxchen/vsock-sdk/log"
+	"github.com/brodyxchen/vsock-sdk/metadata"
 	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
 	"github.com/brodyxchen/vsock-sdk/statistics"
 	"github.com/brodyxchen/vsock-sdk/statistics/metrics"
 	"github.com/mdlayher/vsock"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -15,23 +21,253 @@ import (
 
 type handleFunc func([]byte) ([]byte, error)
 
+// HandleContextFunc is a handler that also receives the request context,
+// which carries the metadata sent by the client (see metadata.FromIncomingContext).
+type HandleContextFunc func(ctx context.Context, req []byte) ([]byte, error)
+
 type Server struct {
 	Addr models.Addr
 
-	handlers map[string]handleFunc
+	// handlers is guarded by mutex: a registration or swap happens-before
+	// every getHandler that follows it.
+	handlers map[string]*handlerEntry
 	mutex    sync.RWMutex
 
+	// MaxPaths caps the registered paths, a registration beyond it fails
+	// with errors.ErrTooManyPaths, to catch runaway dynamic registration.
+	// 0 means unlimited.
+	MaxPaths int
+
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	IdleTimeout  time.Duration
 
+	// FirstByteTimeout bounds the wait for the first byte of a new conn, TLS
+	// handshake included, so conns that connect and stall are dropped long
+	// before IdleTimeout. 0 leaves the first wait under IdleTimeout.
+	FirstByteTimeout time.Duration
+
+	// HeaderReadTimeout bounds completing a frame header once its first byte
+	// arrived, keep it shorter than ReadTimeout so a stalling client is
+	// dropped early. 0 leaves the header under ReadTimeout.
+	HeaderReadTimeout time.Duration
+
+	// HandlerTimeout bounds the handler context, the client's remaining
+	// deadline applies as well, whichever is earlier wins.
+	HandlerTimeout time.Duration
+
+	// SlowRequestThreshold logs the requests taking longer, from reading to
+	// writing the response, with their sizes and source CID. 0 logs none,
+	// UpdateConfig changes it while serving.
+	SlowRequestThreshold time.Duration
+
+	// WriteCoalescing lets responses to pipelined requests share one flush,
+	// FlushInterval bounds how long a coalesced response may wait in the
+	// write buffer (0 waits until the pipeline is drained).
+	WriteCoalescing bool
+	FlushInterval   time.Duration
+
+	// CoalesceMaxBytes flushes coalesced responses once this many bytes are
+	// buffered, trading fewer writes against the latency of the first ones.
+	// 0 flushes only when the write buffer is full (WriteBufferSize).
+	CoalesceMaxBytes int
+
+	// WriteQueue is how many frames produced outside the serve goroutine,
+	// pushes and GoAway, may wait for the per conn writer goroutine, see
+	// WriteQueuePolicy for a full queue. 0 writes them inline under the
+	// write lock instead.
+	WriteQueue       int
+	WriteQueuePolicy WriteQueuePolicy
+
+	// StrictEmptyResponse makes a handler returning (nil, nil) fail with
+	// StatusEmptyResponse instead of an OK response with empty Rsp, to catch
+	// accidental empty returns. A non-nil empty slice is always a valid
+	// empty response. Off by default.
+	StrictEmptyResponse bool
+
+	// MaxRequestBytes caps the reassembled body of a chunked request,
+	// constant.DefaultMaxRequestBytes if 0. Single frame requests are below 64KB anyway.
+	MaxRequestBytes int
+
+	// MaxPathLength caps Request.Path in bytes, a longer one is answered
+	// with StatusInvalidPath before the lookup and not logged.
+	// constant.DefaultMaxPathLength if 0.
+	MaxPathLength int
+
+	// Signer enables request signing: a request body without the HMAC of
+	// the client's Signer (same key and hash) is answered with
+	// StatusSignatureInvalid before any handler, and the responses are
+	// signed for the client to check. Stream responses are then hashed as
+	// they are written, a file body no longer goes out with sendfile.
+	Signer *protocols.Signer
+
+	// ChunkAssemblyTimeout bounds receiving all the chunks of a request once
+	// its first chunk arrived. On expiry the request is answered with
+	// StatusChunkTimeout and the conn closed, the chunks read so far are
+	// freed. 0 uses ReadTimeout, or constant.DefaultChunkTimeout without it.
+	ChunkAssemblyTimeout time.Duration
+
+	// ReadBufferSize/WriteBufferSize size the conn buffers, rounded up to a
+	// pool tier (4KB, 16KB, 64KB), default 4KB. Larger ones suit conns
+	// carrying mostly large messages.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// StreamChunkSize bounds each write of a streamed response, WriteTimeout applies per chunk.
+	StreamChunkSize int
+
+	// MaxFrameSize is the largest frame body the server is willing to
+	// receive, sent in answer to the ActionSettings frame of a client, which
+	// then splits its requests to fit. Larger frames are read and dropped and
+	// the request answered with StatusRequestTooLarge. The smaller of both
+	// sides also bounds the responses and pushes of the conn.
+	// constant.MaxFrameBodySize if 0.
+	MaxFrameSize int
+
 	DisableKeepAlives int32 // accessed atomically.
 
+	// KeepAlive decides after each response whether the conn stays open, e.g.
+	// false after a logout path. respCode is the protocols.Response.Code of a
+	// handler response (StatusOK, StatusErr or the errors.AppError code) and
+	// the status code of a status response; ctx is
+	// the handler context (already done, its values are kept), path is
+	// empty if the request didn't decode.
+	// Returning false closes the conn with ErrNoKeepAlive. nil keeps the
+	// DisableKeepAlives behavior, which is checked first anyway.
+	KeepAlive func(ctx context.Context, path string, respCode uint16) bool
+
+	// AcceptBackoffMin/Max bound the jittered backoff after a temporary accept
+	// error, it resets on the next successful accept. Defaults 5ms and 1s.
+	AcceptBackoffMin time.Duration
+	AcceptBackoffMax time.Duration
+
+	// MaxConnections caps the alive conns, accepts beyond it are closed. 0 means unlimited.
+	MaxConnections int
+
+	// MaxConnectionsPerCID caps the alive vsock conns of one source CID, so a
+	// single VM can't take all of MaxConnections. A conn beyond it is answered
+	// with StatusTooManyConnections and closed. 0 means unlimited.
+	MaxConnectionsPerCID int
+	cidConns             cidConns
+
+	config      atomic.Value // *Config, set by UpdateConfig
+	maintenance atomic.Value // *errors.Status, set by SetMaintenanceMode
+
+	// PingInterval: a conn idle this long is probed with a ping, and closed if
+	// nothing arrives within PingTimeout (defaults to PingInterval). 0 disables.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// DrainTimeout bounds the graceful shutdown of ServeContext once its ctx
+	// is done, constant.DefaultDrainTimeout if 0.
+	DrainTimeout time.Duration
+
+	// HandlerWorkers runs the handlers of all conns on this many goroutines,
+	// so CPU bound handlers can't outnumber the cores however many conns are
+	// busy; up to HandlerQueue requests (default HandlerWorkers) wait for a
+	// worker, beyond it they get StatusServerBusy. 0 runs each handler on the
+	// serve goroutine of its conn. Read when the server starts, see setup.
+	HandlerWorkers int
+	HandlerQueue   int
+	workers        *workerPool
+
+	// RetryAfter is the retry hint sent with the StatusServerBusy of a full
+	// worker queue or HandlerConfig.MaxConcurrency, clients wait that long
+	// before retrying. 0 sends no hint.
+	RetryAfter time.Duration
+
+	setupOnce sync.Once // setup, run by the first Serve, ServeConn, Stats or Shutdown
+
+	// GoAwayGrace is how long a conn keeps answering after GoAway before it
+	// is closed, constant.DefaultGoAwayGrace if 0.
+	GoAwayGrace time.Duration
+
+	// DecayingHistograms makes the latency and size histograms, and so the
+	// percentiles of Stats, weigh the last ~5 minutes of traffic (exponential
+	// decay, alpha 0.015) instead of a uniform sample since Init. Counts stay
+	// all time either way. Read when the server starts, see setup.
+	DecayingHistograms bool
+
+	// NewHistogram creates the latency and size histograms behind Stats
+	// instead of the sampled ones, e.g. to feed an HDR or Prometheus native
+	// histogram; they are then not registered in statistics.ServerReg. name
+	// is the statistic, like "srv.read.costMs". Read when the server starts,
+	// see setup.
+	NewHistogram func(name string) Histogram
+
+	// TCPKeepAlive enables OS level keepalive probes with this period on the
+	// accepted conns that support it (*net.TCPConn), catching half-open conns
+	// without app traffic. AF_VSOCK has no keepalive of its own, vsock and TLS
+	// conns are left as is: use PingInterval there. 0 leaves conns as accepted.
+	TCPKeepAlive time.Duration
+
+	// Verbose puts the reason of a request decode failure into the
+	// StatusInvalidRequest response, it is always logged. Meant for
+	// integration, keep it off in production to not leak internals.
+	Verbose bool
+
+	// DisablePanicRecovery lets a panic in a handler or in RunAfterResponse
+	// work crash the process with its original stack, instead of answering
+	// status 500 and closing the conn. Debugging only: in production a
+	// single bad request then takes down every conn of the server.
+	DisablePanicRecovery bool
+
+	// ConnFilter is called right after accept, before anything is read; a
+	// non-nil error closes the conn. Vsock conns report a *vsock.Addr, so the
+	// peer CID is remoteAddr.(*vsock.Addr).ContextID.
+	ConnFilter func(remoteAddr net.Addr) error
+
+	// ConnAuth authenticates a conn once, after the TLS handshake and before
+	// its first request is read: ctx carries TLSConnectionState, e.g. to map
+	// the client cert to a tenant. The returned metadata is kept for the life
+	// of the conn, handlers read it with ConnMetadata; an error closes the
+	// conn. It doesn't replace per request auth: a request still carries its
+	// own metadata, a handler needing both checks the request metadata
+	// against the conn's.
+	ConnAuth func(ctx context.Context, remoteAddr net.Addr) (metadata.MD, error)
+
+	// OnConnClose is called once a conn is closed, c.Stats() is final by
+	// then. err keeps its cause:
+	// errors.Is(err, io.EOF) means the peer closed cleanly.
+	OnConnClose func(c *Conn, err error)
+
+	// BackgroundWorkers caps the RunAfterResponse work running at once, 0 means
+	// GOMAXPROCS. Read when the server starts, see setup.
+	BackgroundWorkers int
+	background        *backgroundPool
+
+	// EventBuffer is the capacity of the Events channel,
+	// constant.DefaultEventBuffer if 0. Read at the first Events call.
+	EventBuffer   int
+	events        atomic.Value // chan Event, set by Events
+	eventsOnce    sync.Once
+	eventsDropped int64 // atomic visit
+
+	inflight inflightRegistry
+
+	inShutdown int32 // atomic visit, set by Shutdown
+	listeners  map[net.Listener]struct{}
+	lnMutex    sync.Mutex
+	conns      map[*Conn]struct{} // serving conns, for Shutdown to wake the idle ones
+	connMutex  sync.Mutex
+
 	connIndex int64 // atomic visit
+	tlsConns  int64 // atomic visit, alive conns over TLS
+
+	acceptHist Histogram
+	connsHist  metrics.Counter
+	readHist   Histogram
+	writeHist  Histogram
 
-	connsHist metrics.Counter
-	readHist  metrics.Histogram
-	writeHist metrics.Histogram
+	reqSizeHist Histogram
+	rspSizeHist Histogram
+
+	backgroundHist     metrics.Counter
+	backgroundFailHist metrics.Counter
+	maintenanceHist    metrics.Counter
+
+	connLifetimeHist Histogram
+	connRequestsHist Histogram
 }
 
 func (srv *Server) getConnIndex() int64 {
@@ -44,17 +280,139 @@ func (srv *Server) ShowConnIndex() int64 {
 }
 
 func (srv *Server) Init() {
-	srv.handlers = make(map[string]handleFunc, 0)
+	srv.handlers = make(map[string]*handlerEntry, 0)
 	srv.mutex = sync.RWMutex{}
+	srv.listeners = make(map[net.Listener]struct{})
+
+	backgroundHist := metrics.NewCounter()
+	backgroundFailHist := metrics.NewCounter()
+	_ = statistics.ServerReg.Register("srv.background.running", backgroundHist)
+	_ = statistics.ServerReg.Register("srv.background.failed", backgroundFailHist)
+	srv.backgroundHist = backgroundHist
+	srv.backgroundFailHist = backgroundFailHist
+
+	maintenanceHist := metrics.NewCounter()
+	_ = statistics.ServerReg.Register("srv.maintenance.rejected", maintenanceHist)
+	srv.maintenanceHist = maintenanceHist
+}
+
+// setup builds what depends on the settings a caller of NewServer can only
+// change after Init returned. It runs once, before the first conn is served.
+func (srv *Server) setup() {
+	// Serve多个listener时共用
+	srv.connsHist = metrics.NewCounter()
+	_ = statistics.ServerReg.Register("srv.alive.conns", srv.connsHist)
+	srv.acceptHist = srv.histogram("accept")
+	_ = statistics.ServerReg.Register("srv.hand", srv.newHistogram())
+	srv.readHist = srv.histogram("srv.read.costMs")
+	srv.writeHist = srv.histogram("srv.write.costMs")
+
+	// 请求/响应body大小(bytes), 用于容量规划
+	srv.reqSizeHist = srv.histogram("srv.req.bytes")
+	srv.rspSizeHist = srv.histogram("srv.rsp.bytes")
+
+	// 已关闭连接的存活时长和请求数, 用于调整keep-alive与连接数限制
+	srv.connLifetimeHist = srv.histogram("srv.conn.lifetimeMs")
+	srv.connRequestsHist = srv.histogram("srv.conn.requests")
+
+	srv.background = newBackgroundPool(srv.BackgroundWorkers)
+	if srv.HandlerWorkers > 0 {
+		srv.workers = newWorkerPool(srv.HandlerWorkers, srv.HandlerQueue)
+	}
+}
+
+func (srv *Server) ready() {
+	srv.setupOnce.Do(srv.setup)
+}
+
+// newHistogram samples all time, or the recent traffic with DecayingHistograms.
+func (srv *Server) newHistogram() metrics.Histogram {
+	if srv.DecayingHistograms {
+		return metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	}
+	return metrics.NewHistogram(metrics.NewUniformSample(1028))
+}
+
+// HandleFunc registers handleFn for path. Like every registration it fails
+// with errors.ErrDuplicatePath if path is already registered (use
+// ReplaceHandler to swap it), and with errors.ErrTooManyPaths beyond MaxPaths.
+func (srv *Server) HandleFunc(path string, handleFn handleFunc) error {
+	return srv.HandleContext(path, func(ctx context.Context, req []byte) ([]byte, error) {
+		return handleFn(req)
+	})
+}
+
+func (srv *Server) HandleContext(path string, handleFn HandleContextFunc) error {
+	return srv.HandleConfig(path, handleFn, nil)
+}
+
+// HandleConfig registers handleFn for path with per path settings, cfg may be nil.
+func (srv *Server) HandleConfig(path string, handleFn HandleContextFunc, cfg *HandlerConfig) error {
+	entry := &handlerEntry{
+		path: path,
+		fn:   handleFn,
+	}
+	if cfg != nil {
+		entry.config = *cfg
+		entry.limiter = newPathLimiter(cfg.MaxConcurrency)
+		entry.dedup = newDedupCache(cfg.DedupSize, cfg.DedupTTL)
+		entry.flight = newFlightGroup(cfg.CoalesceKey)
+		if entry.dedup == nil && entry.flight == nil {
+			entry.rspBuffers = newResponseBuffers(cfg.ResponseSizeHint)
+		}
+	}
+
+	return srv.register(entry)
+}
+
+// HandleStream registers a handler whose response body is read from an io.Reader
+// and written progressively, see StreamHandleFunc.
+func (srv *Server) HandleStream(path string, handleFn StreamHandleFunc, cfg *HandlerConfig) error {
+	entry := &handlerEntry{
+		path:     path,
+		streamFn: handleFn,
+	}
+	if cfg != nil {
+		entry.config = *cfg
+		entry.limiter = newPathLimiter(cfg.MaxConcurrency)
+	}
+
+	return srv.register(entry)
+}
+
+// register installs entry unless its path is taken or MaxPaths is reached.
+func (srv *Server) register(entry *handlerEntry) error {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if _, ok := srv.handlers[entry.path]; ok {
+		return fmt.Errorf("%w %q", errors.ErrDuplicatePath, entry.path)
+	}
+	if srv.MaxPaths > 0 && len(srv.handlers) >= srv.MaxPaths {
+		return fmt.Errorf("%w (%v) registering %q", errors.ErrTooManyPaths, srv.MaxPaths, entry.path)
+	}
+	srv.handlers[entry.path] = entry
+	return nil
 }
 
-func (srv *Server) HandleFunc(path string, handleFn handleFunc) {
+// ReplaceHandler atomically swaps the handler of a registered path while serving,
+// the path settings are kept. Requests already dispatched finish on the old
+// handler, requests looked up after ReplaceHandler returns run the new one.
+func (srv *Server) ReplaceHandler(path string, handleFn HandleContextFunc) error {
 	srv.mutex.Lock()
 	defer srv.mutex.Unlock()
-	srv.handlers[path] = handleFn
+	old, ok := srv.handlers[path]
+	if !ok {
+		return errors.ErrHandlerNotFound
+	}
+	entry := *old
+	entry.fn = handleFn
+	entry.streamFn = nil
+	entry.subscribeFn = nil
+	srv.handlers[path] = &entry
+	return nil
 }
 
-func (srv *Server) getHandler(path string) handleFunc {
+func (srv *Server) getHandler(path string) *handlerEntry {
 	srv.mutex.RLock()
 	defer srv.mutex.RUnlock()
 	handler, ok := srv.handlers[path]
@@ -65,103 +423,297 @@ func (srv *Server) getHandler(path string) handleFunc {
 }
 
 func (srv *Server) ListenAndServe() error {
-	var (
-		ln  net.Listener
-		err error
-	)
+	ln, err := listen(srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(ln)
+
+}
+
+// Listen returns the listener for "vsock://cid:port", "tcp://host:port" or
+// "unix:///path", the latter two are meant for tests and local development.
+func Listen(addr string) (net.Listener, error) {
+	adr, err := models.ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return listen(adr)
+}
 
-	switch adr := srv.Addr.(type) {
+func listen(addr models.Addr) (net.Listener, error) {
+	switch adr := addr.(type) {
 	case *models.VSockAddr:
-		ln, err = vsock.ListenContextID(adr.ContextId, adr.Port, nil)
+		return vsock.ListenContextID(adr.ContextId, adr.Port, nil)
 	case *models.HttpAddr:
-		ln, err = net.Listen("tcp", adr.GetAddr())
+		return net.Listen("tcp", adr.GetAddr())
+	case *models.UnixAddr:
+		return net.Listen("unix", adr.Path) // the socket file is removed on Close
+	default:
+		return nil, errors.ErrInvalidAddr
 	}
+}
+
+func (srv *Server) Serve(l net.Listener) error {
+	return srv.ServeVersions(l)
+}
+
+// ServeVersions is Serve accepting only frames whose Header.Version is one of
+// versions, none accepts any version. A frame of another version is answered
+// with StatusUnsupportedVersion and the conn is closed. Serve each listener
+// with its versions to run protocols side by side on the same handlers;
+// a handler that must tell them apart reads HeaderFromContext(ctx).Version.
+func (srv *Server) ServeVersions(l net.Listener, versions ...uint16) error {
+	return srv.serve(nil, l, versions)
+}
+
+// ServeContext serves l like Serve until ctx is done, then shuts the server
+// down gracefully and returns once drained: nil, or the Shutdown error when
+// DrainTimeout elapsed first. The values of ctx reach the handlers, and its
+// cancellation cancels the handler contexts of the requests in flight, their
+// responses are still written.
+func (srv *Server) ServeContext(ctx context.Context, l net.Listener) error {
+	done := make(chan struct{})
+	drained := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), srv.drainTimeout())
+			defer cancel()
+			drained <- srv.Shutdown(drainCtx)
+		case <-done:
+			close(drained)
+		}
+	}()
+
+	err := srv.serve(ctx, l, nil)
+	close(done)
+	if drainErr, ok := <-drained; ok {
+		return drainErr
+	}
+	return err
+}
 
+// ServeConn serves one already connected conn without a listener, e.g. an
+// inherited fd of socket activation or one end of a net.Pipe, exactly like an
+// accepted one: ConnFilter and the connection caps apply, OnConnClose and
+// Shutdown see it. It returns once the conn closed, with the reason it
+// closed. The values of ctx reach the handlers; once ctx is done the handler
+// contexts are cancelled and the conn is closed.
+func (srv *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	if srv.shuttingDown() {
+		_ = conn.Close()
+		return errors.ErrServerClosed
+	}
+	srv.ready()
+	c, err := srv.admit(ctx, conn, nil, false)
 	if err != nil {
 		return err
 	}
 
-	return srv.Serve(ln)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close(ctx.Err())
+		case <-stop:
+		}
+	}()
+	c.serve(valueOnly{ctx})
 
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	return c.closeErr
 }
 
-func (srv *Server) Serve(l net.Listener) error {
+// serve is the accept loop, parent is the ServeContext ctx or nil.
+func (srv *Server) serve(parent context.Context, l net.Listener, versions []uint16) error {
 	log.Debugf("srv.Serve(%v)...\n", srv.Addr.GetAddr())
 	defer l.Close()
+	srv.ready()
 	ctx := context.Background()
+	if parent != nil {
+		ctx = valueOnly{parent} // 读写不受parent取消影响, 关闭由Shutdown完成
+	}
 
-	var tempDelay time.Duration // how long to sleep on accept failure
+	if !srv.trackListener(l) {
+		return errors.ErrServerClosed
+	}
+	defer srv.untrackListener(l)
 
-	acceptHist := metrics.NewHistogram(metrics.NewUniformSample(1028))
-	_ = statistics.ServerReg.Register("accept", acceptHist)
-
-	connsHist := metrics.NewCounter()
-	readHist := metrics.NewHistogram(metrics.NewUniformSample(1028))
-	handleHist := metrics.NewHistogram(metrics.NewUniformSample(1028))
-	writeHist := metrics.NewHistogram(metrics.NewUniformSample(1028))
-	_ = statistics.ServerReg.Register("srv.alive.conns", connsHist)
-	_ = statistics.ServerReg.Register("srv.read.costMs", readHist)
-	_ = statistics.ServerReg.Register("srv.hand", handleHist)
-	_ = statistics.ServerReg.Register("srv.write.costMs", writeHist)
-	srv.connsHist = connsHist
-	srv.readHist = readHist
-	srv.writeHist = writeHist
+	var tempDelay time.Duration // how long to sleep on accept failure
 
 	for {
 		rw, err := l.Accept()
 		if err != nil {
+			// Shutdown关闭了listener, 属于正常退出
+			if srv.shuttingDown() {
+				return errors.ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				tempDelay = srv.sleep(tempDelay)
 				continue
 			}
+			log.Errorf("srv accept on %v err: %v\n", l.Addr(), err)
 			return err
 		}
 
 		acceptNow := time.Now()
-
-		connCtx := ctx
 		tempDelay = 0
 
-		c := srv.newConn(rw)
+		c, err := srv.admit(parent, rw, versions, true)
+		if err != nil {
+			continue
+		}
+		go c.serve(ctx)
+
+		srv.acceptHist.Observe(time.Since(acceptNow).Milliseconds())
+	}
+}
+
+// admit wraps an accepted rw in a Conn counted in AliveConns, or rejects it
+// with the reason: ConnFilter, MaxConnections or MaxConnectionsPerCID. A
+// rejected rw is closed, after the StatusTooManyConnections answer in the
+// background if async.
+func (srv *Server) admit(parent context.Context, rw net.Conn, versions []uint16, async bool) (*Conn, error) {
+	if srv.ConnFilter != nil {
+		if err := srv.ConnFilter(rw.RemoteAddr()); err != nil {
+			log.Debugf("srv reject conn from %v: %v\n", rw.RemoteAddr(), err)
+			_ = rw.Close()
+			return nil, err
+		}
+	}
 
-		srv.connsHist.Inc(1)
-		go c.serve(connCtx)
+	if max := srv.maxConnections(); max > 0 && srv.connsHist.Count() >= int64(max) {
+		log.Debugf("srv reject conn from %v: exceed max connections %v\n", rw.RemoteAddr(), max)
+		srv.emit(Event{Kind: EventOverload, RemoteAddr: rw.RemoteAddr().String()})
+		_ = rw.Close()
+		return nil, errors.ErrTooManyConns
+	}
 
-		acceptHist.Update(time.Since(acceptNow).Milliseconds())
+	srv.setKeepAlive(rw)
+	c := srv.newConn(rw)
+	c.versions = versions
+	c.parent = parent
+	if !srv.acquireCID(c) {
+		log.Debugf("srv reject conn from %v: exceed max connections per cid %v\n", rw.RemoteAddr(), srv.MaxConnectionsPerCID)
+		srv.emit(Event{
+			Kind:       EventOverload,
+			RemoteAddr: rw.RemoteAddr().String(),
+			Code:       errors.StatusTooManyConnections.Code(),
+			Err:        errors.StatusTooManyConnections,
+		})
+		if async {
+			go srv.reject(rw, errors.StatusTooManyConnections)
+		} else {
+			srv.reject(rw, errors.StatusTooManyConnections)
+		}
+		return nil, errors.StatusTooManyConnections
 	}
+
+	srv.connsHist.Inc(1)
+	return c, nil
 }
 
 // Create new connection from rwc.
 func (srv *Server) newConn(rwc net.Conn) *Conn {
+	srv.ready() // conn的统计依赖setup
 	index := srv.getConnIndex()
 	c := &Conn{
 		Name:   index,
 		server: srv,
 		rwc:    rwc,
+		openAt: time.Now(),
+		done:   make(chan struct{}),
 	}
 	return c
 }
 
+// keepAliveConn is implemented by *net.TCPConn.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+func (srv *Server) setKeepAlive(rwc net.Conn) {
+	if srv.TCPKeepAlive <= 0 {
+		return
+	}
+	kc, ok := rwc.(keepAliveConn)
+	if !ok {
+		return
+	}
+	if err := kc.SetKeepAlive(true); err != nil {
+		log.Debugf("srv set keepalive on %v err: %v\n", rwc.RemoteAddr(), err)
+		return
+	}
+	_ = kc.SetKeepAlivePeriod(srv.TCPKeepAlive)
+}
+
+func (srv *Server) drainTimeout() time.Duration {
+	if srv.DrainTimeout > 0 {
+		return srv.DrainTimeout
+	}
+	return constant.DefaultDrainTimeout
+}
+
+// valueOnly keeps the values of a context but never ends.
+type valueOnly struct {
+	context.Context
+}
+
+func (valueOnly) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valueOnly) Done() <-chan struct{}       { return nil }
+func (valueOnly) Err() error                  { return nil }
+
 func (srv *Server) doKeepAlives() bool {
 	return atomic.LoadInt32(&srv.DisableKeepAlives) == 0
 }
 
-func (srv *Server) idleTimeout() time.Duration {
-	if srv.IdleTimeout != 0 {
-		return srv.IdleTimeout
+func (srv *Server) keepAlive(ctx context.Context, path string, respCode uint16) bool {
+	if !srv.doKeepAlives() {
+		return false
 	}
-	return srv.ReadTimeout
+	return srv.KeepAlive == nil || srv.KeepAlive(ctx, path, respCode)
 }
 
+func (srv *Server) pingTimeout() time.Duration {
+	if srv.PingTimeout != 0 {
+		return srv.PingTimeout
+	}
+	return srv.PingInterval
+}
+
+// sleep backs off after a temporary accept error: the delay doubles from
+// AcceptBackoffMin up to AcceptBackoffMax, and the sleep is a random time in
+// [delay/2, delay] so server instances hitting the same condition don't retry in step.
 func (srv *Server) sleep(tempDelay time.Duration) time.Duration {
+	min, max := srv.acceptBackoff()
 	if tempDelay == 0 {
-		tempDelay = 5 * time.Millisecond
+		tempDelay = min
 	} else {
 		tempDelay *= 2
 	}
-	if max := 1 * time.Second; tempDelay > max {
+	if tempDelay > max {
 		tempDelay = max
 	}
-	time.Sleep(tempDelay)
+	half := tempDelay / 2
+	time.Sleep(half + time.Duration(rand.Int63n(int64(tempDelay-half)+1)))
 	return tempDelay
 }
+
+func (srv *Server) acceptBackoff() (time.Duration, time.Duration) {
+	min, max := srv.AcceptBackoffMin, srv.AcceptBackoffMax
+	if min <= 0 {
+		min = constant.AcceptBackoffMin
+	}
+	if max <= 0 {
+		max = constant.AcceptBackoffMax
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
@@ -0,0 +1,1334 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/client"
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/log"
+	"github.com/brodyxchen/vsock-sdk/metadata"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/socket"
+	"github.com/mdlayher/vsock"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestConnFilter(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	var seen []uint32
+	srv.ConnFilter = func(remoteAddr net.Addr) error {
+		cid := remoteAddr.(*vsock.Addr).ContextID
+		seen = append(seen, cid)
+		if cid != 3 {
+			return errors.New("cid not allowed")
+		}
+		return nil
+	}
+
+	ln := startMemServer(t, srv)
+
+	allowed := ln.dial(&vsock.Addr{ContextID: 3, Port: 5000})
+	defer allowed.Close()
+	denied := ln.dial(&vsock.Addr{ContextID: 4, Port: 5000})
+	defer denied.Close()
+
+	_ = denied.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := denied.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("denied conn should be closed, got %v", err)
+	}
+
+	tc := wrapTestConn(allowed)
+	if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	_, rsp, _, err := tc.receive()
+	if err != nil || string(rsp.Rsp) != "hi" {
+		t.Fatalf("allowed conn should be served: %v %v", rsp, err)
+	}
+
+	if len(seen) != 2 || seen[0] != 3 || seen[1] != 4 {
+		t.Fatalf("filter saw %v", seen)
+	}
+}
+
+func TestConnAuth(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleContext("whoami", func(ctx context.Context, req []byte) ([]byte, error) {
+		md := ConnMetadata(ctx)
+		return []byte(md.Get("tenant") + "/" + md.Get("user")), nil
+	})
+	srv.HandleContext("login", func(ctx context.Context, req []byte) ([]byte, error) {
+		SetConnMetadata(ctx, "user", string(req))
+		return nil, nil
+	})
+	var auths int64
+	srv.ConnAuth = func(ctx context.Context, remoteAddr net.Addr) (metadata.MD, error) {
+		atomic.AddInt64(&auths, 1)
+		switch remoteAddr.(*vsock.Addr).ContextID {
+		case 3:
+			return metadata.Pairs("tenant", "a"), nil
+		case 4:
+			return metadata.Pairs("tenant", "b"), nil
+		}
+		return nil, errors.New("unknown tenant")
+	}
+	ln := startMemServer(t, srv)
+
+	call := func(tc *testConn, path, req string) string {
+		if err := tc.send(&protocols.Request{Path: path, Req: []byte(req)}); err != nil {
+			t.Fatal(err)
+		}
+		_, rsp, _, err := tc.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(rsp.Rsp)
+	}
+	a := wrapTestConn(ln.dial(&vsock.Addr{ContextID: 3, Port: 5000}))
+	defer a.Close()
+	b := wrapTestConn(ln.dial(&vsock.Addr{ContextID: 4, Port: 5000}))
+	defer b.Close()
+
+	call(a, "login", "alice")
+	if got := call(a, "whoami", ""); got != "a/alice" {
+		t.Fatalf("expect a/alice, got %v", got)
+	}
+	if got := call(b, "whoami", ""); got != "b/" {
+		t.Fatalf("expect the metadata per conn, got %v", got)
+	}
+	if got := call(a, "whoami", ""); got != "a/alice" || atomic.LoadInt64(&auths) != 2 {
+		t.Fatalf("expect the identity cached for the conn, got %v after %v auths", got, auths)
+	}
+
+	denied := ln.dial(&vsock.Addr{ContextID: 5, Port: 5000})
+	defer denied.Close()
+	_ = denied.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := denied.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("conn failing auth should be closed, got %v", err)
+	}
+}
+
+// TestUpdateConfigWhileServing swaps the config under load. Run with -race.
+func TestUpdateConfigWhileServing(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			srv.UpdateConfig(Config{
+				ReadTimeout:  time.Second * time.Duration(1+i%3),
+				WriteTimeout: time.Second * time.Duration(1+i%2),
+				IdleTimeout:  time.Second * 10,
+			})
+			_ = srv.CurrentConfig()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	const conns, requests = 8, 50
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		tc := dialTestConn(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+					errs <- err
+					return
+				}
+				if _, rsp, _, err := tc.receive(); err != nil || string(rsp.Rsp) != "hi" {
+					errs <- errors.New("bad echo response")
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// 后续accept使用新的MaxConnections, 已有连接不受影响
+	srv.UpdateConfig(Config{ReadTimeout: time.Second, WriteTimeout: time.Second, MaxConnections: conns})
+	if got := srv.CurrentConfig().MaxConnections; got != conns {
+		t.Fatalf("MaxConnections = %v", got)
+	}
+	rejected := dialTestConn(t, addr)
+	_ = rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("conn above MaxConnections should be closed, got %v", err)
+	}
+}
+
+// syncBuffer collects log output written from server goroutines.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.buf.String()
+}
+
+func captureLog(t *testing.T) *syncBuffer {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	t.Cleanup(func() { log.SetOutput(os.Stdout) })
+	return out
+}
+
+func TestShutdownClosesListenerQuietly(t *testing.T) {
+	out := captureLog(t)
+
+	srv := newTestServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+	time.Sleep(time.Millisecond * 20) // 等待Serve开始accept
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != errors.ErrServerClosed {
+		t.Fatalf("Serve should return ErrServerClosed, got %v", err)
+	}
+	if logged := out.String(); strings.Contains(logged, "accept") {
+		t.Fatalf("spurious accept error logged: %q", logged)
+	}
+	if err := srv.Serve(ln); err != errors.ErrServerClosed {
+		t.Fatalf("Serve after Shutdown should return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestListenerCloseLogged(t *testing.T) {
+	out := captureLog(t)
+
+	srv := newTestServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+	time.Sleep(time.Millisecond * 20)
+
+	_ = ln.Close() // 不是Shutdown触发, 属于真正的accept失败
+	if err := <-served; err == nil || err == errors.ErrServerClosed {
+		t.Fatalf("Serve should return the accept error, got %v", err)
+	}
+	if logged := out.String(); !strings.Contains(logged, "accept") {
+		t.Fatalf("accept failure should be logged, got %q", logged)
+	}
+}
+
+func TestSlowRequestLogged(t *testing.T) {
+	out := captureLog(t)
+
+	srv := newTestServer()
+	srv.SlowRequestThreshold = time.Millisecond * 30
+	srv.HandleFunc("slow", func(req []byte) ([]byte, error) {
+		time.Sleep(time.Millisecond * 50)
+		return []byte("done"), nil
+	})
+	srv.HandleFunc("fast", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := modelsAddr(startTestServer(t, srv))
+	cli := newTestClient(&client.Config{})
+
+	// 同一个连接按顺序处理, 最后一个请求返回时前面的日志都已写出
+	calls := func(paths ...string) {
+		for _, path := range append(paths, "fast") {
+			if _, err := cli.Call(context.Background(), addr, path, []byte("abc")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	calls("fast", "slow")
+	logged := out.String()
+	if strings.Count(logged, "slow request") != 1 || !strings.Contains(logged, `path="slow"`) ||
+		!strings.Contains(logged, "req=") || !strings.Contains(logged, "rsp=") {
+		t.Fatalf("expect the slow request logged once, got %q", logged)
+	}
+	if strings.Contains(logged, `path="fast"`) {
+		t.Fatalf("fast request logged: %q", logged)
+	}
+
+	cfg := srv.CurrentConfig()
+	cfg.SlowRequestThreshold = 0
+	srv.UpdateConfig(cfg)
+	calls("slow")
+	if logged := out.String(); strings.Count(logged, "slow request") != 1 {
+		t.Fatalf("expect no log once the threshold is off, got %q", logged)
+	}
+}
+
+func TestShutdownAnswersPipelined(t *testing.T) {
+	srv := newTestServer()
+	started := make(chan struct{}, 1)
+	srv.HandleFunc("slow", func(req []byte) ([]byte, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		time.Sleep(time.Millisecond * 20)
+		return req, nil
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	const count = 5
+	for i := 0; i < count; i++ {
+		if err := tc.queue(&protocols.Request{Path: "slow", Req: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	for i := 0; i < count; i++ {
+		_, rsp, _, err := tc.receive()
+		if err != nil {
+			t.Fatalf("response %v lost: %v", i, err)
+		}
+		if len(rsp.Rsp) != 1 || rsp.Rsp[0] != byte(i) {
+			t.Fatalf("response %v out of order: %v", i, rsp.Rsp)
+		}
+	}
+	if _, err := tc.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("conn should be closed after the pipeline, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServeGoroutinesExit runs conns through every way a serve loop ends and
+// checks none of their goroutines is left behind.
+func TestServeGoroutinesExit(t *testing.T) {
+	checkGoroutines(t)
+	_ = captureLog(t) // panic stacks
+
+	srv := newTestServer()
+	srv.IdleTimeout = time.Millisecond * 50
+	srv.WriteCoalescing = true
+	srv.FlushInterval = time.Millisecond
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	srv.HandleFunc("panic", func(req []byte) ([]byte, error) {
+		panic("handler panic")
+	})
+	srv.HandleContext("after", func(ctx context.Context, req []byte) ([]byte, error) {
+		RunAfterResponse(ctx, func(ctx context.Context) error {
+			return errors.New("background failure")
+		})
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+
+	lifecycles := map[string]func(tc *testConn){
+		"normal close": func(tc *testConn) {
+			_ = tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")})
+			_, _, _, _ = tc.receive()
+			_ = tc.Close()
+		},
+		"idle timeout": func(tc *testConn) {
+			_ = tc.SetReadDeadline(time.Now().Add(time.Second))
+			_, _ = tc.reader.ReadByte()
+		},
+		"client abort mid frame": func(tc *testConn) {
+			_, _ = tc.Write([]byte{0x16, 0x17, 0, 1})
+			_ = tc.Close()
+		},
+		"pipelined abort": func(tc *testConn) {
+			for i := 0; i < 8; i++ {
+				_ = tc.queue(&protocols.Request{Path: "echo", Req: []byte("hi")})
+			}
+			_ = tc.writer.Flush()
+			_ = tc.Close()
+		},
+		"panic": func(tc *testConn) {
+			_ = tc.send(&protocols.Request{Path: "panic"})
+			_, _, _, _ = tc.receive()
+			_ = tc.Close()
+		},
+		"background work": func(tc *testConn) {
+			_ = tc.send(&protocols.Request{Path: "after"})
+			_, _, _, _ = tc.receive()
+			_ = tc.Close()
+		},
+		"bad magic": func(tc *testConn) {
+			_, _ = tc.Write(make([]byte, 16))
+			_ = tc.Close()
+		},
+	}
+	for name, lifecycle := range lifecycles {
+		for i := 0; i < 5; i++ {
+			conn, err := net.Dial("tcp", addr.String())
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			lifecycle(wrapTestConn(conn))
+			_ = conn.Close()
+		}
+	}
+
+	// 关闭中仍连着的连接
+	open := dialTestConn(t, addr)
+	_ = open.send(&protocols.Request{Path: "echo", Req: []byte("hi")})
+	_, _, _, _ = open.receive()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeVersions(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleContext("version", func(ctx context.Context, req []byte) ([]byte, error) {
+		header, _ := HeaderFromContext(ctx)
+		return []byte{byte(header.Version)}, nil
+	})
+
+	listen := func(versions ...uint16) net.Addr {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { closeTestServer(srv, ln) })
+		go func() {
+			_ = srv.ServeVersions(ln, versions...)
+		}()
+		return ln.Addr()
+	}
+	v1, v2 := listen(1), listen(2)
+
+	for _, cs := range []struct {
+		addr    net.Addr
+		version uint16
+		code    uint16
+	}{
+		{v1, 1, 0},
+		{v2, 2, 0},
+		{v1, 2, errors.StatusUnsupportedVersion.Code()},
+		{v2, 1, errors.StatusUnsupportedVersion.Code()},
+	} {
+		tc := dialTestConn(t, cs.addr)
+		tc.version = cs.version
+		if err := tc.send(&protocols.Request{Path: "version"}); err != nil {
+			t.Fatal(err)
+		}
+		header, rsp, _, err := tc.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Code != cs.code {
+			t.Fatalf("version %v on %v: code %v, want %v", cs.version, cs.addr, header.Code, cs.code)
+		}
+		if cs.code != 0 {
+			// 版本不符后连接被关闭
+			if _, _, _, err := tc.receive(); err == nil {
+				t.Fatal("conn still open after unsupported version")
+			}
+			continue
+		}
+		if len(rsp.Rsp) != 1 || uint16(rsp.Rsp[0]) != cs.version {
+			t.Fatalf("handler saw version %v, want %v", rsp.Rsp, cs.version)
+		}
+	}
+}
+
+func TestMaxConnectionsPerCID(t *testing.T) {
+	srv := newTestServer()
+	srv.MaxConnectionsPerCID = 2
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	ln := startMemServer(t, srv)
+
+	echo := func(conn net.Conn) error {
+		tc := wrapTestConn(conn)
+		if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+			return err
+		}
+		header, _, body, err := tc.receive()
+		if err == nil && header.Code != 0 {
+			err = errors.New(string(body))
+		}
+		return err
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn := ln.dial(&vsock.Addr{ContextID: 3, Port: uint32(5000 + i)})
+		defer conn.Close()
+		if err := echo(conn); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+
+	// 同一CID的第三个连接被拒绝, 并带上原因
+	third := wrapTestConn(ln.dial(&vsock.Addr{ContextID: 3, Port: 5002}))
+	defer third.Close()
+	_ = third.SetReadDeadline(time.Now().Add(time.Second))
+	header, _, body, err := third.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Code != errors.StatusTooManyConnections.Code() {
+		t.Fatalf("unexpected code %v: %s", header.Code, body)
+	}
+	if _, err := third.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("rejected conn should be closed, got %v", err)
+	}
+
+	// 其他CID不受影响
+	other := ln.dial(&vsock.Addr{ContextID: 4, Port: 5000})
+	defer other.Close()
+	if err := echo(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭一个后名额归还
+	_ = conns[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn := ln.dial(&vsock.Addr{ContextID: 3, Port: 5003})
+		err := echo(conn)
+		_ = conn.Close()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot not released after close: %v", err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestKeepAliveHook(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	srv.HandleFunc("logout", func(req []byte) ([]byte, error) {
+		return nil, errors.New("logged out")
+	})
+	type decision struct {
+		path string
+		code uint16
+	}
+	decisions := make(chan decision, 4)
+	srv.KeepAlive = func(ctx context.Context, path string, respCode uint16) bool {
+		decisions <- decision{path, respCode}
+		return path != "logout"
+	}
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	for _, path := range []string{"echo", "missing", "logout"} {
+		if err := tc.send(&protocols.Request{Path: path}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := tc.receive(); err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+	}
+	_ = tc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := tc.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("conn should be closed after logout, got %v", err)
+	}
+
+	want := []decision{
+		{"echo", uint16(protocols.StatusOK)},
+		{"missing", errors.StatusInvalidPath.Code()},
+		{"logout", uint16(protocols.StatusErr)},
+	}
+	for _, w := range want {
+		if got := <-decisions; got != w {
+			t.Fatalf("hook got %+v, want %+v", got, w)
+		}
+	}
+}
+
+func TestRegisterHealth(t *testing.T) {
+	srv := newTestServer()
+	srv.RegisterHealth("_health")
+	hold := make(chan struct{})
+	srv.HandleConfig("hold", func(ctx context.Context, req []byte) ([]byte, error) {
+		<-hold
+		return req, nil
+	}, &HandlerConfig{MaxConcurrency: 1})
+	addr := startTestServer(t, srv)
+	cli := newTestClient(&client.Config{})
+
+	probe := func() *protocols.Health {
+		rsp, err := cli.Call(context.Background(), modelsAddr(addr), "_health", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		health, err := protocols.UnmarshalHealth(rsp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return health
+	}
+
+	if health := probe(); health.Status != protocols.HealthReady || health.AliveConns != 1 || health.InFlight != 1 {
+		t.Fatalf("unexpected health %+v", health)
+	}
+
+	srv.SetMaintenanceMode(true, 503, "maintenance")
+	if health := probe(); health.Status != protocols.HealthMaintenance {
+		t.Fatalf("unexpected health %+v", health)
+	}
+	srv.SetMaintenanceMode(false, 0, "")
+
+	held := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), modelsAddr(addr), "hold", nil)
+		held <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for probe().Status != protocols.HealthOverloaded {
+		if time.Now().After(deadline) {
+			t.Fatal("health should report overloaded while hold is at MaxConcurrency")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	close(hold)
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+	if health := probe(); health.Status != protocols.HealthReady {
+		t.Fatalf("unexpected health %+v", health)
+	}
+}
+
+func TestDescribeHandlers(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleConfig("get", func(ctx context.Context, req []byte) ([]byte, error) {
+		return req, nil
+	}, &HandlerConfig{
+		Description:     "fetch a key",
+		RequestType:     "pb.GetReq",
+		ResponseType:    "pb.GetRsp",
+		MaxConcurrency:  4,
+		MaxRequestBytes: 128,
+	})
+	srv.HandleStream("download", func(ctx context.Context, req []byte) (io.Reader, int, error) {
+		return bytes.NewReader(req), len(req), nil
+	}, nil)
+	srv.RegisterDescribe("_describe")
+
+	infos := srv.DescribeHandlers()
+	if len(infos) != 3 || infos[0].Path != "_describe" || infos[1].Path != "download" || infos[2].Path != "get" {
+		t.Fatalf("expect the paths sorted, got %+v", infos)
+	}
+	want := HandlerInfo{Path: "get", Kind: HandlerUnary, Description: "fetch a key", RequestType: "pb.GetReq",
+		ResponseType: "pb.GetRsp", MaxConcurrency: 4, MaxRequestBytes: 128}
+	if infos[2] != want {
+		t.Fatalf("expect %+v, got %+v", want, infos[2])
+	}
+	if infos[0].Kind != HandlerHealth || infos[1].Kind != HandlerStream {
+		t.Fatalf("unexpected kinds %+v", infos)
+	}
+
+	// 元数据不影响分发
+	addr := modelsAddr(startTestServer(t, srv))
+	cli := newTestClient(&client.Config{})
+	if rsp, err := cli.Call(context.Background(), addr, "get", []byte("k")); err != nil || string(rsp) != "k" {
+		t.Fatalf("unexpected response %q, %v", rsp, err)
+	}
+	rsp, err := cli.Call(context.Background(), addr, "_describe", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served []HandlerInfo
+	if err := json.Unmarshal(rsp, &served); err != nil {
+		t.Fatalf("%v: %s", err, rsp)
+	}
+	if len(served) != 3 || served[2].Description != "fetch a key" || !strings.Contains(string(rsp), `"kind":"stream"`) {
+		t.Fatalf("unexpected discovery response %s", rsp)
+	}
+}
+
+func TestShutdownWakesIdleConns(t *testing.T) {
+	srv := newTestServer()
+	srv.IdleTimeout = 0 // 空闲连接只能被Shutdown唤醒
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+
+	var conns []*testConn
+	for i := 0; i < 4; i++ {
+		tc := dialTestConn(t, addr)
+		if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := tc.receive(); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, tc)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	now := time.Now()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(now); elapsed > time.Millisecond*500 {
+		t.Fatalf("shutdown with idle conns took %v", elapsed)
+	}
+	for _, tc := range conns {
+		_ = tc.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := tc.reader.ReadByte(); err != io.EOF {
+			t.Fatalf("idle conn should be closed, got %v", err)
+		}
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	srv := newTestServer()
+	srv.FirstByteTimeout = time.Millisecond * 100
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+
+	// 连上不发数据, 很快被关闭
+	stalled := dialTestConn(t, addr)
+	now := time.Now()
+	_ = stalled.SetReadDeadline(now.Add(time.Second * 2))
+	if _, err := stalled.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("stalled conn should be closed, got %v", err)
+	}
+	if elapsed := time.Since(now); elapsed > time.Millisecond*500 {
+		t.Fatalf("stalled conn closed after %v", elapsed)
+	}
+
+	// 首个请求之后回到IdleTimeout
+	tc := dialTestConn(t, addr)
+	if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := tc.receive(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(srv.FirstByteTimeout * 2)
+	if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("again")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp, _, err := tc.receive(); err != nil || string(rsp.Rsp) != "again" {
+		t.Fatalf("conn should stay open after the first request, got %v", err)
+	}
+}
+
+// TestPingInterval answers every ping: the next one comes PingInterval after
+// the pong, never right away.
+func TestPingInterval(t *testing.T) {
+	const interval = time.Millisecond * 50
+	srv := newTestServerWith(func(srv *Server) {
+		srv.PingInterval = interval
+	})
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	pings := 0
+	_ = tc.SetReadDeadline(time.Now().Add(interval * 10))
+	for {
+		header, _, _, err := tc.receive()
+		if err != nil {
+			break
+		}
+		if header.Code != constant.ActionPing {
+			t.Fatalf("unexpected frame %+v", header)
+		}
+		pings++
+		pong := &models.Header{Magic: constant.DefaultMagic, Version: constant.DefaultVersion, Code: constant.ActionPong}
+		if _, err := socket.WriteFrame(context.Background(), tc.writer, pong, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pings < 5 || pings > 11 {
+		t.Fatalf("expect about one ping per %v in %v, got %v", interval, interval*10, pings)
+	}
+}
+
+// TestPingTimeout never answers the ping, the conn is closed once PingTimeout elapsed.
+func TestPingTimeout(t *testing.T) {
+	const interval, timeout = time.Millisecond * 50, time.Millisecond * 100
+	srv := newTestServerWith(func(srv *Server) {
+		srv.PingInterval = interval
+		srv.PingTimeout = timeout
+	})
+	closed := make(chan error, 1)
+	srv.OnConnClose = func(c *Conn, err error) {
+		closed <- err
+	}
+	tc := dialTestConn(t, startTestServer(t, srv))
+
+	now := time.Now()
+	if header, _, _, err := tc.receive(); err != nil || header.Code != constant.ActionPing {
+		t.Fatalf("expect a ping, got %+v, %v", header, err)
+	}
+	select {
+	case err := <-closed:
+		if !errors.Is(err, errors.ErrPingTimeout) {
+			t.Fatalf("expect ErrPingTimeout, got %v", err)
+		}
+		if elapsed := time.Since(now); elapsed < interval+timeout-interval/2 {
+			t.Fatalf("closed after %v, before PingInterval+PingTimeout", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("silent conn was not closed")
+	}
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	rw, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	keepAlive := func() int {
+		raw, err := rw.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value int
+		_ = raw.Control(func(fd uintptr) {
+			value, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	// net.Listen打开了keepalive, 先关掉
+	_ = rw.(*net.TCPConn).SetKeepAlive(false)
+	srv := newTestServer()
+	srv.setKeepAlive(rw)
+	if keepAlive() != 0 {
+		t.Fatal("keepalive should be off by default")
+	}
+	srv.TCPKeepAlive = time.Second * 30
+	srv.setKeepAlive(rw)
+	if keepAlive() == 0 {
+		t.Fatal("keepalive should be on")
+	}
+}
+
+type serveCtxKey struct{}
+
+func TestServeContext(t *testing.T) {
+	checkGoroutines(t)
+	srv := newTestServer()
+	started := make(chan struct{})
+	srv.HandleContext("block", func(ctx context.Context, req []byte) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		return []byte(ctx.Value(serveCtxKey{}).(string)), nil
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), serveCtxKey{}, "from serve ctx"))
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ServeContext(ctx, ln)
+	}()
+
+	tc := dialTestConn(t, ln.Addr())
+	if err := tc.send(&protocols.Request{Path: "block"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	cancel()
+
+	// 取消传给handler, 响应照常写回
+	_ = tc.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, rsp, _, err := tc.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp.Rsp) != "from serve ctx" {
+		t.Fatalf("unexpected response %q", rsp.Rsp)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("ServeContext should drain cleanly, got %v", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("ServeContext did not return")
+	}
+	if _, err := tc.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("conn should be closed after drain, got %v", err)
+	}
+}
+
+func TestFrameSentinel(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+
+	cli := newTestClient(&client.Config{Version: constant.SentinelVersion})
+	for _, req := range []string{"", "hello"} {
+		rsp, err := cli.Do(modelsAddr(addr), "echo", []byte(req))
+		if err != nil || string(rsp) != req {
+			t.Fatalf("echo %q: got %q, %v", req, rsp, err)
+		}
+	}
+
+	tc := dialTestConn(t, addr)
+	tc.version = constant.SentinelVersion
+	if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	header, rsp, _, err := tc.receive()
+	if err != nil || header.Version != constant.SentinelVersion || string(rsp.Rsp) != "hi" {
+		t.Fatalf("unexpected response %+v, %v", header, err)
+	}
+
+	// 长度少报一个字节, 哨兵错位
+	body, _ := proto.Marshal(&protocols.Request{Path: "echo", Req: []byte("hi")})
+	frame := make([]byte, models.HeaderSize+len(body)+socket.SentinelSize)
+	socket.PutHeader(frame, &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.SentinelVersion,
+		Length:  uint16(len(body) - 1),
+	})
+	copy(frame[models.HeaderSize:], body)
+	socket.PutSentinel(frame[models.HeaderSize+len(body):])
+	if _, err := tc.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	_ = tc.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := tc.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("conn with a broken frame should be closed, got %v", err)
+	}
+}
+
+func TestGoAwayGrace(t *testing.T) {
+	srv := newTestServer()
+	srv.GoAwayGrace = time.Millisecond * 200
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	srv.HandleFunc("slow", func(req []byte) ([]byte, error) {
+		time.Sleep(srv.GoAwayGrace + time.Millisecond*100)
+		return req, nil
+	})
+	addr := startTestServer(t, srv)
+
+	cli := newTestClient(&client.Config{})
+	if _, err := cli.Do(modelsAddr(addr), "echo", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	idle := dialTestConn(t, addr)
+	busy := dialTestConn(t, addr)
+	for _, tc := range []*testConn{idle, busy} {
+		if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := tc.receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv.GoAway()
+	for _, tc := range []*testConn{idle, busy} {
+		_ = tc.SetReadDeadline(time.Now().Add(time.Second))
+		if header, _, _, err := tc.receive(); err != nil || header.Code != constant.ActionGoAway {
+			t.Fatalf("expect a goaway frame, got %+v, %v", header, err)
+		}
+	}
+	// 客户端不再复用收到goaway的连接
+	time.Sleep(time.Millisecond * 20)
+	if stats := cli.PoolStats(); stats.Idle != 0 {
+		t.Fatalf("conn got goaway but stays pooled: %+v", stats)
+	}
+
+	// grace内照常应答
+	if err := idle.send(&protocols.Request{Path: "echo", Req: []byte("within grace")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp, _, err := idle.receive(); err != nil || string(rsp.Rsp) != "within grace" {
+		t.Fatalf("request within grace should be answered, got %v", err)
+	}
+	if err := busy.send(&protocols.Request{Path: "slow", Req: []byte("slow")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(srv.GoAwayGrace)
+	if err := busy.send(&protocols.Request{Path: "echo", Req: []byte("after grace")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// grace之后: 空闲连接被关闭, 新请求被拒绝
+	_ = idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("idle conn should be closed after grace, got %v", err)
+	}
+	_ = busy.SetReadDeadline(time.Now().Add(time.Second))
+	if _, rsp, _, err := busy.receive(); err != nil || string(rsp.Rsp) != "slow" {
+		t.Fatalf("request read within grace should be answered, got %v", err)
+	}
+	if header, _, _, err := busy.receive(); err != nil || header.Code != errors.StatusGoingAway.Code() {
+		t.Fatalf("expect StatusGoingAway, got %+v, %v", header, err)
+	}
+	if _, err := busy.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("conn should be closed after the rejection, got %v", err)
+	}
+}
+
+func TestHandlerWorkers(t *testing.T) {
+	srv := newTestServerWith(func(srv *Server) {
+		srv.HandlerWorkers = 1
+		srv.HandlerQueue = 1
+		srv.RetryAfter = time.Millisecond * 250
+	})
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	srv.HandleFunc("block", func(req []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-release
+		return req, nil
+	})
+	srv.HandleFunc("panic", func(req []byte) ([]byte, error) {
+		panic("boom")
+	})
+	addr := startTestServer(t, srv)
+
+	running, queued, rejected := dialTestConn(t, addr), dialTestConn(t, addr), dialTestConn(t, addr)
+	if err := running.send(&protocols.Request{Path: "block", Req: []byte("running")}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := queued.send(&protocols.Request{Path: "block", Req: []byte("queued")}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for srv.Stats().Workers.Queued != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 唯一的worker在忙, 队列也满了
+	if err := rejected.send(&protocols.Request{Path: "block", Req: []byte("rejected")}); err != nil {
+		t.Fatal(err)
+	}
+	header, _, body, err := rejected.receive()
+	if err != nil || header.Code != errors.StatusServerBusy.Code() {
+		t.Fatalf("expect StatusServerBusy, got %+v, %v", header, err)
+	}
+	if wait := errors.DecodeStatus(header.Code, body).RetryAfter(); wait != time.Millisecond*250 {
+		t.Fatalf("expect the RetryAfter hint, got %v", wait)
+	}
+	if stats := srv.Stats().Workers; stats.Size != 1 || stats.Busy != 1 || stats.Queued != 1 || stats.Rejected != 1 {
+		t.Fatalf("unexpected worker stats %+v", stats)
+	}
+
+	close(release)
+	for _, tc := range []*testConn{running, queued} {
+		if _, rsp, _, err := tc.receive(); err != nil || rsp.Code != protocols.StatusOK {
+			t.Fatalf("unexpected response %+v, %v", rsp, err)
+		}
+	}
+
+	// worker上的panic和串行时一样回500
+	if err := rejected.send(&protocols.Request{Path: "panic"}); err != nil {
+		t.Fatal(err)
+	}
+	if header, _, _, err := rejected.receive(); err != nil || header.Code != 500 {
+		t.Fatalf("expect status 500, got %+v, %v", header, err)
+	}
+}
+
+// TestDisablePanicRecoveryWorkers runs the job dispatch queued on a pool
+// without workers: recovered by default, the panic is raised again on the
+// serve goroutine; with DisablePanicRecovery it escapes the job, which
+// crashes the process on a real worker.
+func TestDisablePanicRecoveryWorkers(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		srv := newTestServerWith(func(srv *Server) {
+			srv.HandlerWorkers = 1
+			srv.DisablePanicRecovery = disable
+		})
+		serverSide, clientSide := net.Pipe()
+		c := srv.newConn(serverSide)
+		srv.workers.stop()
+		pool := &workerPool{size: 1, jobs: make(chan func(), 1)}
+		srv.workers = pool
+		handler := &handlerEntry{path: "panic", fn: func(ctx context.Context, req []byte) ([]byte, error) {
+			panic("boom")
+		}}
+
+		raised := make(chan interface{}, 1)
+		go func() {
+			defer func() { raised <- recover() }()
+			_ = c.dispatch(context.Background(), handler, &reply{}, nil)
+		}()
+		job := <-pool.jobs
+		var escaped interface{}
+		func() {
+			defer func() { escaped = recover() }()
+			job()
+		}()
+
+		if disable && (escaped != "boom" || <-raised != nil) {
+			t.Fatalf("expect the panic to escape the worker job, got %v", escaped)
+		}
+		if !disable && (escaped != nil || <-raised != "boom") {
+			t.Fatalf("expect the panic raised again by dispatch, escaped %v", escaped)
+		}
+		_ = clientSide.Close()
+		c.Close(errors.ErrClosed)
+	}
+}
+
+func TestWorkerPoolDefaults(t *testing.T) {
+	wp := newWorkerPool(0, 0)
+	defer wp.stop()
+	if size := runtime.GOMAXPROCS(0); wp.size != size || cap(wp.jobs) != size {
+		t.Fatalf("expect %v workers and queue slots, got %v and %v", size, wp.size, cap(wp.jobs))
+	}
+	done := make(chan struct{})
+	if !wp.submit(func() { close(done) }) {
+		t.Fatal("submit to an idle pool should succeed")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job did not run")
+	}
+}
+
+func TestRegisterLimits(t *testing.T) {
+	srv := newTestServerWith(func(srv *Server) { srv.MaxPaths = 2 })
+	echo := func(req []byte) ([]byte, error) { return req, nil }
+
+	if err := srv.HandleFunc("a", echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.HandleFunc("a", echo); !errors.Is(err, errors.ErrDuplicatePath) {
+		t.Fatalf("expect ErrDuplicatePath, got %v", err)
+	}
+	if err := srv.RegisterHealth("health"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.HandleStream("b", nil, nil); !errors.Is(err, errors.ErrTooManyPaths) {
+		t.Fatalf("expect ErrTooManyPaths, got %v", err)
+	}
+	// 替换不占新的名额
+	if err := srv.ReplaceHandler("a", func(ctx context.Context, req []byte) ([]byte, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if paths := srv.Stats().Paths; paths != 2 {
+		t.Fatalf("expect 2 paths in stats, got %v", paths)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	events := srv.Events()
+	addr := startTestServer(t, srv)
+
+	tc := dialTestConn(t, addr)
+	for _, path := range []string{"echo", "missing"} {
+		if err := tc.send(&protocols.Request{Path: path}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := tc.receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = tc.Close()
+
+	want := []struct {
+		kind EventKind
+		path string
+		code uint16
+	}{
+		{EventConnOpen, "", 0},
+		{EventRequest, "echo", uint16(protocols.StatusOK)},
+		{EventRequestError, "missing", errors.StatusInvalidPath.Code()},
+		{EventConnClose, "", 0},
+	}
+	for _, w := range want {
+		select {
+		case event := <-events:
+			if event.Kind != w.kind || event.Path != w.path || event.Code != w.code || event.ConnName == 0 {
+				t.Fatalf("expect %v %q %v, got %+v", w.kind, w.path, w.code, event)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("no %v event", w.kind)
+		}
+	}
+
+	// 没人读时丢弃, 不阻塞
+	full := newTestServer()
+	full.EventBuffer = 1
+	full.Events()
+	full.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	tc = dialTestConn(t, startTestServer(t, full))
+	for i := 0; i < 3; i++ {
+		if err := tc.send(&protocols.Request{Path: "echo"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := tc.receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 最后一个事件在响应写出之后才发
+	deadline := time.Now().Add(time.Second * 2)
+	for full.Stats().EventsDropped != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect 3 events dropped, got %v", full.Stats().EventsDropped)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	srv := newTestServer()
+	srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+		return req, nil
+	})
+	closed := make(chan error, 2)
+	srv.OnConnClose = func(c *Conn, err error) {
+		closed <- err
+	}
+
+	serve := func(ctx context.Context) (*testConn, chan error) {
+		serverSide, clientSide := net.Pipe()
+		t.Cleanup(func() { _ = clientSide.Close() })
+		served := make(chan error, 1)
+		go func() { served <- srv.ServeConn(ctx, serverSide) }()
+		tc := wrapTestConn(clientSide)
+		if err := tc.send(&protocols.Request{Path: "echo", Req: []byte("hi")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, rsp, _, err := tc.receive(); err != nil || rsp == nil || string(rsp.Rsp) != "hi" {
+			t.Fatalf("echo over the pipe failed: %v %v", rsp, err)
+		}
+		return tc, served
+	}
+
+	// 对端关闭, ServeConn返回关闭原因
+	tc, served := serve(context.Background())
+	_ = tc.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, errors.ErrPeekWritingErr) {
+			t.Fatalf("expect the peer close as the reason, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+	if err := <-closed; !errors.Is(err, errors.ErrPeekWritingErr) {
+		t.Fatalf("OnConnClose should see the conn, got %v", err)
+	}
+
+	// ctx结束时关闭连接
+	ctx, cancel := context.WithCancel(context.Background())
+	_, served = serve(ctx)
+	cancel()
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expect context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeConn did not return after ctx was done")
+	}
+	if n := srv.Stats().AliveConns; n != 0 {
+		t.Fatalf("expect no alive conns, got %v", n)
+	}
+}
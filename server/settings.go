@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+)
+
+func (srv *Server) maxFrameSize() int {
+	if srv.MaxFrameSize > 0 && srv.MaxFrameSize < constant.MaxFrameBodySize {
+		return srv.MaxFrameSize
+	}
+	return constant.MaxFrameBodySize
+}
+
+// MaxFrameSize is the largest frame body agreed with the client by an
+// ActionSettings frame, constant.MaxFrameBodySize if the client sent none.
+func (c *Conn) MaxFrameSize() int {
+	if size := atomic.LoadInt32(&c.maxFrame); size > 0 {
+		return int(size)
+	}
+	return constant.MaxFrameBodySize
+}
+
+// responseSettings records the client settings and answers with the server
+// ones, echoing the stream window it will honor.
+func (c *Conn) responseSettings(ctx context.Context, body []byte) (bool, error) {
+	settings, err := protocols.UnmarshalSettings(body)
+	if err != nil {
+		return c.responseStatus(ctx, errors.StatusInvalidRequest)
+	}
+	size := c.server.maxFrameSize()
+	if peer := int(settings.MaxFrameSize); peer > 0 && peer < size {
+		size = peer
+	}
+	atomic.StoreInt32(&c.maxFrame, int32(size))
+	window := streamWindowSize(settings.StreamWindow)
+	atomic.StoreInt32(&c.streamWindow, int32(window))
+
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: constant.DefaultVersion,
+		Code:    constant.ActionSettings,
+	}
+	answer := &protocols.Settings{MaxFrameSize: uint32(c.server.maxFrameSize()), StreamWindow: uint32(window)}
+	return c.write(ctx, header, answer.Marshal())
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops accepting, lets every conn answer the requests it already
+// read (pipelined ones included, in order) and waits for the conns and the
+// background work to end, or ctx to be done. Idle conns close at once
+// instead of waiting out IdleTimeout.
+// Serve returns errors.ErrServerClosed once Shutdown was called.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	srv.ready()
+
+	srv.lnMutex.Lock()
+	for ln := range srv.listeners {
+		_ = ln.Close()
+		delete(srv.listeners, ln)
+	}
+	srv.lnMutex.Unlock()
+
+	// 空闲连接阻塞在Peek上, 立即唤醒让它们退出
+	srv.connMutex.Lock()
+	for c := range srv.conns {
+		c.interruptIdle()
+	}
+	srv.connMutex.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for srv.connsHist.Count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	if srv.workers != nil {
+		srv.workers.stop() // 连接都已退出, 不会再提交
+	}
+	return srv.WaitBackground(ctx)
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// trackListener registers l for Shutdown, false if the server is already shutting down.
+func (srv *Server) trackListener(l net.Listener) bool {
+	srv.lnMutex.Lock()
+	defer srv.lnMutex.Unlock()
+	if srv.shuttingDown() {
+		return false
+	}
+	srv.listeners[l] = struct{}{}
+	return true
+}
+
+func (srv *Server) untrackListener(l net.Listener) {
+	srv.lnMutex.Lock()
+	defer srv.lnMutex.Unlock()
+	delete(srv.listeners, l)
+}
+
+func (srv *Server) trackConn(c *Conn) {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	if srv.conns == nil {
+		srv.conns = make(map[*Conn]struct{})
+	}
+	srv.conns[c] = struct{}{}
+}
+
+func (srv *Server) untrackConn(c *Conn) {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	delete(srv.conns, c)
+}
+
+// setIdle marks the conn as waiting for the next request. Entering idle
+// fails once the server is shutting down: either this sees the flag or
+// Shutdown sees the conn idle and interrupts it.
+func (c *Conn) setIdle(idle bool) bool {
+	c.idleMutex.Lock()
+	defer c.idleMutex.Unlock()
+	c.idle = idle
+	return !idle || !c.server.shuttingDown()
+}
+
+// interruptIdle makes the Peek of an idle conn return at once, a conn busy
+// with a request is left alone and exits after answering it.
+func (c *Conn) interruptIdle() {
+	c.idleMutex.Lock()
+	defer c.idleMutex.Unlock()
+	if c.idle {
+		_ = c.rwc.SetReadDeadline(time.Unix(1, 0))
+	}
+}
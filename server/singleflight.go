@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+)
+
+// flightGroup runs the handler once for the requests of a path sharing a
+// HandlerConfig.CoalesceKey at the same time.
+type flightGroup struct {
+	key func(ctx context.Context, req []byte) string
+
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{} // closed once the leader finished
+	body []byte        // marshaled protocols.Response of the leader
+	code uint16        // reply.code of body
+	err  error
+}
+
+func newFlightGroup(key func(ctx context.Context, req []byte) string) *flightGroup {
+	if key == nil {
+		return nil
+	}
+	return &flightGroup{key: key, calls: make(map[string]*flightCall)}
+}
+
+// do runs fn for the first request of key, the ones arriving while it runs
+// wait for it and get its response or its error. Unlike dedupCache nothing is
+// kept once it returned.
+func (fg *flightGroup) do(ctx context.Context, key string, rp *reply, fn func() error) error {
+	fg.mutex.Lock()
+	if call, ok := fg.calls[key]; ok {
+		fg.mutex.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return errors.StatusDeadlineExceeded
+		}
+		if call.err != nil {
+			return call.err
+		}
+		rp.body, rp.code = call.body, call.code
+		return nil
+	}
+	call := &flightCall{done: make(chan struct{})}
+	fg.calls[key] = call
+	fg.mutex.Unlock()
+
+	finished := false
+	defer func() {
+		if !finished {
+			// leader panic了, 继续向上交给serve处理, 等待者不能一直等
+			call.err = errors.NewStatus(500, "panic in coalesced handler")
+		}
+		fg.mutex.Lock()
+		delete(fg.calls, key)
+		fg.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.err = fn()
+	call.body, call.code = rp.body, rp.code
+	finished = true
+	return call.err
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/log"
+	"github.com/mdlayher/vsock"
+)
+
+// logSlowRequest logs the request just answered if it took longer than
+// Server.SlowRequestThreshold, elapsed counts from reading its first frame.
+func (c *Conn) logSlowRequest(path string, code uint16, elapsed time.Duration, reqBytes int) {
+	threshold := c.server.slowRequestThreshold()
+	if threshold <= 0 || elapsed <= threshold {
+		return
+	}
+	cid := "-"
+	if addr, ok := c.rwc.RemoteAddr().(*vsock.Addr); ok {
+		cid = strconv.FormatUint(uint64(addr.ContextID), 10)
+	}
+	log.Warnf("conn[%v] %v: slow request path=%q code=%v elapsed=%v req=%vB rsp=%vB cid=%v\n",
+		c.Name, c.remoteAddr, c.server.loggedPath(path), code, elapsed, reqBytes, atomic.LoadInt64(&c.rspBytes), cid)
+}
@@ -0,0 +1,90 @@
+package server
+
+import "sync/atomic"
+
+// Stats is a point in time view of the server.
+type Stats struct {
+	AliveConns     int64
+	TLSConns       int64 // alive conns over TLS, AliveConns = TLSConns + PlaintextConns
+	PlaintextConns int64
+	PathInFlight   map[string]int64 // only paths with MaxConcurrency
+	PathMaxRequest map[string]int   // only paths with HandlerConfig.MaxRequestBytes
+	Paths          int              // registered paths, see Server.MaxPaths
+
+	// over the closed conns
+	ConnLifetimeMs Distribution
+	ConnRequests   Distribution
+
+	// over the requests, see Server.DecayingHistograms for the window
+	AcceptMs      Distribution
+	ReadMs        Distribution
+	WriteMs       Distribution
+	RequestBytes  Distribution
+	ResponseBytes Distribution
+
+	Workers WorkerStats // zero without Server.HandlerWorkers
+
+	EventsDropped int64 // events not emitted because Events was full
+}
+
+func (srv *Server) Stats() *Stats {
+	srv.ready()
+	stats := &Stats{
+		AliveConns:     srv.connsHist.Count(),
+		TLSConns:       atomic.LoadInt64(&srv.tlsConns),
+		PathInFlight:   make(map[string]int64),
+		PathMaxRequest: make(map[string]int),
+
+		ConnLifetimeMs: srv.connLifetimeHist.Distribution(),
+		ConnRequests:   srv.connRequestsHist.Distribution(),
+
+		AcceptMs:      srv.acceptHist.Distribution(),
+		ReadMs:        srv.readHist.Distribution(),
+		WriteMs:       srv.writeHist.Distribution(),
+		RequestBytes:  srv.reqSizeHist.Distribution(),
+		ResponseBytes: srv.rspSizeHist.Distribution(),
+
+		Workers: srv.workers.stats(),
+
+		EventsDropped: atomic.LoadInt64(&srv.eventsDropped),
+	}
+	stats.PlaintextConns = stats.AliveConns - stats.TLSConns
+
+	srv.mutex.RLock()
+	defer srv.mutex.RUnlock()
+	stats.Paths = len(srv.handlers)
+	for path, entry := range srv.handlers {
+		if entry.limiter != nil {
+			stats.PathInFlight[path] = entry.limiter.InFlight()
+		}
+		if max := entry.config.MaxRequestBytes; max > 0 {
+			stats.PathMaxRequest[path] = max
+		}
+	}
+	return stats
+}
+
+// ResetStats clears the histograms and the counters behind Stats, for test
+// isolation or reporting windows handled outside. The conns are not
+// disturbed and the state of the server is kept: AliveConns, TLSConns,
+// PathInFlight and the running background work still count. It is not
+// atomic with concurrent updates: a sample landing during the reset may be
+// kept or lost, take Stats first for a snapshot of the window ending.
+func (srv *Server) ResetStats() {
+	srv.ready()
+	for _, h := range []Histogram{
+		srv.acceptHist, srv.readHist, srv.writeHist,
+		srv.reqSizeHist, srv.rspSizeHist,
+		srv.connLifetimeHist, srv.connRequestsHist,
+	} {
+		if clearer, ok := h.(interface{ Clear() }); ok {
+			clearer.Clear()
+		}
+	}
+	srv.backgroundFailHist.Clear()
+	srv.maintenanceHist.Clear()
+	atomic.StoreInt64(&srv.eventsDropped, 0)
+	if srv.workers != nil {
+		atomic.StoreInt64(&srv.workers.rejected, 0)
+	}
+}
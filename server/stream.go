@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"hash"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/metadata"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/socket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const defaultStreamChunkSize = 4 << 10
+
+// StreamHandleFunc returns the response body as a reader of exactly length bytes,
+// so it never has to be held in memory at once. The frame length is still
+// 16 bits: length plus a few bytes of encoding must fit in 64KB.
+// If reader is an io.Closer it is closed once written.
+type StreamHandleFunc func(ctx context.Context, req []byte) (reader io.Reader, length int, err error)
+
+type streamBody struct {
+	reader   io.Reader
+	length   int
+	progress *streamProgress // nil if not tracked
+
+	// failed is the reader error after sent bytes were written, the frame
+	// was completed with padding and the trailer reports it.
+	failed error
+	sent   int
+
+	// rejected is the error answered instead of the stream when it failed
+	// before any byte was written, a plain error response: without the
+	// trailer unless timing asked for one.
+	rejected error
+	timing   bool
+
+	writeTimeout time.Duration // per chunk, the override of the request if set, see SetWriteTimeout
+}
+
+// close closes the reader if it is an io.Closer.
+func (sb *streamBody) close() {
+	if closer, ok := sb.reader.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// failureTrailer adds the failure of the stream to the trailer md.
+func (sb *streamBody) failureTrailer(md metadata.MD) {
+	md[metadata.StreamErrorCodeKey] = strconv.Itoa(int(responseCode(sb.failed)))
+	md[metadata.StreamErrorKey] = sanitizeReason(sb.failed)
+	md[metadata.StreamSentKey] = strconv.Itoa(sb.sent)
+}
+
+// responseStream writes a protocols.Response frame whose Rsp is copied from
+// the reader chunk by chunk. Errors before the first byte is written become
+// an error response, see rejectStream. A reader error afterwards completes the frame with
+// padding when header announces a trailer (see constant.FlagAcceptsTrailer),
+// sb.failed is then reported in it; otherwise the frame is cut and the conn
+// is broken.
+func (c *Conn) responseStream(ctx context.Context, header *models.Header, path string, sb *streamBody) (bool, error) {
+	defer sb.close()
+
+	select {
+	case <-ctx.Done():
+		return false, errors.ErrCtxWriteDone
+	default:
+	}
+
+	// protocols.Response{Code: StatusOK, Rsp: <length bytes>}
+	prefix := protowire.AppendTag(nil, 1, protowire.VarintType)
+	prefix = protowire.AppendVarint(prefix, uint64(protocols.StatusOK))
+	prefix = protowire.AppendTag(prefix, 2, protowire.BytesType)
+	prefix = protowire.AppendVarint(prefix, uint64(sb.length))
+
+	var mac hash.Hash
+	total := len(prefix) + sb.length
+	if signer := c.server.Signer; signer != nil {
+		mac = signer.New()
+		total += signer.Size()
+	}
+	if sb.length < 0 || total > c.MaxFrameSize() {
+		return c.rejectStream(ctx, header, path, sb, errors.ErrExceedBody)
+	}
+
+	// 有窗口时只向reader要窗口内能写出的部分, 慢的客户端让生产也停下
+	window := c.newStreamWindow(sb)
+	sb.progress.start(sb.length)
+	chunk := make([]byte, minInt(c.server.streamChunkSize(), sb.length))
+	first := minInt(len(chunk), sb.length)
+	if !window.off {
+		first = minInt(first, window.credit-len(prefix))
+	}
+	sb.progress.setReading(true)
+	n, err := io.ReadFull(sb.reader, chunk[:first])
+	sb.progress.setReading(false)
+	if err != nil {
+		return c.rejectStream(ctx, header, path, sb, err)
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.stopFlushTimerLocked()
+
+	header.Length = uint16(total)
+	if !window.off {
+		header.Code |= constant.FlagStreamWindow
+	}
+	c.server.rspSizeHist.Observe(int64(total))
+	atomic.StoreInt64(&c.rspBytes, int64(total))
+	headerBuf := make([]byte, models.HeaderSize)
+	socket.PutHeader(headerBuf, header)
+	if _, err := c.bufWriter.Write(headerBuf); err != nil {
+		return true, err
+	}
+	// body是Response的字节, 签名时同时计算hmac
+	frame := io.Writer(c.bufWriter)
+	if !window.off {
+		frame = windowWriter{w: c.bufWriter, sw: window}
+	}
+	body := frame
+	if mac != nil {
+		body = io.MultiWriter(frame, mac)
+	}
+	if _, err := body.Write(prefix); err != nil {
+		return true, err
+	}
+
+	written := 0
+	for {
+		c.setChunkWriteDeadline(sb)
+		if _, err := body.Write(chunk[:n]); err != nil {
+			return true, err
+		}
+		written += n
+		sb.progress.wrote(n)
+		if written >= sb.length {
+			break
+		}
+
+		// 文件直接sendfile, 不经过用户态缓冲; 签名需要经手每个字节, 窗口需要按额度分段
+		if mac == nil && window.off {
+			if ok, err := c.sendFile(sb, sb.length-written); ok {
+				if err != nil {
+					return true, err
+				}
+				sb.progress.wrote(sb.length - written)
+				break
+			}
+		}
+
+		size := minInt(len(chunk), sb.length-written)
+		if !window.off {
+			credit, err := window.available()
+			if err != nil {
+				return true, err
+			}
+			size = minInt(size, credit)
+		}
+		sb.progress.setReading(true)
+		n, err = io.ReadFull(sb.reader, chunk[:size])
+		sb.progress.setReading(false)
+		if err != nil {
+			if header.Code&constant.FlagTrailer == 0 {
+				// 已经写出部分数据, 客户端无法得知失败, 只能断开
+				return true, errors.Wrap(errors.ErrStreamBroken, err)
+			}
+			// 失败前读到的部分照常写出
+			if _, err := body.Write(chunk[:n]); err != nil {
+				return true, err
+			}
+			written += n
+			sb.progress.wrote(n)
+			sb.failed, sb.sent = err, written
+			if err := c.padStream(sb, body, chunk, sb.length-written); err != nil {
+				return true, err
+			}
+			break
+		}
+	}
+	if mac != nil {
+		if _, err := frame.Write(c.server.Signer.AppendSum(nil, mac)); err != nil {
+			return true, err
+		}
+	}
+
+	if socket.HasSentinel(header.Version) {
+		sentinel := make([]byte, socket.SentinelSize)
+		socket.PutSentinel(sentinel)
+		if _, err := c.bufWriter.Write(sentinel); err != nil {
+			return true, err
+		}
+	}
+	c.setChunkWriteDeadline(sb)
+	if err := c.bufWriter.Flush(); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// rejectStream answers err like a unary handler error, the client gets it
+// without a stream body or a failure trailer.
+func (c *Conn) rejectStream(ctx context.Context, header *models.Header, path string, sb *streamBody, err error) (bool, error) {
+	sb.rejected = err
+	if !sb.timing {
+		header.Code &^= constant.FlagTrailer
+	}
+	return c.responseSuccess(ctx, header, path, wrapResponse(nil, err))
+}
+
+// padStream fills the rest of a failed stream frame with zeros, the client
+// drops them as told by the trailer.
+func (c *Conn) padStream(sb *streamBody, body io.Writer, chunk []byte, remaining int) error {
+	for i := range chunk {
+		chunk[i] = 0
+	}
+	for remaining > 0 {
+		n := minInt(len(chunk), remaining)
+		c.setChunkWriteDeadline(sb)
+		if _, err := body.Write(chunk[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// setChunkWriteDeadline renews the write deadline before each chunk of sb.
+func (c *Conn) setChunkWriteDeadline(sb *streamBody) {
+	timeout := sb.writeTimeout
+	if timeout == 0 {
+		timeout = c.server.writeTimeout()
+	}
+	if timeout != 0 {
+		_ = c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
+
+func (srv *Server) streamChunkSize() int {
+	if srv.StreamChunkSize > 0 {
+		return srv.StreamChunkSize
+	}
+	return defaultStreamChunkSize
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/log"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/socket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pushOverhead leaves room for the id and the encoding of a protocols.Push in one frame.
+const pushOverhead = 16
+
+// SubscribeFunc pushes messages to a subscribed client with send until it
+// returns, its error (nil for a clean end) is delivered to the client as the
+// end of the subscription. ctx is done, its Done channel closed, once the
+// client unsubscribes or the conn closes: the handler must return then.
+// send copies msg; it fails with ctx.Err() after ctx is done and per
+// SubscribeConfig.SlowConsumer while the send buffer is full. send must not
+// be called after the handler returned.
+type SubscribeFunc func(ctx context.Context, req []byte, send func(msg []byte) error) error
+
+// SlowConsumerPolicy is what send does when a subscription's buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDrop drops the message, send returns errors.ErrPushDropped.
+	SlowConsumerDrop SlowConsumerPolicy = iota
+	// SlowConsumerDisconnect closes the conn, send returns errors.ErrSlowConsumer.
+	SlowConsumerDisconnect
+)
+
+// SubscribeConfig holds the settings of a subscription path.
+type SubscribeConfig struct {
+	// SendBuffer is how many pushed messages may wait to be written,
+	// constant.DefaultPushBuffer if 0.
+	SendBuffer   int
+	SlowConsumer SlowConsumerPolicy
+}
+
+// HandleSubscribe registers fn for path. The response to the subscribe
+// request carries the subscription id, then every message fn sends is
+// written as an ActionPush frame tagged with it, and an ActionPushEnd frame
+// once fn returns. A conn holding subscriptions is not closed by IdleTimeout,
+// cfg may be nil.
+func (srv *Server) HandleSubscribe(path string, fn SubscribeFunc, cfg *SubscribeConfig) error {
+	entry := &handlerEntry{
+		path:        path,
+		subscribeFn: fn,
+	}
+	if cfg != nil {
+		entry.subscribe = *cfg
+	}
+
+	return srv.register(entry)
+}
+
+type subscription struct {
+	id      uint64
+	conn    *Conn
+	version uint16 // Header.Version of the subscribe request, used for the push frames
+	policy  SlowConsumerPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan []byte
+	done   chan struct{} // closed once the handler returned
+	err    error         // handler result, set before done is closed
+}
+
+// subscribe registers a subscription for the request, its handler starts
+// once the response carrying the id is written.
+func (c *Conn) subscribe(ctx context.Context, handler *handlerEntry, rp *reply, req []byte) {
+	size := handler.subscribe.SendBuffer
+	if size <= 0 {
+		size = constant.DefaultPushBuffer
+	}
+	header, _ := HeaderFromContext(ctx)
+	// 订阅比请求活得久, 只保留ctx的值
+	subCtx, cancel := context.WithCancel(detachContext{ctx})
+	sub := &subscription{
+		id:      uint64(atomic.AddInt64(&c.subIndex, 1)),
+		conn:    c,
+		version: header.Version,
+		policy:  handler.subscribe.SlowConsumer,
+		ctx:     subCtx,
+		cancel:  cancel,
+		queue:   make(chan []byte, size),
+		done:    make(chan struct{}),
+	}
+
+	c.subsMutex.Lock()
+	if c.subs == nil {
+		c.subs = make(map[uint64]*subscription)
+	}
+	c.subs[sub.id] = sub
+	c.subsMutex.Unlock()
+	if c.isClosed() {
+		cancel() // Close之后注册的, 没有被cancelSubscriptions取消
+	}
+
+	rp.body = wrapResponse(protowire.AppendVarint(nil, sub.id), nil)
+	rp.onFinish(func() {
+		go sub.run(handler.subscribeFn, req)
+		go sub.writeLoop()
+	})
+}
+
+func (sub *subscription) run(fn SubscribeFunc, req []byte) {
+	defer close(sub.done)
+	defer func() {
+		if sub.conn.server.DisablePanicRecovery {
+			return
+		}
+		if err := recover(); err != nil {
+			log.Errorf("conn[%v] %v: panic in subscription %v: %v\n", sub.conn.Name, sub.conn.remoteAddr, sub.id, err)
+			sub.err = errors.NewStatus(500, "panic in subscription handler")
+		}
+	}()
+	sub.err = fn(sub.ctx, req, sub.send)
+}
+
+func (sub *subscription) send(msg []byte) error {
+	if err := sub.ctx.Err(); err != nil {
+		return err
+	}
+	if len(msg) > sub.conn.MaxFrameSize()-pushOverhead {
+		return errors.ErrExceedBody
+	}
+	select {
+	case sub.queue <- append([]byte(nil), msg...):
+		return nil
+	default:
+	}
+	if sub.policy == SlowConsumerDisconnect {
+		sub.conn.Close(errors.ErrSlowConsumer)
+		return errors.ErrSlowConsumer
+	}
+	return errors.ErrPushDropped
+}
+
+// writeLoop writes the queued messages until the handler returned, then the end frame.
+func (sub *subscription) writeLoop() {
+	defer sub.cancel()
+	defer sub.conn.unsubscribe(sub)
+
+	for {
+		select {
+		case msg := <-sub.queue:
+			if !sub.write(constant.ActionPush, &protocols.Push{ID: sub.id, Msg: msg}) {
+				return
+			}
+		case <-sub.done:
+			// handler已返回, 剩下的消息发完再结束
+			for len(sub.queue) > 0 {
+				if !sub.write(constant.ActionPush, &protocols.Push{ID: sub.id, Msg: <-sub.queue}) {
+					return
+				}
+			}
+			end := &protocols.Push{ID: sub.id}
+			if sub.err != nil {
+				end.Err = sub.err.Error()
+			}
+			sub.write(constant.ActionPushEnd, end)
+			return
+		}
+	}
+}
+
+// write sends one push frame, false once the conn is closed or broken.
+func (sub *subscription) write(code uint16, push *protocols.Push) bool {
+	header := &models.Header{
+		Magic:   constant.DefaultMagic,
+		Version: sub.version,
+		Code:    code,
+	}
+	if err := sub.conn.writeControl(header, push.Marshal()); err != nil {
+		if !errors.Is(err, errors.ErrConnClosed) {
+			sub.conn.Close(errors.Wrap(errors.ErrWriteSocketErr, err))
+		}
+		return false
+	}
+	return true
+}
+
+func (c *Conn) unsubscribe(sub *subscription) {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	delete(c.subs, sub.id)
+}
+
+// subscribed reports if the conn holds a subscription.
+func (c *Conn) subscribed() bool {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	return len(c.subs) > 0
+}
+
+// cancelSubscriptions ends the subscriptions of a closed conn.
+func (c *Conn) cancelSubscriptions() {
+	c.subsMutex.Lock()
+	defer c.subsMutex.Unlock()
+	for _, sub := range c.subs {
+		sub.cancel()
+	}
+}
+
+// writeControl writes a frame not answering a request from outside the serve
+// goroutine, under WriteTimeout. ErrConnClosed if the conn is already closed.
+// With Server.WriteQueue the frame is queued for the writer goroutine instead.
+func (c *Conn) writeControl(header *models.Header, body []byte) error {
+	if c.server.WriteQueue > 0 {
+		return c.enqueue(header, body)
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closed || c.bufWriter == nil { // 关闭后bufWriter已归还
+		return errors.ErrConnClosed
+	}
+	c.stopFlushTimerLocked()
+	if timeout := c.server.writeTimeout(); timeout != 0 {
+		_ = c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := socket.WriteSocket(context.Background(), c.bufWriter, header, body)
+	return err
+}
+
+func (c *Conn) isClosed() bool {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.closed
+}
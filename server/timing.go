@@ -0,0 +1,51 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/metadata"
+)
+
+const (
+	timingRead = iota
+	timingQueue
+	timingHandler
+	timingSerialize
+	timingWrite
+	timingCount
+)
+
+var timingKeys = [timingCount]string{
+	timingRead:      metadata.TimingReadKey,
+	timingQueue:     metadata.TimingQueueKey,
+	timingHandler:   metadata.TimingHandlerKey,
+	timingSerialize: metadata.TimingSerializeKey,
+	timingWrite:     metadata.TimingWriteKey,
+}
+
+// requestTiming is the breakdown of one request, sent in the response
+// trailer. Read and write are the costs also fed to readHist/writeHist.
+type requestTiming struct {
+	last time.Time
+	laps [timingCount]time.Duration
+}
+
+// lap records the time since the previous lap as stage, a nil timing
+// (not asked for) records nothing.
+func (rt *requestTiming) lap(stage int) {
+	if rt == nil {
+		return
+	}
+	now := time.Now()
+	rt.laps[stage] = now.Sub(rt.last)
+	rt.last = now
+}
+
+func (rt *requestTiming) trailer() metadata.MD {
+	md := make(metadata.MD, timingCount)
+	for stage, d := range rt.laps {
+		md[timingKeys[stage]] = strconv.FormatInt(d.Microseconds(), 10)
+	}
+	return md
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+)
+
+type tlsStateKey struct{}
+
+// TLSConnectionState returns the negotiated TLS state of the conn a request
+// came in on, false on a plaintext conn. Conns are TLS when Serve is given a
+// tls.NewListener, the handshake is completed before the first request is read.
+//
+// A path requiring mTLS checks len(state.PeerCertificates) > 0 (or
+// state.VerifiedChains with tls.RequireAndVerifyClientCert).
+func TLSConnectionState(ctx context.Context) (*tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	return state, ok
+}
+
+// handshake completes the TLS handshake of a tls conn under ReadTimeout,
+// so the state is known before any request. Non TLS conns are returned as is.
+func (c *Conn) handshake(ctx context.Context) (context.Context, error) {
+	tlsConn, ok := c.rwc.(*tls.Conn)
+	if !ok {
+		return ctx, nil
+	}
+	var deadline time.Time
+	if timeout := c.server.readTimeout(); timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	// 握手也算在首字节之前
+	if timeout := c.server.FirstByteTimeout; timeout > 0 {
+		if first := c.openAt.Add(timeout); deadline.IsZero() || first.Before(deadline) {
+			deadline = first
+		}
+	}
+	_ = c.rwc.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		return ctx, errors.Wrap(errors.ErrTLSHandshake, err)
+	}
+	_ = c.rwc.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	atomic.AddInt64(&c.server.tlsConns, 1)
+	c.tls = true
+	return context.WithValue(ctx, tlsStateKey{}, &state), nil
+}
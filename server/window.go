@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/constant"
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/protocols"
+	"github.com/brodyxchen/vsock-sdk/socket"
+)
+
+// streamWindow is the flow control credit of one stream response: the bytes
+// of its frame body the client still takes before the next
+// constant.ActionWindowUpdate, see protocols.Settings.StreamWindow.
+type streamWindow struct {
+	c      *Conn
+	sb     *streamBody
+	credit int
+	off    bool // 没有协商窗口, 或者客户端在等待期间发了别的帧
+}
+
+func (c *Conn) newStreamWindow(sb *streamBody) *streamWindow {
+	size := int(atomic.LoadInt32(&c.streamWindow))
+	return &streamWindow{c: c, sb: sb, credit: size, off: size <= 0}
+}
+
+// available returns the bytes that may be written now, waiting for a window
+// update once the credit is used up.
+func (sw *streamWindow) available() (int, error) {
+	for !sw.off && sw.credit <= 0 {
+		if err := sw.await(); err != nil {
+			return 0, err
+		}
+	}
+	if sw.off {
+		return math.MaxInt32, nil
+	}
+	return sw.credit, nil
+}
+
+// await flushes what was written and reads the next frame of the client if
+// it is a window update. Any other frame is left to the serve loop and the
+// rest of the stream goes without flow control, waiting on a client that
+// is not granting would never end. Only the serve goroutine reads the conn,
+// it is the one writing the stream.
+func (sw *streamWindow) await() error {
+	c := sw.c
+	if err := c.bufWriter.Flush(); err != nil {
+		return err
+	}
+	timeout := sw.sb.writeTimeout
+	if timeout == 0 {
+		timeout = c.server.writeTimeout()
+	}
+	if timeout != 0 {
+		_ = c.rwc.SetReadDeadline(time.Now().Add(timeout))
+	}
+	defer c.rwc.SetReadDeadline(time.Time{}) // serve按需重新设置
+
+	headerBuf, err := c.bufReader.Peek(models.HeaderSize)
+	if err != nil {
+		return errors.Wrap(errors.ErrStreamWindow, err)
+	}
+	if binary.BigEndian.Uint16(headerBuf[4:]) != constant.ActionWindowUpdate {
+		sw.off = true
+		return nil
+	}
+	_, body, _, err := socket.ReadSocket(context.Background(), c.bufReader)
+	if err != nil {
+		return errors.Wrap(errors.ErrStreamWindow, err)
+	}
+	update, err := protocols.UnmarshalWindowUpdate(body)
+	if err != nil {
+		return errors.Wrap(errors.ErrStreamWindow, err)
+	}
+	sw.credit += int(update.Increment)
+	c.setChunkWriteDeadline(sw.sb) // 等待时的写超时不算
+	return nil
+}
+
+// windowWriter writes through the window of a stream, blocking while it is closed.
+type windowWriter struct {
+	w  io.Writer
+	sw *streamWindow
+}
+
+func (ww windowWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := ww.sw.available()
+		if err != nil {
+			return written, err
+		}
+		n, err = ww.w.Write(p[written:minInt(len(p), written+n)])
+		written += n
+		if !ww.sw.off {
+			ww.sw.credit -= n
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// streamWindowSize is the window a client asked for in its settings, 0 keeps
+// flow control off.
+func streamWindowSize(peer uint32) int {
+	if peer == 0 {
+		return 0
+	}
+	if peer < constant.MinStreamWindow {
+		return constant.MinStreamWindow
+	}
+	if peer > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(peer)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+)
+
+// workerPool runs the handlers of every conn on HandlerWorkers goroutines,
+// at most HandlerQueue requests wait for one.
+type workerPool struct {
+	size     int
+	jobs     chan func()
+	busy     int64 // atomic visit
+	rejected int64 // atomic visit
+
+	stopMutex sync.RWMutex // 守护stopped, 关闭jobs后不能再写入
+	stopped   bool
+}
+
+// newWorkerPool starts size workers, GOMAXPROCS if size <= 0, queue defaults
+// to size. Server.setup only builds one for HandlerWorkers > 0.
+func newWorkerPool(size, queue int) *workerPool {
+	if size <= 0 {
+		size = runtime.GOMAXPROCS(0)
+	}
+	if queue <= 0 {
+		queue = size
+	}
+	wp := &workerPool{
+		size: size,
+		jobs: make(chan func(), queue),
+	}
+	for i := 0; i < size; i++ {
+		go wp.work()
+	}
+	return wp
+}
+
+func (wp *workerPool) work() {
+	for job := range wp.jobs {
+		atomic.AddInt64(&wp.busy, 1)
+		job()
+		atomic.AddInt64(&wp.busy, -1)
+	}
+}
+
+// submit queues job, false if the queue is full or the pool stopped.
+func (wp *workerPool) submit(job func()) bool {
+	wp.stopMutex.RLock()
+	defer wp.stopMutex.RUnlock()
+	if wp.stopped {
+		return false
+	}
+	select {
+	case wp.jobs <- job:
+		return true
+	default:
+		atomic.AddInt64(&wp.rejected, 1)
+		return false
+	}
+}
+
+// stop ends the workers once the queued jobs are done, later submits fail.
+func (wp *workerPool) stop() {
+	wp.stopMutex.Lock()
+	defer wp.stopMutex.Unlock()
+	if !wp.stopped {
+		wp.stopped = true
+		close(wp.jobs)
+	}
+}
+
+// WorkerStats is the state of the handler worker pool, see Server.HandlerWorkers.
+type WorkerStats struct {
+	Size     int
+	Busy     int64
+	Queued   int
+	Rejected int64 // requests answered with StatusServerBusy because the queue was full
+}
+
+func (wp *workerPool) stats() WorkerStats {
+	if wp == nil {
+		return WorkerStats{}
+	}
+	return WorkerStats{
+		Size:     wp.size,
+		Busy:     atomic.LoadInt64(&wp.busy),
+		Queued:   len(wp.jobs),
+		Rejected: atomic.LoadInt64(&wp.rejected),
+	}
+}
+
+// dispatch runs invoke on the worker pool and waits for it, or on the serve
+// goroutine without HandlerWorkers. A handler panic is raised again here, so
+// it is recovered by serve like a sequential one.
+func (c *Conn) dispatch(ctx context.Context, handler *handlerEntry, rp *reply, req []byte) error {
+	pool := c.server.workers
+	if pool == nil {
+		return c.invoke(ctx, handler, rp, req)
+	}
+
+	var (
+		err      error
+		panicked interface{}
+	)
+	done := make(chan struct{})
+	if !pool.submit(func() {
+		defer close(done)
+		if !c.server.DisablePanicRecovery {
+			defer func() { panicked = recover() }()
+		}
+		err = c.invoke(ctx, handler, rp, req)
+	}) {
+		return c.server.busy()
+	}
+	<-done
+	if panicked != nil {
+		panic(panicked)
+	}
+	return err
+}
+
+// busy is the status of a request finding no worker or limiter slot, with
+// the RetryAfter hint if set.
+func (srv *Server) busy() error {
+	if srv.RetryAfter > 0 {
+		return errors.StatusServerBusy.WithRetryAfter(srv.RetryAfter)
+	}
+	return errors.StatusServerBusy
+}
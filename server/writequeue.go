@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/brodyxchen/vsock-sdk/errors"
+	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/socket"
+)
+
+// WriteQueuePolicy is what a producer does when the write queue of a conn is full.
+type WriteQueuePolicy int
+
+const (
+	// WriteQueueBlock waits for room in the queue or the conn to close.
+	WriteQueueBlock WriteQueuePolicy = iota
+	// WriteQueueDrop drops the frame, the producer gets errors.ErrWriteQueueFull.
+	WriteQueueDrop
+)
+
+type queuedFrame struct {
+	header *models.Header
+	body   []byte
+}
+
+// enqueue hands a frame to the writer goroutine of the conn, started by the
+// first one. body must not be changed afterwards. Write errors close the conn.
+func (c *Conn) enqueue(header *models.Header, body []byte) error {
+	c.writeQueueOnce.Do(func() {
+		c.writeQueue = make(chan queuedFrame, c.server.WriteQueue)
+		go c.writeLoop()
+	})
+
+	frame := queuedFrame{header: header, body: body}
+	select {
+	case <-c.done:
+		return errors.ErrConnClosed
+	default:
+	}
+	if c.server.WriteQueuePolicy == WriteQueueDrop {
+		select {
+		case c.writeQueue <- frame:
+			return nil
+		default:
+			return errors.ErrWriteQueueFull
+		}
+	}
+	select {
+	case c.writeQueue <- frame:
+		return nil
+	case <-c.done:
+		return errors.ErrConnClosed
+	}
+}
+
+// writeLoop writes the queued frames until the conn closed, flushing once
+// the queue is drained.
+func (c *Conn) writeLoop() {
+	for {
+		select {
+		case frame := <-c.writeQueue:
+			if err := c.writeQueued(frame); err != nil {
+				if !errors.Is(err, errors.ErrConnClosed) {
+					c.Close(errors.Wrap(errors.ErrWriteSocketErr, err))
+				}
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Conn) writeQueued(frame queuedFrame) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closed {
+		return errors.ErrConnClosed
+	}
+	if c.bufWriter == nil {
+		return nil // serve还没开始, 和直接写一样丢弃
+	}
+	c.stopFlushTimerLocked()
+	if timeout := c.server.writeTimeout(); timeout != 0 {
+		_ = c.rwc.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if _, err := socket.WriteFrame(context.Background(), c.bufWriter, frame.header, frame.body); err != nil {
+		return err
+	}
+	if len(c.writeQueue) > 0 {
+		return nil // 队列里还有, 一起flush
+	}
+	return c.bufWriter.Flush()
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// SetWriteTimeout overrides the write timeout of the response to the request
+// of ctx, a handler context, e.g. for a one-off slow admin call. It applies
+// from the start of the response write, per chunk of a stream. The
+// precedence is: SetWriteTimeout, then metadata.WriteTimeoutKey sent by the
+// client, then HandlerConfig.WriteTimeout of the path, then
+// Server.WriteTimeout. false if ctx is not a handler context.
+func SetWriteTimeout(ctx context.Context, timeout time.Duration) bool {
+	rp, ok := ctx.Value(afterResponseKey{}).(*reply)
+	if !ok || timeout <= 0 {
+		return false
+	}
+	rp.setWriteTimeout(timeout)
+	return true
+}
+
+func (rp *reply) setWriteTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&rp.writeTimeout, int64(timeout))
+}
+
+// responseWriteTimeout is the override of the server write timeout for the
+// response, false if none applies.
+func (rp *reply) responseWriteTimeout() (time.Duration, bool) {
+	if timeout := time.Duration(atomic.LoadInt64(&rp.writeTimeout)); timeout > 0 {
+		return timeout, true
+	}
+	if rp.pathWriteTimeout > 0 {
+		return rp.pathWriteTimeout, true
+	}
+	return 0, false
+}
@@ -1,7 +1,16 @@
 package vsock_sdk
 
 import (
+	"context"
+	"github.com/brodyxchen/vsock-sdk/client"
+	"github.com/brodyxchen/vsock-sdk/errors"
 	"github.com/brodyxchen/vsock-sdk/models"
+	"github.com/brodyxchen/vsock-sdk/server"
+	"github.com/brodyxchen/vsock-sdk/statistics"
+	"github.com/brodyxchen/vsock-sdk/statistics/metrics"
+	"net"
+	"sync/atomic"
+	"testing"
 	"time"
 )
 
@@ -35,3 +44,198 @@ func LaunchCustomExampleServer(port uint32, readTimeout, writeTimeout, idleTimeo
 	}()
 	<-isRunning
 }
+
+// serveNewServer serves a NewServer on a loopback listener until the test
+// ends, configure sets its fields after NewServer returned like a caller does.
+func serveNewServer(t *testing.T, configure func(srv *server.Server), register func(srv *server.Server)) (*server.Server, models.Addr) {
+	srv := NewServer(&models.HttpAddr{IP: "127.0.0.1"})
+	configure(srv)
+	register(srv)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+	return srv, &models.HttpAddr{IP: "127.0.0.1", Port: uint32(ln.Addr().(*net.TCPAddr).Port)}
+}
+
+func TestNewServerHandlerWorkers(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	srv, addr := serveNewServer(t, func(srv *server.Server) {
+		srv.HandlerWorkers = 1
+		srv.HandlerQueue = 1
+	}, func(srv *server.Server) {
+		srv.HandleFunc("block", func(req []byte) ([]byte, error) {
+			started <- struct{}{}
+			<-release
+			return req, nil
+		})
+	})
+	cli := NewClient(&client.Config{Timeout: time.Second * 2})
+
+	results := make(chan error, 2)
+	call := func() {
+		_, err := cli.Call(context.Background(), addr, "block", nil)
+		results <- err
+	}
+	go call()
+	<-started
+	go call()
+	deadline := time.Now().Add(time.Second)
+	for srv.Stats().Workers.Queued != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 唯一的worker在忙, 队列也满了
+	_, err := cli.Call(context.Background(), addr, "block", nil)
+	if status, ok := err.(*errors.Status); !ok || status.Code() != errors.StatusServerBusy.Code() {
+		t.Fatalf("expect StatusServerBusy, got %v", err)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNewServerRetryAfter(t *testing.T) {
+	const retryAfter = time.Millisecond * 150
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	_, addr := serveNewServer(t, func(srv *server.Server) {
+		srv.RetryAfter = retryAfter
+	}, func(srv *server.Server) {
+		srv.HandleConfig("block", func(ctx context.Context, req []byte) ([]byte, error) {
+			started <- struct{}{}
+			<-release
+			return req, nil
+		}, &server.HandlerConfig{MaxConcurrency: 1})
+	})
+	cli := NewClient(&client.Config{Timeout: time.Second})
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := cli.Call(context.Background(), addr, "block", nil)
+		first <- err
+	}()
+	<-started
+	time.AfterFunc(retryAfter/3, func() { close(release) })
+
+	// 被限流拒绝, 等retryAfter后重试成功
+	now := time.Now()
+	if _, err := cli.Call(context.Background(), addr, "block", nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(now); elapsed < retryAfter {
+		t.Fatalf("retried after %v, expect at least %v", elapsed, retryAfter)
+	}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewServerBackgroundWorkers(t *testing.T) {
+	const workers = 3
+	var running int32
+	release := make(chan struct{})
+	srv, addr := serveNewServer(t, func(srv *server.Server) {
+		srv.BackgroundWorkers = workers
+	}, func(srv *server.Server) {
+		srv.HandleContext("work", func(ctx context.Context, req []byte) ([]byte, error) {
+			server.RunAfterResponse(ctx, func(ctx context.Context) error {
+				atomic.AddInt32(&running, 1)
+				<-release
+				return nil
+			})
+			return req, nil
+		})
+	})
+	cli := NewClient(&client.Config{Timeout: time.Second})
+
+	for i := 0; i < workers+1; i++ {
+		if _, err := cli.Call(context.Background(), addr, "work", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&running) != workers && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 20) // 多出的一个不应该开始
+	if n := atomic.LoadInt32(&running); n != workers {
+		t.Fatalf("expect %v background works at once, got %v", workers, n)
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.WaitBackground(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewServerDecayingHistograms(t *testing.T) {
+	_, addr := serveNewServer(t, func(srv *server.Server) {
+		srv.DecayingHistograms = true
+	}, func(srv *server.Server) {
+		srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+			return req, nil
+		})
+	})
+	cli := NewClient(&client.Config{Timeout: time.Second})
+	if _, err := cli.Call(context.Background(), addr, "echo", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	hist, ok := statistics.ServerReg.Get("srv.req.bytes").(metrics.Histogram)
+	if !ok {
+		t.Fatal("srv.req.bytes not registered")
+	}
+	if _, ok := hist.Sample().(*metrics.ExpDecaySample); !ok {
+		t.Fatalf("expect an exponentially decaying sample, got %T", hist.Sample())
+	}
+}
+
+// countingHistogram is a server.Histogram keeping only the count.
+type countingHistogram struct {
+	count int64 // atomic visit
+}
+
+func (ch *countingHistogram) Observe(int64) {
+	atomic.AddInt64(&ch.count, 1)
+}
+
+func (ch *countingHistogram) Distribution() server.Distribution {
+	return server.Distribution{Count: atomic.LoadInt64(&ch.count)}
+}
+
+func TestNewServerHistogramFactory(t *testing.T) {
+	reqBytes := &countingHistogram{}
+	_, addr := serveNewServer(t, func(srv *server.Server) {
+		srv.NewHistogram = func(name string) server.Histogram {
+			if name == "srv.req.bytes" {
+				return reqBytes
+			}
+			return &countingHistogram{}
+		}
+	}, func(srv *server.Server) {
+		srv.HandleFunc("echo", func(req []byte) ([]byte, error) {
+			return req, nil
+		})
+	})
+	cli := NewClient(&client.Config{Timeout: time.Second})
+	for i := 0; i < 3; i++ {
+		if _, err := cli.Call(context.Background(), addr, "echo", []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&reqBytes.count); n != 3 {
+		t.Fatalf("expect the factory histogram to observe 3 requests, got %v", n)
+	}
+}
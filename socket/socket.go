@@ -12,6 +12,22 @@ import (
 )
 
 func ReadSocket(ctx context.Context, reader *bufio.Reader) (*models.Header, []byte, bool, error) {
+	return ReadSocketBuf(ctx, reader, nil)
+}
+
+// ReadSocketBuf is ReadSocket reading the body into alloc(header.Length),
+// e.g. a pooled buffer; nil alloc allocates a new one.
+func ReadSocketBuf(ctx context.Context, reader *bufio.Reader, alloc func(n int) []byte) (*models.Header, []byte, bool, error) {
+	return readSocket(ctx, reader, alloc, nil)
+}
+
+// ReadSocketProgress is ReadSocket calling progress with the body bytes read
+// so far as the body arrives, e.g. to grant flow control credit to the sender.
+func ReadSocketProgress(ctx context.Context, reader *bufio.Reader, progress func(header *models.Header, read int)) (*models.Header, []byte, bool, error) {
+	return readSocket(ctx, reader, nil, progress)
+}
+
+func readSocket(ctx context.Context, reader *bufio.Reader, alloc func(n int) []byte, progress func(header *models.Header, read int)) (*models.Header, []byte, bool, error) {
 	select {
 	case <-ctx.Done():
 		return nil, nil, false, errors.ErrCtxReadDone
@@ -42,11 +58,23 @@ func ReadSocket(ctx context.Context, reader *bufio.Reader) (*models.Header, []by
 	header.Length = binary.BigEndian.Uint16(headerBuf[6:])
 
 	if header.Length <= 0 {
+		if err := readSentinel(reader, header); err != nil {
+			return nil, nil, true, err
+		}
 		return header, nil, false, nil
 	}
 
-	bodyBuf := make([]byte, header.Length)
-	n, err = io.ReadFull(reader, bodyBuf)
+	var bodyBuf []byte
+	if alloc != nil {
+		bodyBuf = alloc(int(header.Length))
+	} else {
+		bodyBuf = make([]byte, header.Length)
+	}
+	if progress == nil {
+		n, err = io.ReadFull(reader, bodyBuf)
+	} else {
+		n, err = readProgress(reader, bodyBuf, func(read int) { progress(header, read) })
+	}
 	if err != nil {
 		if err == io.EOF {
 			return header, nil, true, io.ErrUnexpectedEOF
@@ -57,11 +85,102 @@ func ReadSocket(ctx context.Context, reader *bufio.Reader) (*models.Header, []by
 	if n < int(header.Length) {
 		return nil, nil, false, errors.ErrInvalidBody
 	}
+	if err := readSentinel(reader, header); err != nil {
+		return nil, nil, true, err
+	}
 
 	return header, bodyBuf, false, nil
 }
 
+// readProgress is io.ReadFull reporting each read.
+func readProgress(reader io.Reader, buf []byte, progress func(read int)) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := reader.Read(buf[n:])
+		n += m
+		if m > 0 {
+			progress(n)
+		}
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// HasSentinel reports if frames of version end with constant.FrameSentinel.
+func HasSentinel(version uint16) bool {
+	return version >= constant.SentinelVersion
+}
+
+// readSentinel checks the sentinel ending a frame of header.Version, the
+// header and Length bytes of body are already consumed.
+func readSentinel(reader *bufio.Reader, header *models.Header) error {
+	if !HasSentinel(header.Version) {
+		return nil
+	}
+	buf := make([]byte, SentinelSize)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if binary.BigEndian.Uint16(buf) != constant.FrameSentinel {
+		return errors.ErrFrameSentinel
+	}
+	return nil
+}
+
 func WriteSocket(ctx context.Context, writer *bufio.Writer, header *models.Header, body []byte) (bool, error) {
+	broken, err := WriteFrame(ctx, writer, header, body)
+	if err != nil {
+		return broken, err
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return true, err
+	}
+
+	return false, nil
+}
+
+// WriteChunked writes body as one frame, or split into frames of at most
+// constant.MaxFrameBodySize flagged with constant.FlagMoreChunks but the last,
+// then flushes. Any failure after the first chunk is broken, the peer holds
+// an incomplete request.
+func WriteChunked(ctx context.Context, writer *bufio.Writer, header *models.Header, body []byte) (bool, error) {
+	return WriteChunkedSize(ctx, writer, header, body, constant.MaxFrameBodySize)
+}
+
+// WriteChunkedSize is WriteChunked with frames of at most size bytes, e.g. the
+// max frame size agreed with the peer.
+func WriteChunkedSize(ctx context.Context, writer *bufio.Writer, header *models.Header, body []byte, size int) (bool, error) {
+	if size <= 0 || size > constant.MaxFrameBodySize {
+		size = constant.MaxFrameBodySize
+	}
+	chunked := false
+	for len(body) > size {
+		chunk := *header
+		chunk.Code |= constant.FlagMoreChunks
+		broken, err := WriteFrame(ctx, writer, &chunk, body[:size])
+		if err != nil {
+			return broken || chunked, err
+		}
+		chunked = true
+		body = body[size:]
+	}
+	broken, err := WriteSocket(ctx, writer, header, body)
+	return broken || (err != nil && chunked), err
+}
+
+// WriteFrame writes one frame into writer without flushing it, so several frames
+// can leave in a single syscall. The caller is responsible for the Flush.
+func WriteFrame(ctx context.Context, writer *bufio.Writer, header *models.Header, body []byte) (bool, error) {
 	select {
 	case <-ctx.Done():
 		return false, errors.ErrCtxWriteDone
@@ -74,24 +193,39 @@ func WriteSocket(ctx context.Context, writer *bufio.Writer, header *models.Heade
 	}
 	header.Length = uint16(length)
 
-	buf := make([]byte, models.HeaderSize+length)
-	binary.BigEndian.PutUint16(buf, header.Magic)
-	binary.BigEndian.PutUint16(buf[2:], header.Version)
-	binary.BigEndian.PutUint16(buf[4:], header.Code)
-	binary.BigEndian.PutUint16(buf[6:], header.Length)
+	size := models.HeaderSize + length
+	if HasSentinel(header.Version) {
+		size += SentinelSize
+	}
+	buf := make([]byte, size)
+	PutHeader(buf, header)
 	if length > 0 {
 		copy(buf[models.HeaderSize:], body)
 	}
-
-	_, err := writer.Write(buf)
-	if err != nil {
-		return true, err
+	if HasSentinel(header.Version) {
+		PutSentinel(buf[models.HeaderSize+length:])
 	}
 
-	err = writer.Flush()
+	_, err := writer.Write(buf)
 	if err != nil {
 		return true, err
 	}
 
 	return false, nil
 }
+
+// SentinelSize is the size of the sentinel ending a frame, see HasSentinel.
+const SentinelSize = 2
+
+// PutSentinel encodes constant.FrameSentinel into the first SentinelSize bytes of buf.
+func PutSentinel(buf []byte) {
+	binary.BigEndian.PutUint16(buf, constant.FrameSentinel)
+}
+
+// PutHeader encodes header into the first models.HeaderSize bytes of buf.
+func PutHeader(buf []byte, header *models.Header) {
+	binary.BigEndian.PutUint16(buf, header.Magic)
+	binary.BigEndian.PutUint16(buf[2:], header.Version)
+	binary.BigEndian.PutUint16(buf[4:], header.Code)
+	binary.BigEndian.PutUint16(buf[6:], header.Length)
+}